@@ -3,13 +3,17 @@ module github.com/Kh4n/url-shortener-unity
 go 1.15
 
 require (
+	github.com/alicebob/miniredis/v2 v2.30.0
 	github.com/bradfitz/gomemcache v0.0.0-20190913173617-a41fca850d0b
 	github.com/dgraph-io/badger v1.6.2
 	github.com/golang/protobuf v1.4.2 // indirect
+	github.com/gomodule/redigo v1.8.4
 	github.com/google/go-cmp v0.5.5 // indirect
+	github.com/hashicorp/raft v1.3.11
+	github.com/hashicorp/raft-boltdb/v2 v2.2.2
 	github.com/pkg/errors v0.9.1 // indirect
 	github.com/stretchr/testify v1.7.0 // indirect
-	golang.org/x/net v0.0.0-20201202161906-c7110b5ffcbb // indirect
-	golang.org/x/sys v0.0.0-20210112080510-489259a85091 // indirect
-	golang.org/x/xerrors v0.0.0-20200804184101-5ec99f83aff1 // indirect
+	go.etcd.io/bbolt v1.3.6
+	golang.org/x/net v0.0.0-20201202161906-c7110b5ffcbb
+	modernc.org/sqlite v1.14.8
 )
@@ -0,0 +1,125 @@
+package shortener
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/dgraph-io/badger"
+)
+
+const (
+	// the trailer a backup response reports its version in, to be passed
+	// as since for the next incremental backup
+	BACKUP_VERSION_TRAILER = "X-Backup-Version"
+	// how many pending writes badger buffers while loading a backup
+	RESTORE_MAX_PENDING_WRITES = 256
+)
+
+var (
+	ErrBackupUnsupported = errors.New("storage backend does not support backups")
+)
+
+// BackupStore is a LinkStore that can stream online backups of itself
+type BackupStore interface {
+	// Backup writes every entry newer than version since to w, and returns
+	// the version to pass as since for the next incremental backup. A
+	// since of 0 makes a full backup
+	Backup(w io.Writer, since uint64) (uint64, error)
+}
+
+// Backup streams a backup of the store while it keeps serving. Only the
+// badger backend supports backups
+func (store *URLStore) Backup(w io.Writer, since uint64) (uint64, error) {
+	return backupEngine(store.db, w, since)
+}
+
+func backupEngine(db kvEngine, w io.Writer, since uint64) (uint64, error) {
+	if s, ok := db.(*swapEngine); ok {
+		// the engine is not swapped out until the backup is done
+		s.lock.RLock()
+		defer s.lock.RUnlock()
+		db = s.engine
+	}
+	e, ok := db.(*badgerEngine)
+	if !ok {
+		return 0, ErrBackupUnsupported
+	}
+	last, err := e.db.Backup(w, since)
+	if err != nil {
+		return 0, err
+	}
+	// badger returns the last version it dumped, and includes since itself
+	// in the next backup
+	if last+1 < since {
+		return since, nil
+	}
+	return last + 1, nil
+}
+
+// RestoreBackup loads a full backup followed by any incremental backups,
+// in the order they were taken, into a new badger database at path. path
+// must not exist or be an empty directory
+func RestoreBackup(path string, backups ...io.Reader) error {
+	files, err := ioutil.ReadDir(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	} else if len(files) > 0 {
+		return fmt.Errorf("restore target is not empty: %s", path)
+	}
+	db, err := badger.Open(badger.DefaultOptions(path))
+	if err != nil {
+		return err
+	}
+	for i, r := range backups {
+		if err := db.Load(r, RESTORE_MAX_PENDING_WRITES); err != nil {
+			db.Close()
+			return fmt.Errorf("loading backup %d: %w", i, err)
+		}
+	}
+	return db.Close()
+}
+
+func (ms *MainServer) backup(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("400 - Bad Request"))
+		return
+	}
+	var since uint64
+	if s := r.Form.Get("since"); s != "" {
+		since, err = strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("400 - Bad Request"))
+			return
+		}
+	}
+	store, ok := ms.store.(BackupStore)
+	if !ok {
+		w.WriteHeader(http.StatusNotImplemented)
+		w.Write([]byte("501 - Not Implemented"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Trailer", BACKUP_VERSION_TRAILER)
+	version, err := store.Backup(w, since)
+	if errors.Is(err, ErrBackupUnsupported) {
+		w.WriteHeader(http.StatusNotImplemented)
+		w.Write([]byte("501 - Not Implemented"))
+		return
+	} else if err != nil {
+		// the status has most likely been sent already, so a missing
+		// trailer is how clients find out the backup is incomplete
+		log.Printf("Error streaming backup: %s\n", err.Error())
+		return
+	}
+	w.Header().Set(BACKUP_VERSION_TRAILER, strconv.FormatUint(version, 10))
+}
@@ -0,0 +1,87 @@
+package shortener
+
+import (
+	"bytes"
+	"net/url"
+	"os"
+	"strconv"
+	"testing"
+)
+
+func TestBackupRestore(t *testing.T) {
+	testDB, restoreDB := "./test_db_backup", "./test_db_restore"
+	t.Cleanup(func() {
+		os.RemoveAll(testDB)
+		os.RemoveAll(restoreDB)
+	})
+	store, err := NewURLStore(testDB)
+	if err != nil {
+		t.Fatalf("Unable to create test store: %s", err.Error())
+	}
+	first, err := store.Store("http://example.com/1", LinkOptions{})
+	if err != nil {
+		t.Fatalf("Unable to store url: %s", err.Error())
+	}
+	var full, incremental bytes.Buffer
+	version, err := store.Backup(&full, 0)
+	if err != nil {
+		t.Fatalf("Unable to back up: %s", err.Error())
+	}
+	second, err := store.Store("http://example.com/2", LinkOptions{})
+	if err != nil {
+		t.Fatalf("Unable to store url: %s", err.Error())
+	}
+	if _, err := store.Backup(&incremental, version); err != nil {
+		t.Fatalf("Unable to back up: %s", err.Error())
+	}
+	store.Close()
+
+	if err := RestoreBackup(testDB, &full); err == nil {
+		t.Errorf("Expected restoring into a non-empty directory to fail")
+	}
+	if err := RestoreBackup(restoreDB, &full, &incremental); err != nil {
+		t.Fatalf("Unable to restore: %s", err.Error())
+	}
+	restored, err := NewURLStore(restoreDB)
+	if err != nil {
+		t.Fatalf("Unable to open restored store: %s", err.Error())
+	}
+	defer restored.Close()
+	for key, urlStr := range map[string]string{first: "http://example.com/1", second: "http://example.com/2"} {
+		if rec, err := restored.Query(key); err != nil || rec.URL != urlStr {
+			t.Errorf("Expected %s to be restored, got: %+v, %v", urlStr, rec, err)
+		}
+	}
+
+	memory, _ := NewMemoryURLStore()
+	if _, err := memory.Backup(&full, 0); err != ErrBackupUnsupported {
+		t.Errorf("Expected ErrBackupUnsupported, got: %v", err)
+	}
+}
+
+func TestMainServerBackup(t *testing.T) {
+	testDB := "./test_db_backup_server"
+	t.Cleanup(func() {
+		os.RemoveAll(testDB)
+	})
+	server, err := NewMainServer(testDB)
+	if err != nil {
+		t.Fatalf("Unable to create test server: %s", err.Error())
+	}
+	defer server.Close()
+	if _, err := server.store.Store("http://example.com", LinkOptions{}); err != nil {
+		t.Fatalf("Unable to store url: %s", err.Error())
+	}
+
+	rec := RecordGet(server.mux, BACKUP_ENDPOINT, url.Values{})
+	if rec.Code != 200 || rec.Body.Len() == 0 {
+		t.Errorf("Expected a backup, got status %d with %d bytes", rec.Code, rec.Body.Len())
+	}
+	if _, err := strconv.ParseUint(rec.Result().Trailer.Get(BACKUP_VERSION_TRAILER), 10, 64); err != nil {
+		t.Errorf("Expected a backup version trailer: %s", err.Error())
+	}
+	rec = RecordGet(server.mux, BACKUP_ENDPOINT+"?since=abc", url.Values{})
+	if rec.Code != 400 {
+		t.Errorf("Expected status 400 for a bad since, got: %d", rec.Code)
+	}
+}
@@ -3,21 +3,18 @@ package shortener
 import (
 	"encoding/json"
 	"errors"
+	"expvar"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"net/url"
 	"os"
 	"os/signal"
-	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
-
-	"github.com/bradfitz/gomemcache/memcache"
-)
-
-var (
-	ErrEmptyStack = errors.New("Pop from empty stack")
 )
 
 const (
@@ -25,86 +22,137 @@ const (
 	KEY_EXISTS uint32 = 1
 
 	KEY_404_EXPIRE = 10 // seconds
+	// links are only cached for this long, as deletes, disables and updates
+	// sent to a db server directly do not evict them from the cache
+	KEY_CACHE_EXPIRE = 10 * 60 // seconds
+
+	// reservations are sized to last about this long at the rate keys
+	// were handed out since the last one
+	REFILL_TARGET_PERIOD = 1 * time.Minute
+	REFILL_RETRY         = 1 * time.Second
+	// how often expired reserved keys are discarded
+	KEY_EVICT_INTERVAL = 1 * time.Minute
+)
+
+// refill metrics, served from /debug/vars
+var (
+	reserveRefills = expvar.NewInt("reserve_refills")
+	reserveErrors  = expvar.NewInt("reserve_errors")
 )
 
 type cacheKey struct {
 	key    string
 	expiry int64
+	// the db server the key was reserved from, which is the one that owns it
+	host string
 }
 
-//KeyStack: thread safe stack
-type KeyStack struct {
-	stack []cacheKey
-	lock  sync.Mutex
-}
-
-func (ks *KeyStack) PushAll(vals []cacheKey) {
-	ks.lock.Lock()
-	ks.stack = append(ks.stack, vals...)
-	ks.lock.Unlock()
-}
-
-func (ks *KeyStack) Pop() (cacheKey, error) {
-	ks.lock.Lock()
-	if len(ks.stack) == 0 {
-		ks.lock.Unlock()
-		return cacheKey{}, ErrEmptyStack
-	}
-	ret := ks.stack[len(ks.stack)-1]
-	ks.stack = ks.stack[:len(ks.stack)-1]
-	ks.lock.Unlock()
-	return ret, nil
+// savedKey is a reserved key as kept in a cache server's key file
+type savedKey struct {
+	Key    string `json:"key"`
+	Expiry int64  `json:"expiry"`
+	Host   string `json:"host"`
 }
 
 type CacheServer struct {
-	mc     *memcache.Client
+	cache  LinkCache
 	mux    *http.ServeMux
 	client *http.Client
 
-	dbServer   string
+	shards *Rendezvous
+	// round robins reservations over the shards
+	nextShard uint32
+	// the size of the next reservation, adapted between minReserve and
+	// MAX_RESERVE_NUM by the refill worker
 	reserveAmt uint32
-	ks         KeyStack
+	minReserve uint32
+	kq         KeyQueue
+	// the refill worker reserves keys whenever the queue drops to watermark
+	watermark int
+	// keys handed out since the last refill
+	popped     uint32
+	lastRefill time.Time
+	refill     chan struct{}
+	stopRefill chan struct{}
+	refillDone chan struct{}
+	canon      *Canonicalizer
+	queries    queryGroup
+	// nil until OpenOutbox is called
+	outbox *outbox
+	// where unused keys are saved on shutdown, empty to release them
+	keyFile string
 }
 
 func NewCacheServer(memcachedHost, dbServerHost string, reserveAmt uint32) (*CacheServer, error) {
+	return NewShardedCacheServer(memcachedHost, []string{dbServerHost}, reserveAmt)
+}
+
+// NewShardedCacheServer creates a cache server in front of db servers that
+// each hold one shard of the keys, routing every key with rendezvous
+// hashing over dbServerHosts
+func NewShardedCacheServer(memcachedHost string, dbServerHosts []string, reserveAmt uint32) (*CacheServer, error) {
+	cache, err := NewMemcachedCache(memcachedHost)
+	if err != nil {
+		return nil, err
+	}
+	return NewCacheServerWithCache(cache, dbServerHosts, reserveAmt)
+}
+
+// NewCacheServerWithCache creates a sharded cache server caching query
+// responses in cache
+func NewCacheServerWithCache(cache LinkCache, dbServerHosts []string, reserveAmt uint32) (*CacheServer, error) {
+	shards, err := NewRendezvous(dbServerHosts)
+	if err != nil {
+		return nil, err
+	}
 	ret := &CacheServer{
-		mc:     memcache.New(memcachedHost),
+		cache:  cache,
 		client: &http.Client{},
 		mux:    http.NewServeMux(),
 
+		shards:     shards,
 		reserveAmt: reserveAmt,
-		dbServer:   fmt.Sprintf("http://%s", dbServerHost),
+		minReserve: reserveAmt,
+		watermark:  int(reserveAmt / 4),
+		canon:      NewCanonicalizer(DEFAULT_TRACKING_PARAMS),
 	}
 	ret.mux.HandleFunc(QUERY_ENDPOINT, ret.query)
 	ret.mux.HandleFunc(SHORTEN_ENDPOINT, ret.shorten)
+	ret.mux.HandleFunc(DELETE_ENDPOINT, ret.invalidate)
+	ret.mux.HandleFunc(DISABLE_ENDPOINT, ret.invalidate)
+	ret.mux.HandleFunc(UPDATE_ENDPOINT, ret.invalidate)
+	ret.mux.Handle(METRICS_ENDPOINT, expvar.Handler())
 
-	err := CheckAll([]string{
-		ret.dbServer,
-		SingleJoiningSlash(ret.dbServer, SHORTEN_ENDPOINT),
-		SingleJoiningSlash(ret.dbServer, QUERY_ENDPOINT),
-		SingleJoiningSlash(ret.dbServer, RESERVE_ENDPOINT),
-		SingleJoiningSlash(ret.dbServer, SETRESERVE_ENDPOINT),
-	})
-	if err != nil {
-		return nil, fmt.Errorf("unable to connect to main server: %s", err)
-	}
-	err = nil
-	for i := 0; i < 10; i++ {
-		err = ret.mc.Ping()
-		if err == nil {
-			break
+	for _, host := range shards.Hosts() {
+		dbServer := dbServerURL(host)
+		err := CheckAll([]string{
+			dbServer,
+			SingleJoiningSlash(dbServer, SHORTEN_ENDPOINT),
+			SingleJoiningSlash(dbServer, QUERY_ENDPOINT),
+			SingleJoiningSlash(dbServer, RESERVE_ENDPOINT),
+			SingleJoiningSlash(dbServer, SETRESERVE_ENDPOINT),
+			SingleJoiningSlash(dbServer, DELETE_ENDPOINT),
+			SingleJoiningSlash(dbServer, DISABLE_ENDPOINT),
+			SingleJoiningSlash(dbServer, UPDATE_ENDPOINT),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("unable to connect to main server %s: %s", host, err)
 		}
-		log.Printf("Unable to connect to cache server, retrying in 1s")
-		time.Sleep(1 * time.Second)
-	}
-	if err != nil {
-		return nil, fmt.Errorf("unable to connect to memcached server: %s", err)
 	}
 	return ret, nil
 }
 
+func dbServerURL(host string) string {
+	return fmt.Sprintf("http://%s", host)
+}
+
+// dbServerFor returns the db server owning key
+func (cs *CacheServer) dbServerFor(key string) string {
+	return dbServerURL(cs.shards.Owner(key))
+}
+
 func (cs *CacheServer) Start(port uint) error {
-	c := make(chan os.Signal)
+	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		<-c
@@ -114,11 +162,182 @@ func (cs *CacheServer) Start(port uint) error {
 		}
 		os.Exit(0)
 	}()
+	cs.startRefill()
 	log.Printf("Starting cache server on :%d\n", port)
 	return http.ListenAndServe(fmt.Sprintf(":%d", port), cs.mux)
 }
 
+// SetCanonicalizer replaces the default canonicalizer. It must be called
+// before the server is started
+func (cs *CacheServer) SetCanonicalizer(canon *Canonicalizer) {
+	cs.canon = canon
+}
+
+// SetRefillWatermark sets how few keys may be left before more are
+// reserved. It must be called before the server is started
+func (cs *CacheServer) SetRefillWatermark(watermark int) {
+	cs.watermark = watermark
+}
+
+// OpenOutbox queues shortens made with reserved keys in a bbolt file at
+// path until the db server accepted them, retrying with exponential
+// backoff. Without an outbox they are sent once and lost if that fails.
+// It must be called before the server is started
+func (cs *CacheServer) OpenOutbox(path string) error {
+	o, err := openOutbox(path, cs.sendSetReserve)
+	if err != nil {
+		return err
+	}
+	cs.outbox = o
+	return nil
+}
+
+// OpenKeyFile loads the reserved keys saved at path by the last shutdown,
+// and saves the keys left over to it on the next one. Without a key file,
+// unused keys are released to the db servers on shutdown instead. It must
+// be called before the server is started
+func (cs *CacheServer) OpenKeyFile(path string) error {
+	raw, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		cs.keyFile = path
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var saved []savedKey
+	if err := json.Unmarshal(raw, &saved); err != nil {
+		return fmt.Errorf("corrupt key file %s: %s", path, err.Error())
+	}
+	// the keys are ours now. if we crash before saving them again they
+	// are wasted, but a stale file would hand them out twice
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+	hosts := map[string]bool{}
+	for _, host := range cs.shards.Hosts() {
+		hosts[host] = true
+	}
+	now := time.Now().Unix()
+	keys := make([]cacheKey, 0, len(saved))
+	moved := []cacheKey{}
+	for _, k := range saved {
+		key := cacheKey{key: k.Key, expiry: k.Expiry, host: k.Host}
+		// keys of shards we no longer use cannot be set anywhere
+		if k.Expiry <= now || !hosts[k.Host] {
+			continue
+		}
+		if cs.ownedByHost(key) {
+			keys = append(keys, key)
+		} else {
+			moved = append(moved, key)
+		}
+	}
+	if err := cs.releaseKeys(moved); err != nil {
+		log.Printf("Unable to release %d keys owned by other shards: %s\n", len(moved), err.Error())
+	}
+	cs.kq.PushAll(keys)
+	cs.keyFile = path
+	log.Printf("Loaded %d of %d saved keys from %s\n", len(keys), len(saved), path)
+	return nil
+}
+
+// saveKeys writes keys to the key file, replacing it in one go so that a
+// crash part way never leaves a truncated file behind
+func (cs *CacheServer) saveKeys(keys []cacheKey) error {
+	saved := make([]savedKey, 0, len(keys))
+	for _, k := range keys {
+		saved = append(saved, savedKey{Key: k.key, Expiry: k.expiry, Host: k.host})
+	}
+	raw, err := json.Marshal(saved)
+	if err != nil {
+		return err
+	}
+	tmp := cs.keyFile + ".tmp"
+	if err := ioutil.WriteFile(tmp, raw, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, cs.keyFile)
+}
+
+// ownedByHost reports whether key still belongs to the shard it was
+// reserved from. After the shards change, a key set on a shard that no
+// longer owns it would be queried on its new owner and not be found
+func (cs *CacheServer) ownedByHost(key cacheKey) bool {
+	return cs.shards.Owner(key.key) == key.host
+}
+
+// releaseKeys returns keys to the db servers they were reserved from
+func (cs *CacheServer) releaseKeys(keys []cacheKey) error {
+	byHost := map[string][]string{}
+	for _, k := range keys {
+		byHost[k.host] = append(byHost[k.host], k.key)
+	}
+	for host, hostKeys := range byHost {
+		for len(hostKeys) > 0 {
+			n := len(hostKeys)
+			if n > MAX_RESERVE_NUM {
+				n = MAX_RESERVE_NUM
+			}
+			body, err := ReadPost(
+				cs.client, SingleJoiningSlash(dbServerURL(host), RELEASE_ENDPOINT),
+				url.Values{"key": hostKeys[:n]},
+			)
+			if err != nil {
+				return err
+			}
+			var jsonResp ReserveResponse
+			if err := json.Unmarshal(body, &jsonResp); err != nil {
+				return err
+			}
+			if !jsonResp.Succeeded {
+				return errors.New(jsonResp.ErrorMsg)
+			}
+			hostKeys = hostKeys[n:]
+		}
+	}
+	return nil
+}
+
+// returnKeys saves our unused keys for the next start, or releases them
+// if there is no key file or saving them failed
+func (cs *CacheServer) returnKeys() error {
+	now := time.Now().Unix()
+	keys := []cacheKey{}
+	for _, k := range cs.kq.Drain() {
+		if k.expiry > now {
+			keys = append(keys, k)
+		}
+	}
+	if cs.keyFile != "" {
+		err := cs.saveKeys(keys)
+		if err == nil {
+			return nil
+		}
+		log.Printf("Error saving keys, releasing them instead: %s\n", err.Error())
+	}
+	return cs.releaseKeys(keys)
+}
+
 func (cs *CacheServer) Close() error {
+	if cs.stopRefill != nil {
+		close(cs.stopRefill)
+		<-cs.refillDone
+	}
+	if err := cs.returnKeys(); err != nil {
+		log.Printf("Error returning unused keys: %s\n", err.Error())
+	}
+	if cs.outbox != nil {
+		if err := cs.outbox.close(); err != nil {
+			log.Printf("Error closing outbox: %s\n", err.Error())
+			return err
+		}
+	}
+	if closer, ok := cs.cache.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			log.Printf("Error closing cache: %s\n", err.Error())
+			return err
+		}
+	}
 	log.Println("Closed cache server successfully")
 	return nil
 }
@@ -132,32 +351,84 @@ func (cs *CacheServer) query(w http.ResponseWriter, r *http.Request) {
 	}
 	key := r.Form.Get("key")
 	// first check our cache
-	urlIt, err := cs.mc.Get(key)
+	cachedRaw, err := cs.cache.Get(key)
 	if err == nil {
-		WriteRawJSON(w, urlIt.Value)
+		var cached SetShortenQueryResponse
+		if err := json.Unmarshal(cachedRaw, &cached); err == nil {
+			writeQueryResp(w, cachedRaw, &cached)
+			return
+		}
+	}
+	// query the main server if we have a cache miss. misses of the same
+	// key share a single query, and a single cache write
+	jsonResp, raw, err := cs.queries.do(key, func() (SetShortenQueryResponse, []byte, error) {
+		jsonResp, raw, err := PostSetShortenQuery(
+			cs.client, SingleJoiningSlash(cs.dbServerFor(key), QUERY_ENDPOINT),
+			url.Values{"key": {key}},
+		)
+		if err != nil {
+			return SetShortenQueryResponse{}, nil, fmt.Errorf("parsing response: %s", err.Error())
+		}
+		if err := cs.cacheResp(raw, &jsonResp); err != nil {
+			return SetShortenQueryResponse{}, nil, fmt.Errorf("caching response: %s", err.Error())
+		}
+		return jsonResp, raw, nil
+	})
+	if err != nil {
+		log.Printf("Internal server error querying key: %s\n", err.Error())
+		http.Error(w, "Internal server error querying key", http.StatusInternalServerError)
+		return
+	}
+	switch {
+	case jsonResp.Gone():
+		writeQueryResp(w, raw, &jsonResp)
+	case jsonResp.Succeeded:
+		http.Redirect(w, r, jsonResp.OriginalURL, REDIRECT_STATUS)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// writeQueryResp answers a query with the main server's response. links
+// that may no longer be followed are served as 410 Gone so that they are
+// never redirected to
+func writeQueryResp(w http.ResponseWriter, raw []byte, jsonResp *SetShortenQueryResponse) {
+	if jsonResp.Gone() {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusGone)
+		w.Write(raw)
+		return
+	}
+	WriteRawJSON(w, raw)
+}
+
+// invalidate forwards a request changing a link (delete, disable or
+// update) to the main server and evicts the key from our cache once it
+// went through
+func (cs *CacheServer) invalidate(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("400 - Bad Request"))
 		return
 	}
-	// query the main server if we have a cache miss
 	jsonResp, raw, err := PostSetShortenQuery(
-		cs.client, SingleJoiningSlash(cs.dbServer, QUERY_ENDPOINT),
-		url.Values{"key": {key}},
+		cs.client, SingleJoiningSlash(cs.dbServerFor(r.Form.Get("key")), r.URL.Path), r.Form,
 	)
 	if err != nil {
 		log.Printf("Internal server error parsing response: %s\n", err.Error())
 		http.Error(w, "Internal server error parsing response", http.StatusInternalServerError)
 		return
 	}
-	err = cs.cacheResp(raw, &jsonResp)
-	if err != nil {
-		log.Printf("Internal server error caching response: %s\n", err.Error())
-		http.Error(w, "Internal server error caching response", http.StatusInternalServerError)
-		return
-	}
 	if jsonResp.Succeeded {
-		http.Redirect(w, r, jsonResp.OriginalURL, REDIRECT_STATUS)
-	} else {
-		http.NotFound(w, r)
+		err = cs.cache.Delete(jsonResp.Key)
+		if err != nil {
+			log.Printf("Internal server error evicting key: %s\n", err.Error())
+			http.Error(w, "Internal server error evicting key", http.StatusInternalServerError)
+			return
+		}
 	}
+	WriteRawJSON(w, raw)
 }
 
 func (cs *CacheServer) shorten(w http.ResponseWriter, r *http.Request) {
@@ -168,73 +439,213 @@ func (cs *CacheServer) shorten(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	urlStr := r.Form.Get("url")
 	// validate url early as opposed to asking main server to validate it
-	if !ValidUrl(urlStr) {
+	urlStr, err := cs.canon.Canonicalize(r.Form.Get("url"))
+	if err != nil {
 		resp := SetShortenQueryResponse{
 			Succeeded:   false,
 			Key:         "",
-			OriginalURL: urlStr,
-			ErrorMsg:    fmt.Sprintf("Invalid url: %s", urlStr),
+			OriginalURL: r.Form.Get("url"),
+			ErrorMsg:    err.Error(),
+			ErrorCode:   ErrorCode(err),
 		}
 		WriteJSON(w, resp)
 		return
 	}
-	key, err := cs.ks.Pop()
-	// can't use expired keys as the main server has reclaimed them
-	if err == nil && key.expiry > time.Now().Unix() {
-		// we still need to update the main server, but that can be done
-		// asynchronously. this means that other cache servers will not
-		// immediately experience the changes until the main server receives this request
-		go func() {
-			jsonResp, err := cs.setReserve(key.key, urlStr)
-			if err != nil {
-				log.Printf("Internal server error pushing shorten: %s\n", err.Error())
-			} else if !jsonResp.Succeeded {
-				log.Printf("Internal server error pushing shorten: %s\n", jsonResp.ErrorMsg)
-			}
-		}()
+	// resolve relative expiries now, so that the main server stores the
+	// same expiry we hand back to the user
+	opts := LinkOptions{Creator: r.Form.Get("creator"), Dedupe: r.Form.Get("dedupe") == "true"}
+	opts.ExpiresAt, err = ParseExpiry(r.Form.Get("expiry"), time.Now())
+	if err != nil {
+		WriteJSON(w, SetShortenQueryResponse{
+			Succeeded:   false,
+			OriginalURL: urlStr,
+			ErrorMsg:    err.Error(),
+			ErrorCode:   ErrorCode(err),
+		})
+		return
+	}
+	// aliases cannot use our reserved keys, so they always go to the main server
+	alias := r.Form.Get("alias")
+	if alias != "" {
+		if err := ValidAlias(alias); err != nil {
+			WriteJSON(w, SetShortenQueryResponse{
+				Succeeded:   false,
+				OriginalURL: urlStr,
+				ErrorMsg:    err.Error(),
+				ErrorCode:   ErrorCode(err),
+			})
+			return
+		}
+		cs.shortenUpstream(w, urlStr, alias, opts)
+		return
+	}
+	// only the main server knows whether the url was shortened before, so
+	// our reserved keys cannot be used when deduplicating
+	if opts.Dedupe {
+		cs.shortenUpstream(w, urlStr, "", opts)
+		return
+	}
+	// expired keys are never handed out, as the main server has reclaimed them
+	key, err := cs.kq.Pop(time.Now())
+	if err == nil {
+		atomic.AddUint32(&cs.popped, 1)
+	}
+	if cs.kq.Len() <= cs.watermark {
+		cs.triggerRefill()
+	}
+	if err == nil {
 		resp := SetShortenQueryResponse{
 			Succeeded:   true,
 			Key:         key.key,
 			OriginalURL: urlStr,
 		}
+		resp.SetExpiresAt(opts.ExpiresAt)
 		raw, err := json.Marshal(resp)
 		if err != nil {
 			log.Printf("Internal server error marshalling response: %s\n", err.Error())
 			http.Error(w, "Internal server error marshalling response", http.StatusInternalServerError)
 		}
+		// the link is cached before the main server is told about it, so
+		// that a rejection evicts it after it was cached, not before
 		err = cs.cacheResp(raw, &resp)
 		if err != nil {
 			log.Printf("Internal server error caching key: %s\n", err.Error())
 			http.Error(w, "Internal server error caching key", http.StatusInternalServerError)
 			return
 		}
+		// we still need to update the main server, but that can be done
+		// asynchronously. this means that other cache servers will not
+		// immediately experience the changes until the main server receives this request
+		if cs.outbox != nil {
+			err := cs.outbox.push(key.host, setReserveArgs(key.key, urlStr, opts))
+			if err != nil {
+				cs.evict(key.key)
+				log.Printf("Internal server error queueing shorten: %s\n", err.Error())
+				http.Error(w, "Internal server error queueing shorten", http.StatusInternalServerError)
+				return
+			}
+		} else {
+			go func() {
+				jsonResp, err := cs.setReserve(key, urlStr, opts)
+				if err != nil {
+					log.Printf("Internal server error pushing shorten: %s\n", err.Error())
+				} else if !jsonResp.Succeeded {
+					cs.evict(key.key)
+					log.Printf("Internal server error pushing shorten: %s\n", jsonResp.ErrorMsg)
+				}
+			}()
+		}
 		WriteJSON(w, resp)
 		return
 	}
-	go func() {
-		err := cs.reserveKeys()
-		if err != nil {
-			log.Printf("Internal server error: %s\n", err.Error())
-		}
-	}()
 	// update the main server, synchronously this time as we have to wait
 	// for a response in order to serve the request
-	jsonResp, raw, err := cs.pushShorten(urlStr)
+	cs.shortenUpstream(w, urlStr, "", opts)
+}
+
+// shortenUpstream asks the main server to shorten the url and caches the
+// result. failures are not cached, as a failed alias would otherwise
+// shadow the url already stored under it
+func (cs *CacheServer) shortenUpstream(w http.ResponseWriter, urlStr, alias string, opts LinkOptions) {
+	jsonResp, raw, err := cs.pushShorten(urlStr, alias, opts)
 	if err != nil {
 		log.Printf("Internal server error pushing shorten: %s\n", err.Error())
 		http.Error(w, "Internal server error pushing shorten", http.StatusInternalServerError)
 		return
 	}
-	cs.cacheResp(raw, &jsonResp)
+	if jsonResp.Succeeded {
+		cs.cacheResp(raw, &jsonResp)
+	}
 	WriteJSON(w, jsonResp)
 }
 
+// startRefill starts the refill worker and fills the queue up front, so
+// that the first shortens need not wait on the main server
+func (cs *CacheServer) startRefill() {
+	cs.refill = make(chan struct{}, 1)
+	cs.stopRefill = make(chan struct{})
+	cs.refillDone = make(chan struct{})
+	cs.lastRefill = time.Now()
+	go cs.refillLoop()
+	cs.triggerRefill()
+}
+
+// triggerRefill wakes the refill worker. refills asked for while one is
+// pending or running are folded into it
+func (cs *CacheServer) triggerRefill() {
+	if cs.refill == nil {
+		return
+	}
+	select {
+	case cs.refill <- struct{}{}:
+	default:
+	}
+}
+
+// refillLoop reserves keys when asked to, and discards expired keys every
+// KEY_EVICT_INTERVAL, which may leave too few keys as well
+func (cs *CacheServer) refillLoop() {
+	defer close(cs.refillDone)
+	evict := time.NewTicker(KEY_EVICT_INTERVAL)
+	defer evict.Stop()
+	for {
+		select {
+		case <-cs.stopRefill:
+			return
+		case <-cs.refill:
+		case now := <-evict.C:
+			if n := cs.kq.Evict(now); n > 0 {
+				log.Printf("Discarded %d expired reserved keys\n", n)
+			}
+		}
+		for cs.kq.Len() <= cs.watermark {
+			cs.resize(time.Now())
+			err := cs.reserveKeys()
+			if err == nil {
+				reserveRefills.Add(1)
+				continue
+			}
+			reserveErrors.Add(1)
+			log.Printf("Error reserving keys: %s\n", err.Error())
+			select {
+			case <-cs.stopRefill:
+				return
+			case <-time.After(REFILL_RETRY):
+			}
+		}
+	}
+}
+
+// resize sizes the next reservation to last about REFILL_TARGET_PERIOD at
+// the rate keys were handed out since the last refill, averaged with the
+// last size so that a single burst does not swing it all the way
+func (cs *CacheServer) resize(now time.Time) {
+	popped := atomic.SwapUint32(&cs.popped, 0)
+	elapsed := now.Sub(cs.lastRefill)
+	cs.lastRefill = now
+	if elapsed <= 0 {
+		return
+	}
+	want := float64(popped) * float64(REFILL_TARGET_PERIOD) / float64(elapsed)
+	amt := (float64(atomic.LoadUint32(&cs.reserveAmt)) + want) / 2
+	if amt > MAX_RESERVE_NUM {
+		amt = MAX_RESERVE_NUM
+	}
+	if amt < float64(cs.minReserve) {
+		amt = float64(cs.minReserve)
+	}
+	atomic.StoreUint32(&cs.reserveAmt, uint32(amt))
+}
+
+// reserveKeys reserves keys from the next shard. shards only hand out
+// keys they own, so the keys can be set on the shard they came from
 func (cs *CacheServer) reserveKeys() error {
+	hosts := cs.shards.Hosts()
+	host := hosts[int(atomic.AddUint32(&cs.nextShard, 1)%uint32(len(hosts)))]
 	body, err := ReadPost(
-		cs.client, SingleJoiningSlash(cs.dbServer, RESERVE_ENDPOINT),
-		url.Values{"num": {fmt.Sprintf("%d", cs.reserveAmt)}},
+		cs.client, SingleJoiningSlash(dbServerURL(host), RESERVE_ENDPOINT),
+		url.Values{"num": {fmt.Sprintf("%d", atomic.LoadUint32(&cs.reserveAmt))}},
 	)
 	if err != nil {
 		return err
@@ -248,20 +659,40 @@ func (cs *CacheServer) reserveKeys() error {
 		return errors.New(jsonResp.ErrorMsg)
 	}
 	newKeys := make([]cacheKey, 0, len(jsonResp.Keys))
+	foreign := []cacheKey{}
 	for i := 0; i < len(jsonResp.Keys); i++ {
-		newKeys = append(newKeys, cacheKey{
+		key := cacheKey{
 			// only hold keys for 16 hours
-			jsonResp.Keys[i], time.Now().Add(CACHE_RESERVE_EXPIRY).Unix(),
-		})
+			jsonResp.Keys[i], time.Now().Add(CACHE_RESERVE_EXPIRY).Unix(), host,
+		}
+		// a shard started with other shards than ours hands out keys
+		// we would query elsewhere
+		if cs.ownedByHost(key) {
+			newKeys = append(newKeys, key)
+		} else {
+			foreign = append(foreign, key)
+		}
+	}
+	cs.kq.PushAll(newKeys)
+	if len(foreign) > 0 {
+		return cs.releaseKeys(foreign)
 	}
-	cs.ks.PushAll(newKeys)
 	return nil
 }
 
-func (cs *CacheServer) pushShorten(urlStr string) (SetShortenQueryResponse, []byte, error) {
+// pushShorten stores an alias on the shard owning it. generated keys may
+// go to any shard, so they go to the one owning the url, which keeps
+// every url deduplicated on a single shard
+func (cs *CacheServer) pushShorten(urlStr, alias string, opts LinkOptions) (SetShortenQueryResponse, []byte, error) {
+	args := url.Values{"url": {urlStr}}
+	dbServer := cs.dbServerFor(normalizeURL(urlStr))
+	if alias != "" {
+		args.Set("alias", alias)
+		dbServer = cs.dbServerFor(alias)
+	}
+	setLinkOptionArgs(args, opts)
 	jsonResp, raw, err := PostSetShortenQuery(
-		cs.client, SingleJoiningSlash(cs.dbServer, SHORTEN_ENDPOINT),
-		url.Values{"url": {urlStr}},
+		cs.client, SingleJoiningSlash(dbServer, SHORTEN_ENDPOINT), args,
 	)
 	if err != nil {
 		return SetShortenQueryResponse{}, nil, err
@@ -269,10 +700,10 @@ func (cs *CacheServer) pushShorten(urlStr string) (SetShortenQueryResponse, []by
 	return jsonResp, raw, nil
 }
 
-func (cs *CacheServer) setReserve(key, urlStr string) (SetShortenQueryResponse, error) {
+func (cs *CacheServer) setReserve(key cacheKey, urlStr string, opts LinkOptions) (SetShortenQueryResponse, error) {
 	jsonResp, _, err := PostSetShortenQuery(
-		cs.client, SingleJoiningSlash(cs.dbServer, SETRESERVE_ENDPOINT),
-		url.Values{"key": {key}, "url": {urlStr}},
+		cs.client, SingleJoiningSlash(dbServerURL(key.host), SETRESERVE_ENDPOINT),
+		setReserveArgs(key.key, urlStr, opts),
 	)
 	if err != nil {
 		return SetShortenQueryResponse{}, err
@@ -280,15 +711,71 @@ func (cs *CacheServer) setReserve(key, urlStr string) (SetShortenQueryResponse,
 	return jsonResp, nil
 }
 
+func setReserveArgs(key, urlStr string, opts LinkOptions) url.Values {
+	args := url.Values{"key": {key}, "url": {urlStr}}
+	setLinkOptionArgs(args, opts)
+	return args
+}
+
+// sendSetReserve sends a queued setReserve. a db server without a raft
+// leader answers, but may take it once it has one
+func (cs *CacheServer) sendSetReserve(entry outboxEntry) error {
+	args, err := url.ParseQuery(entry.Args)
+	if err != nil {
+		return fmt.Errorf("%w: %s", errOutboxRejected, err.Error())
+	}
+	jsonResp, _, err := PostSetShortenQuery(
+		cs.client, SingleJoiningSlash(dbServerURL(entry.Host), SETRESERVE_ENDPOINT), args,
+	)
+	if err != nil {
+		return err
+	}
+	if !jsonResp.Succeeded && jsonResp.ErrorCode == ERR_CODE_NOT_LEADER {
+		return errors.New(jsonResp.ErrorMsg)
+	} else if !jsonResp.Succeeded {
+		// the link was cached when the key was handed out, but will never
+		// exist
+		cs.evict(args.Get("key"))
+		return fmt.Errorf("%w: %s", errOutboxRejected, jsonResp.ErrorMsg)
+	}
+	return nil
+}
+
+// evict drops a link we cached but the main server never stored
+func (cs *CacheServer) evict(key string) {
+	if err := cs.cache.Delete(key); err != nil {
+		log.Printf("Internal server error evicting key: %s\n", err.Error())
+	}
+}
+
+// setLinkOptionArgs forwards link options to the main server. the expiry
+// is sent already resolved, as an absolute time
+func setLinkOptionArgs(args url.Values, opts LinkOptions) {
+	if !opts.ExpiresAt.IsZero() {
+		args.Set("expiry", opts.ExpiresAt.UTC().Format(time.RFC3339))
+	}
+	if opts.Creator != "" {
+		args.Set("creator", opts.Creator)
+	}
+	if opts.Dedupe {
+		args.Set("dedupe", "true")
+	}
+}
+
 func (cs *CacheServer) cacheResp(raw []byte, jsonResp *SetShortenQueryResponse) error {
-	if jsonResp.Succeeded {
-		return cs.mc.Set(&memcache.Item{
-			Key: jsonResp.Key, Value: raw,
-			Expiration: 0,
-		})
+	if !jsonResp.Succeeded {
+		return cs.cache.Set(jsonResp.Key, raw, KEY_404_EXPIRE*time.Second)
 	}
-	return cs.mc.Set(&memcache.Item{
-		Key: jsonResp.Key, Value: raw,
-		Expiration: KEY_404_EXPIRE,
-	})
+	ttl := KEY_CACHE_EXPIRE * time.Second
+	if jsonResp.ExpiresAt > 0 {
+		// a link that expired in the meantime is not worth caching, as the
+		// next query finds it gone anyway
+		untilExpiry := time.Until(time.Unix(jsonResp.ExpiresAt, 0))
+		if untilExpiry <= 0 {
+			return nil
+		} else if untilExpiry < ttl {
+			ttl = untilExpiry
+		}
+	}
+	return cs.cache.Set(jsonResp.Key, raw, ttl)
 }
@@ -0,0 +1,411 @@
+package shortener
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func queueKeys(kq *KeyQueue) []string {
+	keys := []string{}
+	for _, k := range kq.Drain() {
+		keys = append(keys, k.key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func TestCacheServerKeyFile(t *testing.T) {
+	path := "./test_keys.json"
+	t.Cleanup(func() { os.Remove(path) })
+	shards, _ := NewRendezvous([]string{"db:8082"})
+	cs := &CacheServer{shards: shards, client: &http.Client{}}
+	if err := cs.OpenKeyFile(path); err != nil {
+		t.Fatalf("Unable to open a missing key file: %s", err.Error())
+	}
+	expiry := time.Now().Add(time.Hour).Unix()
+	cs.kq.PushAll([]cacheKey{
+		{"kept1", expiry, "db:8082"},
+		{"kept2", expiry, "db:8082"},
+		{"expired", time.Now().Add(-time.Hour).Unix(), "db:8082"},
+		{"gone", expiry, "old:8082"},
+	})
+	if err := cs.returnKeys(); err != nil {
+		t.Fatalf("Unable to save keys: %s", err.Error())
+	}
+
+	restarted := &CacheServer{shards: shards, client: &http.Client{}}
+	if err := restarted.OpenKeyFile(path); err != nil {
+		t.Fatalf("Unable to load keys: %s", err.Error())
+	}
+	if keys := queueKeys(&restarted.kq); !reflect.DeepEqual(keys, []string{"kept1", "kept2"}) {
+		t.Errorf("Expected the unexpired keys of current shards to be loaded, got %v", keys)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("Expected the key file to be removed once loaded, got %v", err)
+	}
+}
+
+func TestCacheServerKeyFileMovedKeys(t *testing.T) {
+	path := "./test_moved_keys.json"
+	t.Cleanup(func() { os.Remove(path) })
+	store, err := NewMemoryURLStore()
+	if err != nil {
+		t.Fatalf("Unable to create test store: %s", err.Error())
+	}
+	server := NewMainServerWithStore(store)
+	defer server.Close()
+	db := httptest.NewServer(server.mux)
+	defer db.Close()
+	host := strings.TrimPrefix(db.URL, "http://")
+
+	keys, err := store.Reserve(20)
+	if err != nil {
+		t.Fatalf("Unable to reserve keys: %s", err.Error())
+	}
+	before, _ := NewRendezvous([]string{host})
+	cs := &CacheServer{shards: before, client: &http.Client{}}
+	if err := cs.OpenKeyFile(path); err != nil {
+		t.Fatalf("Unable to open a missing key file: %s", err.Error())
+	}
+	for _, key := range keys {
+		cs.kq.PushAll([]cacheKey{{key, time.Now().Add(time.Hour).Unix(), host}})
+	}
+	if err := cs.returnKeys(); err != nil {
+		t.Fatalf("Unable to save keys: %s", err.Error())
+	}
+
+	// after a shard is added, keys it took over are released to the shard
+	// they came from instead of being set there
+	after, _ := NewRendezvous([]string{host, "added:8082"})
+	restarted := &CacheServer{shards: after, client: &http.Client{}}
+	if err := restarted.OpenKeyFile(path); err != nil {
+		t.Fatalf("Unable to load keys: %s", err.Error())
+	}
+	kept := map[string]bool{}
+	for _, key := range queueKeys(&restarted.kq) {
+		kept[key] = true
+	}
+	if len(kept) == 0 || len(kept) == len(keys) {
+		t.Fatalf("Expected some of the keys to move to the added shard, kept %d of %d", len(kept), len(keys))
+	}
+	for _, key := range keys {
+		owned := after.Owner(key) == host
+		if kept[key] != owned {
+			t.Errorf("Expected %s to be kept only if its shard still owns it, kept: %v", key, kept[key])
+		}
+		err := store.SetReserve(key, "http://example.com", LinkOptions{})
+		if owned && err != nil {
+			t.Errorf("Expected kept key %s to stay reserved, got %v", key, err)
+		} else if !owned && err == nil {
+			t.Errorf("Expected moved key %s to be released", key)
+		}
+	}
+}
+
+func TestCacheServerReleaseOnClose(t *testing.T) {
+	store, err := NewMemoryURLStore()
+	if err != nil {
+		t.Fatalf("Unable to create test store: %s", err.Error())
+	}
+	server := NewMainServerWithStore(store)
+	defer server.Close()
+	db := httptest.NewServer(server.mux)
+	defer db.Close()
+	host := strings.TrimPrefix(db.URL, "http://")
+
+	keys, err := store.Reserve(5)
+	if err != nil {
+		t.Fatalf("Unable to reserve keys: %s", err.Error())
+	}
+	shards, _ := NewRendezvous([]string{host})
+	cs := &CacheServer{shards: shards, client: &http.Client{}}
+	for _, key := range keys {
+		cs.kq.PushAll([]cacheKey{{key, time.Now().Add(time.Hour).Unix(), host}})
+	}
+	if err := cs.Close(); err != nil {
+		t.Fatalf("Unable to close cache server: %s", err.Error())
+	}
+	for _, key := range keys {
+		if _, err := store.Query(key); !errors.Is(err, ErrLinkNotFound) {
+			t.Errorf("Expected %s to be released, got %v", key, err)
+		}
+	}
+}
+
+func TestCacheServerRefill(t *testing.T) {
+	store, err := NewMemoryURLStore()
+	if err != nil {
+		t.Fatalf("Unable to create test store: %s", err.Error())
+	}
+	server := NewMainServerWithStore(store)
+	defer server.Close()
+	var reserves, inFlight, maxInFlight int32
+	db := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == RESERVE_ENDPOINT {
+			atomic.AddInt32(&reserves, 1)
+			if n := atomic.AddInt32(&inFlight, 1); n > atomic.LoadInt32(&maxInFlight) {
+				atomic.StoreInt32(&maxInFlight, n)
+			}
+			defer atomic.AddInt32(&inFlight, -1)
+			time.Sleep(20 * time.Millisecond)
+		}
+		server.mux.ServeHTTP(w, r)
+	}))
+	defer db.Close()
+	host := strings.TrimPrefix(db.URL, "http://")
+
+	shards, _ := NewRendezvous([]string{host})
+	cs := &CacheServer{
+		shards: shards, client: &http.Client{},
+		reserveAmt: 8, minReserve: 8, watermark: 2,
+	}
+	// the stack is filled as soon as the worker starts
+	cs.startRefill()
+	waitFor(t, func() bool { return cs.kq.Len() >= 8 })
+
+	// draining below the watermark refills once, however many ask for it
+	for cs.kq.Len() > 2 {
+		cs.kq.Pop(time.Now())
+	}
+	before := atomic.LoadInt32(&reserves)
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			cs.triggerRefill()
+		}()
+	}
+	wg.Wait()
+	waitFor(t, func() bool { return cs.kq.Len() >= 10 })
+	if err := cs.Close(); err != nil {
+		t.Fatalf("Unable to close cache server: %s", err.Error())
+	}
+	if n := atomic.LoadInt32(&reserves) - before; n != 1 {
+		t.Errorf("Expected concurrent refills to reserve once, got %d reserves", n)
+	}
+	if n := atomic.LoadInt32(&maxInFlight); n != 1 {
+		t.Errorf("Expected at most one reserve in flight, got %d", n)
+	}
+}
+
+func TestCacheServerResize(t *testing.T) {
+	start := time.Now()
+	cs := &CacheServer{reserveAmt: 100, minReserve: 100, lastRefill: start}
+	// 50 keys a second last a minute with 3000 keys, which the size moves
+	// half way towards every refill
+	cs.popped = 500
+	cs.resize(start.Add(10 * time.Second))
+	if cs.reserveAmt != 1550 {
+		t.Errorf("Expected the reservation to grow to 1550, got %d", cs.reserveAmt)
+	}
+	// the cap is the most keys a db server reserves at once, see
+	// TestMainServerReserveLimit
+	cs.popped = 1 << 20
+	cs.resize(start.Add(11 * time.Second))
+	if cs.reserveAmt != MAX_RESERVE_NUM {
+		t.Errorf("Expected the reservation to be capped at %d, got %d", MAX_RESERVE_NUM, cs.reserveAmt)
+	}
+	// an idle cache server shrinks back to the configured amount
+	for i := 0; i < 20; i++ {
+		cs.resize(start.Add(time.Duration(12+i) * time.Minute))
+	}
+	if cs.reserveAmt != 100 {
+		t.Errorf("Expected the reservation to shrink back to 100, got %d", cs.reserveAmt)
+	}
+}
+
+func TestCacheServerLRU(t *testing.T) {
+	store, err := NewMemoryURLStore()
+	if err != nil {
+		t.Fatalf("Unable to create test store: %s", err.Error())
+	}
+	server := NewMainServerWithStore(store)
+	defer server.Close()
+	db := httptest.NewServer(server.mux)
+	defer db.Close()
+
+	cache := NewLRUCache(DEFAULT_LRU_SIZE)
+	cs, err := NewCacheServerWithCache(cache, []string{strings.TrimPrefix(db.URL, "http://")}, 4)
+	if err != nil {
+		t.Fatalf("Unable to create cache server: %s", err.Error())
+	}
+	key, _ := store.Store("http://example.com", LinkOptions{})
+	_, rec, err := HttpTestPostSetQueryShorten(cs.mux, QUERY_ENDPOINT, url.Values{"key": {key}})
+	if err != nil || rec.Code != REDIRECT_STATUS || rec.Header().Get("Location") != "http://example.com" {
+		t.Fatalf("Unable to query through the cache server: %v %v", rec, err)
+	}
+	if _, err := cache.Get(key); err != nil {
+		t.Errorf("Expected the query to be cached, got %v", err)
+	}
+	jsonResp, _, err := HttpTestPostSetQueryShorten(cs.mux, QUERY_ENDPOINT, url.Values{"key": {key}})
+	if err != nil || jsonResp.OriginalURL != "http://example.com" {
+		t.Errorf("Expected the cached link, got: %+v %v", jsonResp, err)
+	}
+
+	// deleting through the cache server evicts the key
+	jsonResp, _, err = HttpTestPostSetQueryShorten(cs.mux, DELETE_ENDPOINT, url.Values{"key": {key}})
+	if err != nil || !jsonResp.Succeeded {
+		t.Fatalf("Unable to delete through the cache server: %+v %v", jsonResp, err)
+	}
+	if _, err := cache.Get(key); err != ErrCacheMiss {
+		t.Errorf("Expected the delete to evict %s, got %v", key, err)
+	}
+	jsonResp, _, _ = HttpTestPostSetQueryShorten(cs.mux, QUERY_ENDPOINT, url.Values{"key": {key}})
+	if jsonResp.ErrorCode != ERR_CODE_LINK_DELETED {
+		t.Errorf("Expected the deleted link to be gone, got %+v", jsonResp)
+	}
+}
+
+func TestCacheServerRejectedShorten(t *testing.T) {
+	store, err := NewMemoryURLStore()
+	if err != nil {
+		t.Fatalf("Unable to create test store: %s", err.Error())
+	}
+	server := NewMainServerWithStore(store)
+	defer server.Close()
+	db := httptest.NewServer(server.mux)
+	defer db.Close()
+	host := strings.TrimPrefix(db.URL, "http://")
+
+	cache := NewLRUCache(DEFAULT_LRU_SIZE)
+	cs, err := NewCacheServerWithCache(cache, []string{host}, 4)
+	if err != nil {
+		t.Fatalf("Unable to create cache server: %s", err.Error())
+	}
+	// the db server never reserved these keys, so it rejects setting them
+	cs.kq.PushAll([]cacheKey{{"unknown", time.Now().Add(time.Hour).Unix(), host}})
+	jsonResp, _, err := HttpTestPostSetQueryShorten(cs.mux, SHORTEN_ENDPOINT, url.Values{"url": {"http://example.com"}})
+	if err != nil || !jsonResp.Succeeded || jsonResp.Key != "unknown" {
+		t.Fatalf("Unable to shorten through the cache server: %+v %v", jsonResp, err)
+	}
+	waitFor(t, func() bool {
+		_, err := cache.Get("unknown")
+		return err == ErrCacheMiss
+	})
+
+	// the same goes for shortens queued in the outbox
+	resp := SetShortenQueryResponse{Succeeded: true, Key: "queued", OriginalURL: "http://example.com"}
+	if err := cs.cacheResp([]byte("{}"), &resp); err != nil {
+		t.Fatalf("Unable to cache response: %s", err.Error())
+	}
+	entry := outboxEntry{Host: host, Args: setReserveArgs("queued", "http://example.com", LinkOptions{}).Encode()}
+	if err := cs.sendSetReserve(entry); !errors.Is(err, errOutboxRejected) {
+		t.Errorf("Expected the db server to reject the shorten, got %v", err)
+	}
+	if _, err := cache.Get("queued"); err != ErrCacheMiss {
+		t.Errorf("Expected the rejected shorten to be evicted, got %v", err)
+	}
+}
+
+// countingCache counts the writes to the cache it wraps
+type countingCache struct {
+	LinkCache
+	sets int32
+	// of the last write
+	ttl time.Duration
+}
+
+func (c *countingCache) Set(key string, value []byte, ttl time.Duration) error {
+	atomic.AddInt32(&c.sets, 1)
+	c.ttl = ttl
+	return c.LinkCache.Set(key, value, ttl)
+}
+
+func TestCacheServerCacheTTL(t *testing.T) {
+	cache := &countingCache{LinkCache: NewLRUCache(DEFAULT_LRU_SIZE)}
+	cs := &CacheServer{cache: cache}
+	inAMinute := time.Now().Add(time.Minute).Unix()
+	for _, c := range []struct {
+		resp SetShortenQueryResponse
+		max  time.Duration
+	}{
+		// even links that never expire are cached for a while only, as a
+		// write sent straight to a db server does not evict them
+		{SetShortenQueryResponse{Succeeded: true, Key: "a"}, KEY_CACHE_EXPIRE * time.Second},
+		{SetShortenQueryResponse{Succeeded: true, Key: "b", ExpiresAt: inAMinute}, time.Minute},
+		{SetShortenQueryResponse{Succeeded: false, Key: "c"}, KEY_404_EXPIRE * time.Second},
+	} {
+		if err := cs.cacheResp([]byte("{}"), &c.resp); err != nil {
+			t.Fatalf("Unable to cache response: %s", err.Error())
+		}
+		if cache.ttl <= 0 || cache.ttl > c.max {
+			t.Errorf("Expected %s to be cached for up to %s, got %s", c.resp.Key, c.max, cache.ttl)
+		}
+	}
+}
+
+func TestCacheServerCoalescesQueries(t *testing.T) {
+	store, err := NewMemoryURLStore()
+	if err != nil {
+		t.Fatalf("Unable to create test store: %s", err.Error())
+	}
+	server := NewMainServerWithStore(store)
+	defer server.Close()
+	var blocking, queries int32
+	release := make(chan struct{})
+	db := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == QUERY_ENDPOINT && atomic.LoadInt32(&blocking) == 1 {
+			atomic.AddInt32(&queries, 1)
+			r.ParseForm()
+			if r.Form.Get("key") == "broken" {
+				w.Write([]byte("not json"))
+				return
+			}
+			<-release
+		}
+		server.mux.ServeHTTP(w, r)
+	}))
+	defer db.Close()
+	cache := &countingCache{LinkCache: NewLRUCache(DEFAULT_LRU_SIZE)}
+	cs, err := NewCacheServerWithCache(cache, []string{strings.TrimPrefix(db.URL, "http://")}, 4)
+	if err != nil {
+		t.Fatalf("Unable to create cache server: %s", err.Error())
+	}
+	atomic.StoreInt32(&blocking, 1)
+
+	key, _ := store.Store("http://example.com/viral", LinkOptions{})
+	coalesced := queriesCoalesced.Value()
+	const callers = 10
+	results := make(chan string, callers)
+	for i := 0; i < callers; i++ {
+		go func() {
+			_, rec, _ := HttpTestPostSetQueryShorten(cs.mux, QUERY_ENDPOINT, url.Values{"key": {key}})
+			results <- rec.Header().Get("Location")
+		}()
+	}
+	waitFor(t, func() bool { return queriesCoalesced.Value()-coalesced >= callers-1 })
+	close(release)
+	for i := 0; i < callers; i++ {
+		if location := <-results; location != "http://example.com/viral" {
+			t.Errorf("Expected every caller to be redirected to the link, got %q", location)
+		}
+	}
+	if n := atomic.LoadInt32(&queries); n != 1 {
+		t.Errorf("Expected a single upstream query, got %d", n)
+	}
+	if n := atomic.LoadInt32(&cache.sets); n != 1 {
+		t.Errorf("Expected a single cache write, got %d", n)
+	}
+
+	// failures are not kept around for later queries
+	for i := 0; i < 2; i++ {
+		_, rec, _ := HttpTestPostSetQueryShorten(cs.mux, QUERY_ENDPOINT, url.Values{"key": {"broken"}})
+		if rec.Code != http.StatusInternalServerError {
+			t.Errorf("Expected a broken upstream response to fail, got %d", rec.Code)
+		}
+	}
+	if n := atomic.LoadInt32(&queries); n != 3 {
+		t.Errorf("Expected each failed query to be retried upstream, got %d queries", n)
+	}
+}
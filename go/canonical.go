@@ -0,0 +1,130 @@
+package shortener
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+var (
+	ErrInvalidURL = errors.New("invalid url")
+)
+
+// query parameters that only track where a click came from. entries
+// ending in '*' match by prefix
+var DEFAULT_TRACKING_PARAMS = []string{
+	"utm_*", "fbclid", "gclid", "dclid", "msclkid", "mc_cid", "mc_eid",
+}
+
+var defaultPorts = map[string]string{
+	"http":  "80",
+	"https": "443",
+}
+
+// Canonicalizer rewrites urls to a canonical form before they are
+// stored, so that equivalent urls are stored the same way
+type Canonicalizer struct {
+	trackingParams []string
+}
+
+func NewCanonicalizer(trackingParams []string) *Canonicalizer {
+	return &Canonicalizer{trackingParams: trackingParams}
+}
+
+// Canonicalize lowercases the scheme and host, converts internationalized
+// hosts to punycode, strips default ports, resolves dot segments and
+// removes tracking parameters. Only http(s) urls are accepted
+func (c *Canonicalizer) Canonicalize(urlStr string) (string, error) {
+	if len(urlStr) > MAX_URL_LEN {
+		return "", fmt.Errorf("%w: longer than %d bytes", ErrInvalidURL, MAX_URL_LEN)
+	}
+	u, err := url.Parse(urlStr)
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", ErrInvalidURL, urlStr)
+	}
+	u.Scheme = strings.ToLower(u.Scheme)
+	if _, ok := defaultPorts[u.Scheme]; !ok {
+		return "", fmt.Errorf("%w: unsupported scheme %q", ErrInvalidURL, u.Scheme)
+	}
+	if u.Opaque != "" || u.Hostname() == "" {
+		return "", fmt.Errorf("%w: %s", ErrInvalidURL, urlStr)
+	}
+
+	host := strings.ToLower(u.Hostname())
+	if net.ParseIP(host) == nil {
+		host, err = idna.Lookup.ToASCII(host)
+		if err != nil {
+			return "", fmt.Errorf("%w: bad host: %s", ErrInvalidURL, err.Error())
+		}
+	}
+	port := u.Port()
+	if port == defaultPorts[u.Scheme] {
+		port = ""
+	}
+	switch {
+	case port != "":
+		u.Host = net.JoinHostPort(host, port)
+	case strings.Contains(host, ":"):
+		u.Host = "[" + host + "]"
+	default:
+		u.Host = host
+	}
+
+	u = u.ResolveReference(&url.URL{})
+	if u.RawQuery != "" {
+		u.RawQuery = c.stripTracking(u.RawQuery)
+	}
+	return u.String(), nil
+}
+
+// stripTracking drops tracking parameters from a raw query, leaving the
+// order and encoding of the others as they were
+func (c *Canonicalizer) stripTracking(rawQuery string) string {
+	pairs := strings.Split(rawQuery, "&")
+	kept := make([]string, 0, len(pairs))
+	for _, pair := range pairs {
+		param := pair
+		if i := strings.IndexByte(pair, '='); i >= 0 {
+			param = pair[:i]
+		}
+		if unescaped, err := url.QueryUnescape(param); err == nil {
+			param = unescaped
+		}
+		if !c.tracking(param) {
+			kept = append(kept, pair)
+		}
+	}
+	if len(kept) == len(pairs) {
+		return rawQuery
+	}
+	return strings.Join(kept, "&")
+}
+
+// normalizer keeps every parameter, as which ones are tracking is up to
+// the servers, which strip them before urls are stored
+var normalizer = NewCanonicalizer(nil)
+
+// normalizeURL reduces urls that point to the same page to the same
+// string, by canonicalizing them the way servers do before storing them.
+// urls that cannot be canonicalized are left as they are
+func normalizeURL(urlStr string) string {
+	canonical, err := normalizer.Canonicalize(urlStr)
+	if err != nil {
+		return urlStr
+	}
+	return canonical
+}
+
+func (c *Canonicalizer) tracking(param string) bool {
+	param = strings.ToLower(param)
+	for _, p := range c.trackingParams {
+		if strings.HasSuffix(p, "*") && strings.HasPrefix(param, p[:len(p)-1]) || param == p {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,48 @@
+package shortener
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCanonicalize(t *testing.T) {
+	canon := NewCanonicalizer(DEFAULT_TRACKING_PARAMS)
+	for in, want := range map[string]string{
+		"HTTP://Example.COM:80/a/./b/../c":              "http://example.com/a/c",
+		"https://example.com:443/":                      "https://example.com/",
+		"https://example.com:8443/":                     "https://example.com:8443/",
+		"http://bücher.example/":                        "http://xn--bcher-kva.example/",
+		"http://example.com/?utm_source=x&id=1&fbclid=": "http://example.com/?id=1",
+		"http://[::1]:80/x":                             "http://[::1]/x",
+		"http://example.com/?b=1&a=2":                   "http://example.com/?b=1&a=2",
+		"http://example.com/?flag":                      "http://example.com/?flag",
+		"http://example.com/?b=%20&utm_medium=x&a":      "http://example.com/?b=%20&a",
+		"http://example.com/?utm%5Fsource=x":            "http://example.com/",
+	} {
+		got, err := canon.Canonicalize(in)
+		if err != nil {
+			t.Errorf("Unexpected error canonicalizing %q: %s", in, err.Error())
+		} else if got != want {
+			t.Errorf("Expected %q canonicalizing %q, got: %q", want, in, got)
+		}
+	}
+	for _, in := range []string{
+		"javascript:alert(1)", "data:text/html,hi", "ftp://example.com/", "http:///nohost", "example.com",
+	} {
+		if _, err := canon.Canonicalize(in); !errors.Is(err, ErrInvalidURL) {
+			t.Errorf("Expected ErrInvalidURL canonicalizing %q, got: %v", in, err)
+		}
+	}
+}
+
+func TestNormalizeURL(t *testing.T) {
+	for in, want := range map[string]string{
+		// parameters are kept, stripping them is up to the servers
+		"HTTP://Example.COM:80/a/../b?utm_source=x": "http://example.com/b?utm_source=x",
+		"not a url": "not a url",
+	} {
+		if got := normalizeURL(in); got != want {
+			t.Errorf("Expected %q normalizing %q, got: %q", want, in, got)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package shortener
+
+import (
+	"errors"
+	"expvar"
+	"sync"
+)
+
+// queries that waited on one already in flight instead of asking the db
+// server themselves, served from /debug/vars
+var queriesCoalesced = expvar.NewInt("queries_coalesced")
+
+var errQueryAborted = errors.New("coalesced query aborted")
+
+// queryCall is a query in flight, and its result once done
+type queryCall struct {
+	done chan struct{}
+	resp SetShortenQueryResponse
+	raw  []byte
+	err  error
+}
+
+// queryGroup coalesces concurrent queries of the same key, so that only
+// one of them is in flight at a time and the others share its result
+type queryGroup struct {
+	lock  sync.Mutex
+	calls map[string]*queryCall
+}
+
+// do runs fn for key unless a call for key is already in flight, in which
+// case it waits for that call and returns its result instead. the raw
+// response is shared between callers, who must not modify it
+func (g *queryGroup) do(key string, fn func() (SetShortenQueryResponse, []byte, error)) (SetShortenQueryResponse, []byte, error) {
+	g.lock.Lock()
+	if g.calls == nil {
+		g.calls = map[string]*queryCall{}
+	}
+	if c, ok := g.calls[key]; ok {
+		g.lock.Unlock()
+		queriesCoalesced.Add(1)
+		<-c.done
+		return c.resp, c.raw, c.err
+	}
+	c := &queryCall{done: make(chan struct{}), err: errQueryAborted}
+	g.calls[key] = c
+	g.lock.Unlock()
+
+	// waiters are released even if fn panics, with errQueryAborted
+	defer func() {
+		g.lock.Lock()
+		delete(g.calls, key)
+		g.lock.Unlock()
+		close(c.done)
+	}()
+	c.resp, c.raw, c.err = fn()
+	return c.resp, c.raw, c.err
+}
@@ -0,0 +1,20 @@
+package shortener
+
+import (
+	"testing"
+)
+
+func TestQueryGroupPanic(t *testing.T) {
+	var g queryGroup
+	func() {
+		defer func() { recover() }()
+		g.do("key", func() (SetShortenQueryResponse, []byte, error) { panic("upstream") })
+	}()
+	// the panicking call is no longer in flight
+	resp, _, err := g.do("key", func() (SetShortenQueryResponse, []byte, error) {
+		return SetShortenQueryResponse{Key: "key"}, nil, nil
+	})
+	if err != nil || resp.Key != "key" {
+		t.Errorf("Expected a fresh call after a panic, got %+v %v", resp, err)
+	}
+}
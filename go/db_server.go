@@ -1,6 +1,7 @@
 package shortener
 
 import (
+	"expvar"
 	"fmt"
 	"log"
 	"net/http"
@@ -8,6 +9,7 @@ import (
 	"os/signal"
 	"strconv"
 	"syscall"
+	"time"
 )
 
 const (
@@ -15,32 +17,71 @@ const (
 	QUERY_ENDPOINT      = "/api/query"
 	RESERVE_ENDPOINT    = "/api/reserve"
 	SETRESERVE_ENDPOINT = "/api/setReserve"
+	RELEASE_ENDPOINT    = "/api/release"
+	DELETE_ENDPOINT     = "/api/delete"
+	DISABLE_ENDPOINT    = "/api/disable"
+	UPDATE_ENDPOINT     = "/api/update"
 
-	REDIRECT_STATUS = http.StatusMovedPermanently
+	METRICS_ENDPOINT = "/debug/vars"
+	BACKUP_ENDPOINT  = "/admin/backup"
+	EXPORT_ENDPOINT  = "/admin/export"
+	IMPORT_ENDPOINT  = "/admin/import"
+	PURGE_ENDPOINT   = "/admin/purge"
+	CHANGES_ENDPOINT = "/admin/changes"
+
+	// not a permanent redirect, as browsers cache those indefinitely and
+	// would keep following links after they are updated or disabled
+	REDIRECT_STATUS = http.StatusFound
 )
 
 type MainServer struct {
-	store *URLStore
+	store LinkStore
 	mux   *http.ServeMux
+	canon *Canonicalizer
 }
 
 func NewMainServer(dbLocation string) (*MainServer, error) {
-	ret := &MainServer{
-		mux: http.NewServeMux(),
-	}
-	var err error
-	ret.store, err = NewURLStore(dbLocation)
+	store, err := NewURLStore(dbLocation)
 	if err != nil {
 		return nil, err
 	}
+	return NewMainServerWithStore(store), nil
+}
+
+// NewMainServerWithStore creates a server around an already configured
+// store, which the server takes ownership of
+func NewMainServerWithStore(store LinkStore) *MainServer {
+	ret := &MainServer{
+		store: store,
+		mux:   http.NewServeMux(),
+		canon: NewCanonicalizer(DEFAULT_TRACKING_PARAMS),
+	}
 
 	ret.mux.HandleFunc(QUERY_ENDPOINT, ret.query)
-	ret.mux.HandleFunc(SHORTEN_ENDPOINT, ret.shorten)
+	ret.mux.HandleFunc(SHORTEN_ENDPOINT, ret.leaderOnly(ret.shorten))
+
+	ret.mux.HandleFunc(RESERVE_ENDPOINT, ret.leaderOnly(ret.reserve))
+	ret.mux.HandleFunc(SETRESERVE_ENDPOINT, ret.leaderOnly(ret.setReserve))
+	ret.mux.HandleFunc(RELEASE_ENDPOINT, ret.leaderOnly(ret.release))
 
-	ret.mux.HandleFunc(RESERVE_ENDPOINT, ret.reserve)
-	ret.mux.HandleFunc(SETRESERVE_ENDPOINT, ret.setReserve)
+	ret.mux.HandleFunc(DELETE_ENDPOINT, ret.leaderOnly(ret.delete))
+	ret.mux.HandleFunc(DISABLE_ENDPOINT, ret.leaderOnly(ret.disable))
+	ret.mux.HandleFunc(UPDATE_ENDPOINT, ret.leaderOnly(ret.update))
 
-	return ret, nil
+	ret.mux.Handle(METRICS_ENDPOINT, expvar.Handler())
+	ret.mux.HandleFunc(BACKUP_ENDPOINT, ret.backup)
+	ret.mux.HandleFunc(EXPORT_ENDPOINT, ret.export)
+	ret.mux.HandleFunc(IMPORT_ENDPOINT, ret.leaderOnly(ret.importLinks))
+	ret.mux.HandleFunc(PURGE_ENDPOINT, ret.leaderOnly(ret.purge))
+	ret.mux.HandleFunc(CHANGES_ENDPOINT, ret.changes)
+
+	return ret
+}
+
+// SetCanonicalizer replaces the default canonicalizer. It must be called
+// before the server is started
+func (ms *MainServer) SetCanonicalizer(canon *Canonicalizer) {
+	ms.canon = canon
 }
 
 func (ms *MainServer) Close() error {
@@ -54,7 +95,7 @@ func (ms *MainServer) Close() error {
 }
 
 func (ms *MainServer) Start(port uint) error {
-	c := make(chan os.Signal)
+	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		<-c
@@ -77,15 +118,29 @@ func (ms *MainServer) shorten(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	urlStr := r.Form.Get("url")
-	key, err := ms.store.Store(urlStr)
+	key := r.Form.Get("alias")
+	opts := LinkOptions{Creator: r.Form.Get("creator"), Dedupe: r.Form.Get("dedupe") == "true"}
+	urlStr, err := ms.canon.Canonicalize(r.Form.Get("url"))
+	if err == nil {
+		opts.ExpiresAt, err = ParseExpiry(r.Form.Get("expiry"), time.Now())
+	}
+	if err != nil {
+		key = ""
+	} else if key != "" {
+		err = ms.store.StoreAlias(key, urlStr, opts)
+	} else {
+		key, err = ms.store.Store(urlStr, opts)
+	}
 	if err != nil {
 		resp.Succeeded = false
 		resp.ErrorMsg = err.Error()
+		resp.ErrorCode = ErrorCode(err)
 	} else {
 		resp.Succeeded = true
 		resp.Key = key
 		resp.OriginalURL = urlStr
+		resp.SetExpiresAt(opts.ExpiresAt)
+		resp.Index = ms.appliedIndex()
 	}
 	WriteJSON(w, resp)
 }
@@ -100,14 +155,23 @@ func (ms *MainServer) setReserve(w http.ResponseWriter, r *http.Request) {
 	}
 
 	resp.Key = r.Form.Get("key")
-	urlStr := r.Form.Get("url")
-	err = ms.store.SetReserve(resp.Key, urlStr)
+	opts := LinkOptions{Creator: r.Form.Get("creator")}
+	urlStr, err := ms.canon.Canonicalize(r.Form.Get("url"))
+	if err == nil {
+		opts.ExpiresAt, err = ParseExpiry(r.Form.Get("expiry"), time.Now())
+	}
+	if err == nil {
+		err = ms.store.SetReserve(resp.Key, urlStr, opts)
+	}
 	if err != nil {
 		resp.Succeeded = false
 		resp.ErrorMsg = err.Error()
+		resp.ErrorCode = ErrorCode(err)
 	} else {
 		resp.Succeeded = true
 		resp.OriginalURL = urlStr
+		resp.SetExpiresAt(opts.ExpiresAt)
+		resp.Index = ms.appliedIndex()
 	}
 	WriteJSON(w, resp)
 }
@@ -121,8 +185,8 @@ func (ms *MainServer) reserve(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	num, err := strconv.ParseUint(r.Form.Get("num"), 10, MAX_RESERVE_NUM_BITS)
-	if err != nil {
+	num, err := strconv.ParseUint(r.Form.Get("num"), 10, 32)
+	if err != nil || num > MAX_RESERVE_NUM {
 		w.WriteHeader(http.StatusBadRequest)
 		w.Write([]byte("400 - Bad Request"))
 		return
@@ -133,6 +197,29 @@ func (ms *MainServer) reserve(w http.ResponseWriter, r *http.Request) {
 		resp.ErrorMsg = err.Error()
 	} else {
 		resp.Succeeded = true
+		resp.Index = ms.appliedIndex()
+	}
+	WriteJSON(w, resp)
+}
+
+// release returns the reserved keys given as key, which may be repeated.
+// The response lists the keys that were released
+func (ms *MainServer) release(w http.ResponseWriter, r *http.Request) {
+	resp := ReserveResponse{}
+	err := r.ParseForm()
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("400 - Bad Request"))
+		return
+	}
+
+	resp.Keys, err = ms.store.Release(r.Form["key"])
+	if err != nil {
+		resp.Succeeded = false
+		resp.ErrorMsg = err.Error()
+	} else {
+		resp.Succeeded = true
+		resp.Index = ms.appliedIndex()
 	}
 	WriteJSON(w, resp)
 }
@@ -146,14 +233,124 @@ func (ms *MainServer) query(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	var minIndex uint64
+	if s := r.Form.Get("minIndex"); s != "" {
+		minIndex, err = strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("400 - Bad Request"))
+			return
+		}
+	}
+
+	resp.Key = r.Form.Get("key")
+	var rec LinkRecord
+	err = ms.awaitIndex(minIndex)
+	if err == nil {
+		rec, err = ms.store.Query(resp.Key)
+	}
+	if err != nil {
+		resp.Succeeded = false
+		resp.ErrorMsg = err.Error()
+		resp.ErrorCode = ErrorCode(err)
+	} else {
+		resp.Succeeded = true
+		resp.OriginalURL = rec.URL
+		resp.SetExpiresAt(rec.Expiry())
+	}
+	WriteJSON(w, resp)
+}
+
+func (ms *MainServer) delete(w http.ResponseWriter, r *http.Request) {
+	resp := SetShortenQueryResponse{}
+	err := r.ParseForm()
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("400 - Bad Request"))
+		return
+	}
+
 	resp.Key = r.Form.Get("key")
-	url, err := ms.store.Query(resp.Key)
+	err = ms.store.Delete(resp.Key)
 	if err != nil {
 		resp.Succeeded = false
 		resp.ErrorMsg = err.Error()
+		resp.ErrorCode = ErrorCode(err)
 	} else {
 		resp.Succeeded = true
-		resp.OriginalURL = url
+		resp.Index = ms.appliedIndex()
+	}
+	WriteJSON(w, resp)
+}
+
+// purge removes a key that moved to another shard
+func (ms *MainServer) purge(w http.ResponseWriter, r *http.Request) {
+	resp := SetShortenQueryResponse{}
+	err := r.ParseForm()
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("400 - Bad Request"))
+		return
+	}
+
+	resp.Key = r.Form.Get("key")
+	err = ms.store.Purge(resp.Key)
+	if err != nil {
+		resp.Succeeded = false
+		resp.ErrorMsg = err.Error()
+		resp.ErrorCode = ErrorCode(err)
+	} else {
+		resp.Succeeded = true
+		resp.Index = ms.appliedIndex()
+	}
+	WriteJSON(w, resp)
+}
+
+// disable disables the key, or enables it again with disabled=false
+func (ms *MainServer) disable(w http.ResponseWriter, r *http.Request) {
+	resp := SetShortenQueryResponse{}
+	err := r.ParseForm()
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("400 - Bad Request"))
+		return
+	}
+
+	resp.Key = r.Form.Get("key")
+	err = ms.store.Disable(resp.Key, r.Form.Get("disabled") != "false")
+	if err != nil {
+		resp.Succeeded = false
+		resp.ErrorMsg = err.Error()
+		resp.ErrorCode = ErrorCode(err)
+	} else {
+		resp.Succeeded = true
+		resp.Index = ms.appliedIndex()
+	}
+	WriteJSON(w, resp)
+}
+
+func (ms *MainServer) update(w http.ResponseWriter, r *http.Request) {
+	resp := SetShortenQueryResponse{}
+	err := r.ParseForm()
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("400 - Bad Request"))
+		return
+	}
+
+	resp.Key = r.Form.Get("key")
+	urlStr, err := ms.canon.Canonicalize(r.Form.Get("url"))
+	if err == nil {
+		err = ms.store.Update(resp.Key, urlStr)
+	}
+	if err != nil {
+		resp.Succeeded = false
+		resp.ErrorMsg = err.Error()
+		resp.ErrorCode = ErrorCode(err)
+	} else {
+		resp.Succeeded = true
+		resp.OriginalURL = urlStr
+		resp.Index = ms.appliedIndex()
 	}
 	WriteJSON(w, resp)
 }
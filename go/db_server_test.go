@@ -12,6 +12,7 @@ import (
 	"strings"
 	"sync"
 	"testing"
+	"time"
 )
 
 func GetRequest(target string, args url.Values) *http.Request {
@@ -65,6 +66,18 @@ func HttpTestPostReserve(
 	return jsonResp, rec, nil
 }
 
+// waitFor polls cond until it holds, failing the test after 5 seconds
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for the condition")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
 func CheckJSONResponse(t *testing.T, jsonResp interface{}, target interface{}) {
 	if !reflect.DeepEqual(jsonResp, target) {
 		t.Errorf("Expected response %+v, got response %+v", target, jsonResp)
@@ -125,6 +138,7 @@ func TestMainServerBasic(t *testing.T) {
 			CheckJSONResponse(t, &jsonResp, &SetShortenQueryResponse{
 				Succeeded: false,
 				ErrorMsg:  jsonResp.ErrorMsg,
+				ErrorCode: ERR_CODE_LINK_NOT_FOUND,
 				Key:       "BADKEY",
 			})
 
@@ -173,3 +187,176 @@ func TestMainServerBasic(t *testing.T) {
 		}
 	})
 }
+
+func TestMainServerAlias(t *testing.T) {
+	testDB := "./test_db_alias"
+	server, err := NewMainServer(testDB)
+	if err != nil {
+		t.Fatalf("Unable to create test server: %s", err.Error())
+	}
+	t.Cleanup(func() {
+		err := server.Close()
+		if err != nil {
+			t.Errorf("Unable to close server: %s", err.Error())
+		}
+		err = os.RemoveAll(testDB)
+		if err != nil {
+			t.Fatalf("Could not remove test db directory: %s", err.Error())
+		}
+	})
+
+	exampleUrl := "http://example.com"
+	jsonResp, _, err := HttpTestPostSetQueryShorten(
+		server.mux, SHORTEN_ENDPOINT, url.Values{"url": {exampleUrl}, "alias": {"q3-launch"}},
+	)
+	if err != nil {
+		t.Fatalf("Unable to mock post: %s", err.Error())
+	}
+	CheckJSONResponse(t, &jsonResp, &SetShortenQueryResponse{
+		Succeeded:   true,
+		Key:         "q3-launch",
+		OriginalURL: exampleUrl,
+	})
+
+	jsonResp, _, err = HttpTestPostSetQueryShorten(
+		server.mux, QUERY_ENDPOINT, url.Values{"key": {"q3-launch"}},
+	)
+	if err != nil {
+		t.Fatalf("Unable to mock post: %s", err.Error())
+	}
+	CheckJSONResponse(t, &jsonResp, &SetShortenQueryResponse{
+		Succeeded:   true,
+		Key:         "q3-launch",
+		OriginalURL: exampleUrl,
+	})
+
+	// taken, reserved and malformed aliases are rejected with distinct codes
+	reserveResp, _, err := HttpTestPostReserve(
+		server.mux, RESERVE_ENDPOINT, url.Values{"num": {"1"}},
+	)
+	if err != nil {
+		t.Fatalf("Unable to mock post: %s", err.Error())
+	}
+	for alias, code := range map[string]string{
+		"q3-launch":         ERR_CODE_ALIAS_IN_USE,
+		reserveResp.Keys[0]: ERR_CODE_ALIAS_IN_USE,
+		"API":               ERR_CODE_INVALID_ALIAS,
+		"no":                ERR_CODE_INVALID_ALIAS,
+		"has space":         ERR_CODE_INVALID_ALIAS,
+	} {
+		jsonResp, _, err = HttpTestPostSetQueryShorten(
+			server.mux, SHORTEN_ENDPOINT, url.Values{"url": {exampleUrl}, "alias": {alias}},
+		)
+		if err != nil {
+			t.Fatalf("Unable to mock post: %s", err.Error())
+		}
+		CheckJSONResponse(t, &jsonResp, &SetShortenQueryResponse{
+			Succeeded: false,
+			ErrorMsg:  jsonResp.ErrorMsg,
+			ErrorCode: code,
+		})
+	}
+}
+
+func TestMainServerDeleteDisable(t *testing.T) {
+	testDB := "./test_db_delete"
+	server, err := NewMainServer(testDB)
+	if err != nil {
+		t.Fatalf("Unable to create test server: %s", err.Error())
+	}
+	t.Cleanup(func() {
+		server.Close()
+		os.RemoveAll(testDB)
+	})
+
+	exampleUrl := "http://example.com"
+	jsonResp, _, _ := HttpTestPostSetQueryShorten(
+		server.mux, SHORTEN_ENDPOINT, url.Values{"url": {exampleUrl}},
+	)
+	key := jsonResp.Key
+
+	steps := []struct {
+		endpoint string
+		args     url.Values
+		code     string
+	}{
+		{DISABLE_ENDPOINT, url.Values{"key": {key}}, ""},
+		{QUERY_ENDPOINT, url.Values{"key": {key}}, ERR_CODE_LINK_DISABLED},
+		{DISABLE_ENDPOINT, url.Values{"key": {key}, "disabled": {"false"}}, ""},
+		{QUERY_ENDPOINT, url.Values{"key": {key}}, ""},
+		{DELETE_ENDPOINT, url.Values{"key": {key}}, ""},
+		{QUERY_ENDPOINT, url.Values{"key": {key}}, ERR_CODE_LINK_DELETED},
+		{DISABLE_ENDPOINT, url.Values{"key": {key}}, ERR_CODE_LINK_NOT_FOUND},
+		{DELETE_ENDPOINT, url.Values{"key": {"BADKEY"}}, ERR_CODE_LINK_NOT_FOUND},
+	}
+	for _, step := range steps {
+		jsonResp, _, err = HttpTestPostSetQueryShorten(server.mux, step.endpoint, step.args)
+		if err != nil {
+			t.Fatalf("Unable to mock post: %s", err.Error())
+		}
+		if jsonResp.Succeeded != (step.code == "") || jsonResp.ErrorCode != step.code {
+			t.Errorf("Expected code %q from %s, got response %+v", step.code, step.endpoint, jsonResp)
+		}
+	}
+}
+
+func TestMainServerReserveLimit(t *testing.T) {
+	store, err := NewMemoryURLStore()
+	if err != nil {
+		t.Fatalf("Unable to create test store: %s", err.Error())
+	}
+	server := NewMainServerWithStore(store)
+	defer server.Close()
+
+	// cache servers cap their reservations at MAX_RESERVE_NUM
+	jsonResp, rec, err := HttpTestPostReserve(
+		server.mux, RESERVE_ENDPOINT, url.Values{"num": {fmt.Sprint(MAX_RESERVE_NUM)}},
+	)
+	if err != nil || !jsonResp.Succeeded || len(jsonResp.Keys) != MAX_RESERVE_NUM {
+		t.Errorf("Expected %d reserved keys, got %d: %d %v", MAX_RESERVE_NUM, len(jsonResp.Keys), rec.Code, err)
+	}
+	_, rec, _ = HttpTestPostReserve(
+		server.mux, RESERVE_ENDPOINT, url.Values{"num": {fmt.Sprint(MAX_RESERVE_NUM + 1)}},
+	)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 above the limit, got: %d", rec.Code)
+	}
+}
+
+func TestMainServerRelease(t *testing.T) {
+	store, err := NewMemoryURLStore()
+	if err != nil {
+		t.Fatalf("Unable to create test store: %s", err.Error())
+	}
+	server := NewMainServerWithStore(store)
+	defer server.Close()
+	keys, err := store.Reserve(3)
+	if err != nil {
+		t.Fatalf("Unable to reserve keys: %s", err.Error())
+	}
+	if err := store.SetReserve(keys[0], "http://example.com", LinkOptions{}); err != nil {
+		t.Fatalf("Unable to set reserved key: %s", err.Error())
+	}
+
+	// used and unknown keys are left alone
+	jsonResp, rec, err := HttpTestPostReserve(
+		server.mux, RELEASE_ENDPOINT, url.Values{"key": append(keys, "unknown")},
+	)
+	if err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("Unable to release keys: %v %d", err, rec.Code)
+	}
+	CheckJSONResponse(t, &jsonResp, &ReserveResponse{Succeeded: true, Keys: keys[1:]})
+	if rec, err := store.Query(keys[0]); err != nil || rec.URL != "http://example.com" {
+		t.Errorf("Expected the used key to be kept, got %+v %v", rec, err)
+	}
+	for _, key := range keys[1:] {
+		if err := store.SetReserve(key, "http://example.com", LinkOptions{}); err == nil {
+			t.Errorf("Expected released key %s to no longer be settable", key)
+		}
+	}
+
+	jsonResp, _, _ = HttpTestPostReserve(server.mux, RELEASE_ENDPOINT, url.Values{"key": {"bad key"}})
+	if jsonResp.Succeeded {
+		t.Errorf("Expected releasing an invalid key to fail")
+	}
+}
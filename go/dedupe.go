@@ -0,0 +1,50 @@
+package shortener
+
+import (
+	"crypto/sha256"
+)
+
+// the dedupe index maps the hash of a normalized url to the key of a
+// link pointing at it. only links that never expire are indexed, as an
+// expiring link cannot stand in for a permanent one
+const DEDUPE_PREFIX = "!url/"
+
+func dedupeKey(urlStr string) []byte {
+	sum := sha256.Sum256([]byte(normalizeURL(urlStr)))
+	return append([]byte(DEDUPE_PREFIX), sum[:]...)
+}
+
+// lookupDedupe returns the key of a live, permanent link to urlStr, or an
+// empty string if there is none
+func lookupDedupe(txn kvTxn, urlStr string) (string, error) {
+	v, err := txn.Get(dedupeKey(urlStr))
+	if err == errKeyNotFound {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	key := v.Value
+	// the index is only a hint, the link may have been replaced since
+	v, err = txn.Get(key)
+	if err == errKeyNotFound {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	rec, err := readRecord(v)
+	if err != nil {
+		return "", err
+	}
+	if rec.Flags != 0 || rec.ExpiresAt != 0 || normalizeURL(rec.URL) != normalizeURL(urlStr) {
+		return "", nil
+	}
+	return string(key), nil
+}
+
+// indexDedupe points the dedupe index for the record's url at key
+func indexDedupe(txn kvTxn, key []byte, rec LinkRecord) error {
+	if rec.Flags != 0 || rec.ExpiresAt != 0 {
+		return nil
+	}
+	return txn.Set(dedupeKey(rec.URL), key, 0)
+}
@@ -0,0 +1,115 @@
+package shortener
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+const (
+	// 62^7 < 2^42, so the cipher works on 42 bit blocks and cycle walks
+	// any output past MAX_KEY_NUM back into the key space
+	FEISTEL_HALF_BITS = 21
+	FEISTEL_HALF_MASK = 1<<FEISTEL_HALF_BITS - 1
+	FEISTEL_ROUNDS    = 8
+)
+
+// UniqueKeyGenerator is implemented by generators that never hand out the
+// same key twice, so allocation can skip checking whether keys are in use
+type UniqueKeyGenerator interface {
+	KeyGenerator
+	// Owns reports whether the generator may hand out key, in which case
+	// it must not be taken as an alias
+	Owns(key string) bool
+}
+
+// KeyCounter is a persistent, monotonic counter. *badger.Sequence
+// satisfies it
+type KeyCounter interface {
+	Next() (uint64, error)
+}
+
+// FeistelKeyGenerator encrypts a sequential counter with a Feistel network
+// over the 62^7 key space. Keys are unique as the cipher is a permutation,
+// and unguessable as long as the secret is kept. Changing the secret or
+// switching generators on an existing db may hand out keys already in use
+type FeistelKeyGenerator struct {
+	secret  []byte
+	counter KeyCounter
+	lock    sync.Mutex
+}
+
+func NewFeistelKeyGenerator(secret []byte, counter KeyCounter) (*FeistelKeyGenerator, error) {
+	if len(secret) == 0 {
+		return nil, errors.New("feistel key generator needs a secret")
+	}
+	return &FeistelKeyGenerator{secret: secret, counter: counter}, nil
+}
+
+// GenKey ignores n, as keys are always KEY_LEN digits
+func (gen *FeistelKeyGenerator) GenKey(n int, key *[]byte) error {
+	gen.lock.Lock()
+	num, err := gen.counter.Next()
+	gen.lock.Unlock()
+	if err != nil {
+		return err
+	}
+	if num >= MAX_KEY_NUM {
+		return fmt.Errorf("%w: feistel counter at %d", ErrKeySpaceExhausted, num)
+	}
+	base62EncodePadded(gen.permute(num), KEY_LEN, key)
+	return nil
+}
+
+func (gen *FeistelKeyGenerator) Owns(key string) bool {
+	if len(key) != KEY_LEN {
+		return false
+	}
+	for _, c := range key {
+		if c == '-' || c == '_' {
+			return false
+		}
+	}
+	return ValidKey(key)
+}
+
+// permute maps num in [0, MAX_KEY_NUM) to a unique value in the same range
+func (gen *FeistelKeyGenerator) permute(num uint64) uint64 {
+	// encrypting a value in range always eventually lands back in range,
+	// as the cipher is a permutation of the 42 bit block
+	num = gen.encrypt(num)
+	for num >= MAX_KEY_NUM {
+		num = gen.encrypt(num)
+	}
+	return num
+}
+
+func (gen *FeistelKeyGenerator) encrypt(block uint64) uint64 {
+	left, right := block>>FEISTEL_HALF_BITS, block&FEISTEL_HALF_MASK
+	for i := 0; i < FEISTEL_ROUNDS; i++ {
+		left, right = right, left^gen.round(i, right)
+	}
+	return left<<FEISTEL_HALF_BITS | right
+}
+
+// round is the keyed round function, a truncated HMAC of the round
+// number and half block
+func (gen *FeistelKeyGenerator) round(i int, half uint64) uint64 {
+	var buf [9]byte
+	buf[0] = byte(i)
+	binary.BigEndian.PutUint64(buf[1:], half)
+	mac := hmac.New(sha256.New, gen.secret)
+	mac.Write(buf[:])
+	return binary.BigEndian.Uint64(mac.Sum(nil)) & FEISTEL_HALF_MASK
+}
+
+// base62EncodePadded is base62Encode padded with zeros to n digits
+func base62EncodePadded(num uint64, n int, ret *[]byte) {
+	base62Encode(num, ret)
+	for len(*ret) < n {
+		*ret = append(*ret, base62Lut[0])
+	}
+}
@@ -0,0 +1,168 @@
+package shortener
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+)
+
+var (
+	ErrKeySpaceExhausted = errors.New("key space exhausted")
+)
+
+const (
+	MAX_KEY_RETRIES = 16
+	// how many candidates a key filter may reject in a row before giving
+	// up, far more than any sensible number of shards needs
+	MAX_FILTERED_KEYS = 1 << 16
+	// 62^10 is the largest key space that still fits in a uint64
+	MAX_KEY_LEN = 10
+
+	// keys grow by a digit once more than KEY_GROW_COLLISION_RATE of the
+	// last KEY_GROW_WINDOW candidates were already in use
+	KEY_GROW_COLLISION_RATE = 0.25
+	KEY_GROW_WINDOW         = 1024
+)
+
+// keyAllocator hands out unused keys, checking every candidate and
+// growing the key length when the key space gets crowded
+type keyAllocator struct {
+	gen KeyGenerator
+	// called with the length of every key allocated past KEY_LEN and the
+	// transaction it is written in, so that the stored length never falls
+	// behind a written key
+	onGrow func(txn kvTxn, length int) error
+	// keys the filter rejects belong to another shard. they are skipped
+	// without counting as collisions, nil accepts every key
+	filter func(key []byte) bool
+
+	lock       sync.Mutex
+	length     int
+	candidates int
+	collisions int
+}
+
+func newKeyAllocator(gen KeyGenerator, length int, onGrow func(kvTxn, int) error) *keyAllocator {
+	return &keyAllocator{gen: gen, length: length, onGrow: onGrow}
+}
+
+func (a *keyAllocator) keyLen() int {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.length
+}
+
+// raise grows keys to length if they are shorter, for keys allocated by
+// another node
+func (a *keyAllocator) raise(length int) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if length > a.length {
+		a.length = length
+	}
+}
+
+// keyBatch allocates the keys of one transaction
+type keyBatch struct {
+	alloc *keyAllocator
+	// keys of a unique generator, generated before the transaction
+	unique [][]byte
+}
+
+// batch prepares allocating up to num keys in one transaction. Unique
+// generators never repeat themselves, so there is nothing to check their
+// keys against and they are generated here instead: counter based ones
+// lease counter values in a write of their own, which engines with a
+// single writer cannot start while the transaction is open
+func (a *keyAllocator) batch(num int) (*keyBatch, error) {
+	b := &keyBatch{alloc: a}
+	if _, ok := a.gen.(UniqueKeyGenerator); !ok {
+		return b, nil
+	}
+	b.unique = make([][]byte, num)
+	for i := range b.unique {
+		b.unique[i] = make([]byte, 0, KEY_LEN)
+		if err := a.genFiltered(KEY_LEN, &b.unique[i]); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+// allocate writes an unused key to key, see keyAllocator.allocate
+func (b *keyBatch) allocate(txn kvTxn, key *[]byte, exists func(key []byte) (bool, error)) error {
+	if _, ok := b.alloc.gen.(UniqueKeyGenerator); !ok {
+		return b.alloc.allocate(txn, key, exists)
+	}
+	if len(b.unique) == 0 {
+		return errors.New("more keys allocated than batched")
+	}
+	*key = append((*key)[:0], b.unique[0]...)
+	b.unique = b.unique[1:]
+	return nil
+}
+
+// allocate writes an unused key to key. exists reports whether a
+// candidate is already in use, and is expected to read from txn, the
+// transaction the key will be written in. txn is nil for keys that are
+// written elsewhere
+func (a *keyAllocator) allocate(txn kvTxn, key *[]byte, exists func(key []byte) (bool, error)) error {
+	var length int
+	for i := 0; i < MAX_KEY_RETRIES; i++ {
+		// keys may grow between candidates
+		length = a.keyLen()
+		if err := a.genFiltered(length, key); err != nil {
+			return err
+		}
+		used, err := exists(*key)
+		if err != nil {
+			return err
+		}
+		a.record(used)
+		if used {
+			continue
+		}
+		if length > KEY_LEN && a.onGrow != nil {
+			return a.onGrow(txn, length)
+		}
+		return nil
+	}
+	return fmt.Errorf(
+		"%w: no unused %d digit key after %d attempts", ErrKeySpaceExhausted, length, MAX_KEY_RETRIES,
+	)
+}
+
+// genFiltered generates a key of length that passes the filter
+func (a *keyAllocator) genFiltered(length int, key *[]byte) error {
+	for i := 0; i < MAX_FILTERED_KEYS; i++ {
+		if err := a.gen.GenKey(length, key); err != nil {
+			return err
+		}
+		if a.filter == nil || a.filter(*key) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: no key for this shard after %d attempts", ErrKeySpaceExhausted, MAX_FILTERED_KEYS)
+}
+
+// record counts a candidate towards the collision rate, growing the key
+// length once the current window is done if the rate was too high
+func (a *keyAllocator) record(collided bool) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.candidates++
+	if collided {
+		a.collisions++
+	}
+	if a.candidates < KEY_GROW_WINDOW {
+		return
+	}
+	rate := float64(a.collisions) / float64(a.candidates)
+	a.candidates, a.collisions = 0, 0
+	if rate <= KEY_GROW_COLLISION_RATE || a.length >= MAX_KEY_LEN {
+		return
+	}
+	log.Printf("Key collision rate %.2f over %d digit keys, growing keys\n", rate, a.length)
+	a.length++
+}
@@ -0,0 +1,57 @@
+package shortener
+
+import (
+	crand "crypto/rand"
+	"math/rand"
+	"sync"
+)
+
+// KeyGenerator generates candidate keys for new links
+type KeyGenerator interface {
+	// GenKey writes a random key of n base62 digits to key, which is
+	// cleared before use
+	GenKey(n int, key *[]byte) error
+}
+
+// CryptoKeyGenerator draws keys from crypto/rand, so that keys cannot be
+// predicted from previously handed out ones
+type CryptoKeyGenerator struct{}
+
+func (CryptoKeyGenerator) GenKey(n int, key *[]byte) error {
+	*key = (*key)[:0]
+	var buf [32]byte
+	for len(*key) < n {
+		if _, err := crand.Read(buf[:]); err != nil {
+			return err
+		}
+		for _, b := range buf {
+			// 248 is the largest multiple of 62 that fits in a byte. bytes
+			// past it are rejected so that every digit is equally likely
+			if b < 248 && len(*key) < n {
+				*key = append(*key, base62Lut[b%62])
+			}
+		}
+	}
+	return nil
+}
+
+// SeededKeyGenerator generates the same keys for the same seed. It is
+// only meant for tests, as its keys are trivially guessable
+type SeededKeyGenerator struct {
+	rng  *rand.Rand
+	lock sync.Mutex
+}
+
+func NewSeededKeyGenerator(seed int64) *SeededKeyGenerator {
+	return &SeededKeyGenerator{rng: rand.New(rand.NewSource(seed))}
+}
+
+func (gen *SeededKeyGenerator) GenKey(n int, key *[]byte) error {
+	*key = (*key)[:0]
+	gen.lock.Lock()
+	for i := 0; i < n; i++ {
+		*key = append(*key, base62Lut[gen.rng.Intn(62)])
+	}
+	gen.lock.Unlock()
+	return nil
+}
@@ -0,0 +1,90 @@
+package shortener
+
+import (
+	"container/heap"
+	"errors"
+	"expvar"
+	"sync"
+	"time"
+)
+
+var (
+	ErrEmptyQueue = errors.New("Pop from empty queue")
+)
+
+// reserved keys that expired before they were handed out, served from
+// /debug/vars
+var reserveWasted = expvar.NewInt("reserve_wasted")
+
+// keyHeap is a min heap of keys by expiry
+type keyHeap []cacheKey
+
+func (h keyHeap) Len() int            { return len(h) }
+func (h keyHeap) Less(i, j int) bool  { return h[i].expiry < h[j].expiry }
+func (h keyHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *keyHeap) Push(x interface{}) { *h = append(*h, x.(cacheKey)) }
+func (h *keyHeap) Pop() interface{} {
+	old := *h
+	ret := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return ret
+}
+
+// KeyQueue: thread safe queue of reserved keys handing out the key closest
+// to expiring first, so that keys are used before they go stale
+type KeyQueue struct {
+	keys keyHeap
+	lock sync.Mutex
+}
+
+func (kq *KeyQueue) PushAll(vals []cacheKey) {
+	kq.lock.Lock()
+	defer kq.lock.Unlock()
+	for _, k := range vals {
+		heap.Push(&kq.keys, k)
+	}
+}
+
+// Pop returns the oldest key still valid at now, discarding the expired
+// keys in front of it
+func (kq *KeyQueue) Pop(now time.Time) (cacheKey, error) {
+	kq.lock.Lock()
+	defer kq.lock.Unlock()
+	kq.evict(now)
+	if len(kq.keys) == 0 {
+		return cacheKey{}, ErrEmptyQueue
+	}
+	return heap.Pop(&kq.keys).(cacheKey), nil
+}
+
+// Evict discards the keys expired at now, returning how many there were
+func (kq *KeyQueue) Evict(now time.Time) int {
+	kq.lock.Lock()
+	defer kq.lock.Unlock()
+	return kq.evict(now)
+}
+
+func (kq *KeyQueue) evict(now time.Time) int {
+	evicted := 0
+	for len(kq.keys) > 0 && kq.keys[0].expiry <= now.Unix() {
+		heap.Pop(&kq.keys)
+		evicted++
+	}
+	reserveWasted.Add(int64(evicted))
+	return evicted
+}
+
+func (kq *KeyQueue) Len() int {
+	kq.lock.Lock()
+	defer kq.lock.Unlock()
+	return len(kq.keys)
+}
+
+// Drain empties the queue, returning everything that was in it
+func (kq *KeyQueue) Drain() []cacheKey {
+	kq.lock.Lock()
+	defer kq.lock.Unlock()
+	ret := kq.keys
+	kq.keys = nil
+	return ret
+}
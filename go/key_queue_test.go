@@ -0,0 +1,41 @@
+package shortener
+
+import (
+	"testing"
+	"time"
+)
+
+func TestKeyQueue(t *testing.T) {
+	now := time.Now()
+	at := func(d time.Duration) int64 { return now.Add(d).Unix() }
+	var kq KeyQueue
+	kq.PushAll([]cacheKey{
+		{"late", at(3 * time.Hour), "db"},
+		{"expired", at(-time.Hour), "db"},
+		{"early", at(time.Hour), "db"},
+	})
+	kq.PushAll([]cacheKey{{"middle", at(2 * time.Hour), "db"}})
+
+	// the oldest valid key comes first, and expired keys are never handed out
+	wasted := reserveWasted.Value()
+	for _, expected := range []string{"early", "middle"} {
+		key, err := kq.Pop(now)
+		if err != nil || key.key != expected {
+			t.Errorf("Expected to pop %s, got %+v %v", expected, key, err)
+		}
+	}
+	if reserveWasted.Value()-wasted != 1 {
+		t.Errorf("Expected 1 wasted key, got %d", reserveWasted.Value()-wasted)
+	}
+
+	kq.PushAll([]cacheKey{{"soon", at(time.Minute), "db"}})
+	if n := kq.Evict(now.Add(time.Hour)); n != 1 || kq.Len() != 1 {
+		t.Errorf("Expected to evict 1 of 2 keys, evicted %d leaving %d", n, kq.Len())
+	}
+	if _, err := kq.Pop(now.Add(4 * time.Hour)); err != ErrEmptyQueue {
+		t.Errorf("Expected the last key to have expired, got %v", err)
+	}
+	if reserveWasted.Value()-wasted != 3 {
+		t.Errorf("Expected 3 wasted keys, got %d", reserveWasted.Value()-wasted)
+	}
+}
@@ -0,0 +1,195 @@
+package shortener
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	boltLinksBucket     = []byte("links")
+	boltSequencesBucket = []byte("sequences")
+)
+
+// boltEngine keeps everything in a single bbolt file. bolt has no TTLs,
+// so every value is prefixed with its expiry and expired values are
+// treated as missing until they are overwritten or purged
+type boltEngine struct {
+	db *bolt.DB
+}
+
+func openBoltEngine(path string) (*boltEngine, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 10 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(boltLinksBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(boltSequencesBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &boltEngine{db: db}, nil
+}
+
+// decodeBoltValue splits a stored value into its expiry and value, and
+// reports whether it is still live
+func decodeBoltValue(raw []byte, now int64) (kvValue, bool) {
+	if len(raw) < 8 {
+		return kvValue{}, false
+	}
+	expiresAt := binary.BigEndian.Uint64(raw)
+	if expiresAt != 0 && uint64(now) >= expiresAt {
+		return kvValue{}, false
+	}
+	return kvValue{Value: append([]byte{}, raw[8:]...), ExpiresAt: expiresAt}, true
+}
+
+type boltTxn struct {
+	bucket *bolt.Bucket
+}
+
+func (t boltTxn) Get(key []byte) (kvValue, error) {
+	val, ok := decodeBoltValue(t.bucket.Get(key), time.Now().Unix())
+	if !ok {
+		return kvValue{}, errKeyNotFound
+	}
+	return val, nil
+}
+
+func (t boltTxn) Set(key, val []byte, expiresAt uint64) error {
+	raw := make([]byte, 8+len(val))
+	binary.BigEndian.PutUint64(raw, expiresAt)
+	copy(raw[8:], val)
+	return t.bucket.Put(key, raw)
+}
+
+func (t boltTxn) Delete(key []byte) error {
+	return t.bucket.Delete(key)
+}
+
+func (e *boltEngine) View(fn func(txn kvTxn) error) error {
+	return e.db.View(func(tx *bolt.Tx) error {
+		return fn(boltTxn{tx.Bucket(boltLinksBucket)})
+	})
+}
+
+func (e *boltEngine) Update(fn func(txn kvTxn) error) error {
+	return e.db.Update(func(tx *bolt.Tx) error {
+		return fn(boltTxn{tx.Bucket(boltLinksBucket)})
+	})
+}
+
+func (e *boltEngine) Iterate(prefix []byte, fn func(key []byte, val kvValue) error) error {
+	now := time.Now().Unix()
+	return e.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltLinksBucket).Cursor()
+		for k, raw := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, raw = c.Next() {
+			if val, ok := decodeBoltValue(raw, now); ok {
+				if err := fn(append([]byte{}, k...), val); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// Sequence leases SEQUENCE_BANDWIDTH values at a time from the sequence
+// of a bucket named after the counter, as every bolt write is an fsync
+func (e *boltEngine) Sequence(name []byte) (KeyCounter, error) {
+	return &leasedCounter{lease: func() (uint64, error) {
+		var start uint64
+		err := e.db.Update(func(tx *bolt.Tx) error {
+			b, err := tx.Bucket(boltSequencesBucket).CreateBucketIfNotExists(name)
+			if err != nil {
+				return err
+			}
+			start = b.Sequence()
+			return b.SetSequence(start + SEQUENCE_BANDWIDTH)
+		})
+		return start, err
+	}}, nil
+}
+
+// Reclaim deletes expired values. bolt keeps the freed pages for reuse
+// rather than shrinking the file
+func (e *boltEngine) Reclaim(discardRatio float64) (int64, error) {
+	now := time.Now().Unix()
+	var freed int64
+	err := e.db.Update(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltLinksBucket).Cursor()
+		for k, raw := c.First(); k != nil; {
+			if _, ok := decodeBoltValue(raw, now); ok {
+				k, raw = c.Next()
+				continue
+			}
+			freed += int64(len(k) + len(raw))
+			k = append([]byte{}, k...)
+			if err := c.Delete(); err != nil {
+				return err
+			}
+			// Next skips a key after a delete, so seek past the deleted one
+			k, raw = c.Seek(k)
+		}
+		return nil
+	})
+	return freed, err
+}
+
+// fresh opens an empty bolt database next to this one
+func (e *boltEngine) fresh() (kvEngine, error) {
+	path := e.db.Path() + RESTORE_SUFFIX
+	if err := os.RemoveAll(path); err != nil {
+		return nil, err
+	}
+	return openBoltEngine(path)
+}
+
+func (e *boltEngine) replace(next kvEngine) (kvEngine, error) {
+	path, nextPath := e.db.Path(), next.(*boltEngine).db.Path()
+	return replaceEngine(e, next, path, nextPath, func(path string) (kvEngine, error) {
+		db, err := openBoltEngine(path)
+		if err != nil {
+			return nil, err
+		}
+		return db, nil
+	})
+}
+
+func (e *boltEngine) Close() error {
+	return e.db.Close()
+}
+
+// leasedCounter hands out values from leases of SEQUENCE_BANDWIDTH
+// values, where lease persists the end of a new lease and returns its start
+type leasedCounter struct {
+	lease func() (uint64, error)
+
+	lock   sync.Mutex
+	next   uint64
+	leased uint64
+}
+
+func (c *leasedCounter) Next() (uint64, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.next >= c.leased {
+		start, err := c.lease()
+		if err != nil {
+			return 0, err
+		}
+		c.next, c.leased = start, start+SEQUENCE_BANDWIDTH
+	}
+	c.next++
+	return c.next - 1, nil
+}
@@ -0,0 +1,206 @@
+package shortener
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+
+	"github.com/dgraph-io/badger"
+)
+
+var (
+	errKeyNotFound = errors.New("key not found")
+	errReadOnlyTxn = errors.New("write in read only transaction")
+)
+
+// kvValue is a value read from a kvEngine
+type kvValue struct {
+	Value []byte
+	// unix seconds, 0 if the value never expires
+	ExpiresAt uint64
+}
+
+// kvTxn is a transaction on a kvEngine. Writes are only allowed in
+// transactions started with Update
+type kvTxn interface {
+	// Get returns errKeyNotFound for missing and expired keys
+	Get(key []byte) (kvValue, error)
+	// Set stores val under key until expiresAt, in unix seconds, or
+	// forever if it is 0
+	Set(key, val []byte, expiresAt uint64) error
+	Delete(key []byte) error
+}
+
+// kvEngine is the key value store a URLStore keeps its links in. Engines
+// must provide serializable transactions, and must stop returning keys
+// once they expire
+type kvEngine interface {
+	View(fn func(txn kvTxn) error) error
+	Update(fn func(txn kvTxn) error) error
+	// Iterate calls fn for every live key starting with prefix
+	Iterate(prefix []byte, fn func(key []byte, val kvValue) error) error
+	Sequence(name []byte) (KeyCounter, error)
+	// Reclaim frees the space held by expired and overwritten values, and
+	// returns roughly how many bytes it freed. discardRatio is how much
+	// of a badger value log file must be garbage before it is rewritten,
+	// other engines ignore it
+	Reclaim(discardRatio float64) (int64, error)
+	Close() error
+}
+
+type badgerEngine struct {
+	db   *badger.DB
+	path string
+	seqs []*badger.Sequence
+	lock sync.Mutex
+}
+
+func openBadgerEngine(path string) (*badgerEngine, error) {
+	db, err := badger.Open(badger.DefaultOptions(path).WithTruncate(true))
+	if err != nil {
+		return nil, err
+	}
+	return &badgerEngine{db: db, path: path}, nil
+}
+
+type badgerTxn struct {
+	txn *badger.Txn
+}
+
+func (t badgerTxn) Get(key []byte) (kvValue, error) {
+	item, err := t.txn.Get(key)
+	if err == badger.ErrKeyNotFound {
+		return kvValue{}, errKeyNotFound
+	} else if err != nil {
+		return kvValue{}, err
+	}
+	return readBadgerItem(item)
+}
+
+// Set copies key and val, as badger holds on to them until the
+// transaction commits and callers reuse their buffers
+func (t badgerTxn) Set(key, val []byte, expiresAt uint64) error {
+	e := badger.NewEntry(append([]byte{}, key...), append([]byte{}, val...))
+	e.ExpiresAt = expiresAt
+	return t.txn.SetEntry(e)
+}
+
+func (t badgerTxn) Delete(key []byte) error {
+	return t.txn.Delete(append([]byte{}, key...))
+}
+
+func readBadgerItem(item *badger.Item) (kvValue, error) {
+	val, err := item.ValueCopy(nil)
+	if err != nil {
+		return kvValue{}, err
+	}
+	return kvValue{Value: val, ExpiresAt: item.ExpiresAt()}, nil
+}
+
+func (e *badgerEngine) View(fn func(txn kvTxn) error) error {
+	return e.db.View(func(txn *badger.Txn) error {
+		return fn(badgerTxn{txn})
+	})
+}
+
+func (e *badgerEngine) Update(fn func(txn kvTxn) error) error {
+	return e.db.Update(func(txn *badger.Txn) error {
+		return fn(badgerTxn{txn})
+	})
+}
+
+func (e *badgerEngine) Iterate(prefix []byte, fn func(key []byte, val kvValue) error) error {
+	return e.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			item := it.Item()
+			val, err := readBadgerItem(item)
+			if err != nil {
+				return err
+			}
+			if err := fn(item.KeyCopy(nil), val); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (e *badgerEngine) Sequence(name []byte) (KeyCounter, error) {
+	seq, err := e.db.GetSequence(name, SEQUENCE_BANDWIDTH)
+	if err != nil {
+		return nil, err
+	}
+	e.lock.Lock()
+	e.seqs = append(e.seqs, seq)
+	e.lock.Unlock()
+	return seq, nil
+}
+
+// Reclaim rewrites value log files until badger finds none worth
+// rewriting. badger only refreshes DB.Size once a minute, so the freed
+// space is measured from the files themselves
+func (e *badgerEngine) Reclaim(discardRatio float64) (int64, error) {
+	before, err := dirSize(e.path)
+	if err != nil {
+		return 0, err
+	}
+	for {
+		err := e.db.RunValueLogGC(discardRatio)
+		if err == badger.ErrNoRewrite || err == badger.ErrRejected {
+			break
+		} else if err != nil {
+			return 0, err
+		}
+	}
+	after, err := dirSize(e.path)
+	return before - after, err
+}
+
+// dirSize sums the sizes of the files directly in dir
+func dirSize(dir string) (int64, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+	var size int64
+	for _, f := range files {
+		if !f.IsDir() {
+			size += f.Size()
+		}
+	}
+	return size, nil
+}
+
+// fresh opens an empty badger database next to this one
+func (e *badgerEngine) fresh() (kvEngine, error) {
+	path := e.path + RESTORE_SUFFIX
+	if err := os.RemoveAll(path); err != nil {
+		return nil, err
+	}
+	return openBadgerEngine(path)
+}
+
+func (e *badgerEngine) replace(next kvEngine) (kvEngine, error) {
+	return replaceEngine(e, next, e.path, next.(*badgerEngine).path, func(path string) (kvEngine, error) {
+		db, err := openBadgerEngine(path)
+		if err != nil {
+			return nil, err
+		}
+		return db, nil
+	})
+}
+
+func (e *badgerEngine) Close() error {
+	e.lock.Lock()
+	for _, seq := range e.seqs {
+		if err := seq.Release(); err != nil {
+			log.Printf("Error releasing sequence: %s\n", err.Error())
+		}
+	}
+	e.lock.Unlock()
+	return e.db.Close()
+}
@@ -0,0 +1,165 @@
+package shortener
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// memoryEngine keeps everything in a map, for tests and deployments that
+// can afford to lose their links. Update transactions hold the write lock
+// throughout, so they are trivially serializable
+type memoryEngine struct {
+	lock sync.RWMutex
+	data map[string]kvValue
+	seqs map[string]*uint64
+}
+
+func newMemoryEngine() *memoryEngine {
+	return &memoryEngine{
+		data: make(map[string]kvValue),
+		seqs: make(map[string]*uint64),
+	}
+}
+
+func (e *memoryEngine) live(val kvValue, ok bool) bool {
+	return ok && (val.ExpiresAt == 0 || uint64(time.Now().Unix()) < val.ExpiresAt)
+}
+
+// memoryTxn buffers writes until the transaction commits. a nil value in
+// writes marks a delete
+type memoryTxn struct {
+	engine *memoryEngine
+	writes map[string]*kvValue
+}
+
+func (t *memoryTxn) Get(key []byte) (kvValue, error) {
+	if w, ok := t.writes[string(key)]; ok {
+		if w == nil {
+			return kvValue{}, errKeyNotFound
+		}
+		return *w, nil
+	}
+	val, ok := t.engine.data[string(key)]
+	if !t.engine.live(val, ok) {
+		return kvValue{}, errKeyNotFound
+	}
+	return kvValue{Value: append([]byte{}, val.Value...), ExpiresAt: val.ExpiresAt}, nil
+}
+
+func (t *memoryTxn) Set(key, val []byte, expiresAt uint64) error {
+	if t.writes == nil {
+		return errReadOnlyTxn
+	}
+	t.writes[string(key)] = &kvValue{Value: append([]byte{}, val...), ExpiresAt: expiresAt}
+	return nil
+}
+
+func (t *memoryTxn) Delete(key []byte) error {
+	if t.writes == nil {
+		return errReadOnlyTxn
+	}
+	t.writes[string(key)] = nil
+	return nil
+}
+
+func (e *memoryEngine) View(fn func(txn kvTxn) error) error {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+	return fn(&memoryTxn{engine: e})
+}
+
+func (e *memoryEngine) Update(fn func(txn kvTxn) error) error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	txn := &memoryTxn{engine: e, writes: make(map[string]*kvValue)}
+	if err := fn(txn); err != nil {
+		return err
+	}
+	for k, w := range txn.writes {
+		if w == nil {
+			delete(e.data, k)
+		} else {
+			e.data[k] = *w
+		}
+	}
+	return nil
+}
+
+// Iterate walks the keys in order, like the other engines
+func (e *memoryEngine) Iterate(prefix []byte, fn func(key []byte, val kvValue) error) error {
+	e.lock.RLock()
+	keys := make([]string, 0, len(e.data))
+	for k := range e.data {
+		if strings.HasPrefix(k, string(prefix)) {
+			keys = append(keys, k)
+		}
+	}
+	e.lock.RUnlock()
+	sort.Strings(keys)
+	for _, k := range keys {
+		var val kvValue
+		err := e.View(func(txn kvTxn) error {
+			var err error
+			val, err = txn.Get([]byte(k))
+			return err
+		})
+		if err == errKeyNotFound {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if err := fn([]byte(k), val); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *memoryEngine) Sequence(name []byte) (KeyCounter, error) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	seq, ok := e.seqs[string(name)]
+	if !ok {
+		seq = new(uint64)
+		e.seqs[string(name)] = seq
+	}
+	return memoryCounter{seq}, nil
+}
+
+// Reclaim drops expired values, which are otherwise only hidden
+func (e *memoryEngine) Reclaim(discardRatio float64) (int64, error) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	var freed int64
+	for k, val := range e.data {
+		if !e.live(val, true) {
+			freed += int64(len(k) + len(val.Value))
+			delete(e.data, k)
+		}
+	}
+	return freed, nil
+}
+
+func (e *memoryEngine) fresh() (kvEngine, error) {
+	return newMemoryEngine(), nil
+}
+
+// replace hands back next as is, as there is nothing to move
+func (e *memoryEngine) replace(next kvEngine) (kvEngine, error) {
+	return next, nil
+}
+
+func (e *memoryEngine) Close() error {
+	return nil
+}
+
+type memoryCounter struct {
+	next *uint64
+}
+
+func (c memoryCounter) Next() (uint64, error) {
+	return atomic.AddUint64(c.next, 1) - 1, nil
+}
@@ -0,0 +1,329 @@
+package shortener
+
+import (
+	"database/sql"
+	"encoding/binary"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+const (
+	SQLITE_ITERATE_PAGE = 1000
+)
+
+// links are spread over three tables so that analysts can query them
+// with plain SQL: live links and tombstones in links, keys reserved by
+// cache servers in reservations, and store bookkeeping in metadata.
+// every table keeps the encoded record as well, which is what the store
+// reads back. ttl is when the engine reclaims a row, not the link expiry
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS links (
+	key        TEXT PRIMARY KEY,
+	url        TEXT NOT NULL,
+	created_at INTEGER NOT NULL,
+	expires_at INTEGER,
+	creator    TEXT,
+	disabled   INTEGER NOT NULL,
+	deleted    INTEGER NOT NULL,
+	record     BLOB NOT NULL,
+	ttl        INTEGER
+);
+CREATE TABLE IF NOT EXISTS reservations (
+	key         TEXT PRIMARY KEY,
+	reserved_at INTEGER NOT NULL,
+	expires_at  INTEGER NOT NULL,
+	record      BLOB NOT NULL
+);
+CREATE TABLE IF NOT EXISTS metadata (
+	key   TEXT PRIMARY KEY,
+	value BLOB NOT NULL,
+	ttl   INTEGER
+);
+CREATE INDEX IF NOT EXISTS links_url ON links (url);
+`
+
+// sqliteEngine stores links in a SQLite database. sqlite only allows one
+// writer at a time, so the engine uses a single connection and
+// serializes every transaction on it
+type sqliteEngine struct {
+	db   *sql.DB
+	path string
+	lock sync.Mutex
+}
+
+func openSQLiteEngine(path string) (*sqliteEngine, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+	for _, stmt := range []string{"PRAGMA journal_mode=WAL", "PRAGMA synchronous=NORMAL", sqliteSchema} {
+		if _, err := db.Exec(stmt); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	return &sqliteEngine{db: db, path: path}, nil
+}
+
+// Reclaim deletes every row past its TTL, which reads only hide until
+// then. sqlite keeps the freed pages for reuse rather than shrinking the
+// file, so the freed bytes are those added to the freelist
+func (e *sqliteEngine) Reclaim(discardRatio float64) (int64, error) {
+	before, err := e.freeBytes()
+	if err != nil {
+		return 0, err
+	}
+	if _, err := e.reclaim(time.Now()); err != nil {
+		return 0, err
+	}
+	after, err := e.freeBytes()
+	return after - before, err
+}
+
+func (e *sqliteEngine) freeBytes() (int64, error) {
+	var pages, pageSize int64
+	if err := e.db.QueryRow("PRAGMA freelist_count").Scan(&pages); err != nil {
+		return 0, err
+	}
+	err := e.db.QueryRow("PRAGMA page_size").Scan(&pageSize)
+	return pages * pageSize, err
+}
+
+// reclaim deletes every row past its TTL as of now, returning how many
+func (e *sqliteEngine) reclaim(now time.Time) (int64, error) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	var total int64
+	for _, stmt := range []string{
+		"DELETE FROM links WHERE ttl IS NOT NULL AND ttl <= ?",
+		"DELETE FROM reservations WHERE expires_at <= ?",
+		"DELETE FROM metadata WHERE ttl IS NOT NULL AND ttl <= ?",
+	} {
+		res, err := e.db.Exec(stmt, now.Unix())
+		if err != nil {
+			return total, err
+		}
+		n, _ := res.RowsAffected()
+		total += n
+	}
+	return total, nil
+}
+
+type sqliteTxn struct {
+	tx       *sql.Tx
+	readOnly bool
+	now      int64
+}
+
+// nullableTTL maps a 0 expiry to NULL
+func nullableTTL(expiresAt uint64) interface{} {
+	if expiresAt == 0 {
+		return nil
+	}
+	return int64(expiresAt)
+}
+
+func (t *sqliteTxn) Get(key []byte) (kvValue, error) {
+	var query string
+	if strings.HasPrefix(string(key), "!") {
+		query = `SELECT value, ttl FROM metadata WHERE key = ?1 AND (ttl IS NULL OR ttl > ?2)`
+	} else {
+		query = `SELECT record, ttl FROM links WHERE key = ?1 AND (ttl IS NULL OR ttl > ?2)
+			UNION ALL SELECT record, expires_at FROM reservations WHERE key = ?1 AND expires_at > ?2`
+	}
+	var val []byte
+	var ttl sql.NullInt64
+	err := t.tx.QueryRow(query, string(key), t.now).Scan(&val, &ttl)
+	if err == sql.ErrNoRows {
+		return kvValue{}, errKeyNotFound
+	} else if err != nil {
+		return kvValue{}, err
+	}
+	return kvValue{Value: val, ExpiresAt: uint64(ttl.Int64)}, nil
+}
+
+// Set writes bookkeeping to metadata, and records to links or
+// reservations depending on whether they are reserved
+func (t *sqliteTxn) Set(key, val []byte, expiresAt uint64) error {
+	if t.readOnly {
+		return errReadOnlyTxn
+	}
+	if strings.HasPrefix(string(key), "!") {
+		_, err := t.tx.Exec(
+			`INSERT OR REPLACE INTO metadata (key, value, ttl) VALUES (?, ?, ?)`,
+			string(key), val, nullableTTL(expiresAt),
+		)
+		return err
+	}
+	rec, err := DecodeLinkRecord(val)
+	if err != nil {
+		return err
+	}
+	if err := t.Delete(key); err != nil {
+		return err
+	}
+	if rec.Reserved() {
+		_, err = t.tx.Exec(
+			`INSERT INTO reservations (key, reserved_at, expires_at, record) VALUES (?, ?, ?, ?)`,
+			string(key), rec.CreatedAt, int64(expiresAt), val,
+		)
+		return err
+	}
+	var linkExpiry interface{}
+	if rec.ExpiresAt != 0 {
+		linkExpiry = rec.ExpiresAt
+	}
+	_, err = t.tx.Exec(
+		`INSERT INTO links (key, url, created_at, expires_at, creator, disabled, deleted, record, ttl)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		string(key), rec.URL, rec.CreatedAt, linkExpiry, rec.Creator,
+		rec.Disabled(), rec.Deleted(), val, nullableTTL(expiresAt),
+	)
+	return err
+}
+
+func (t *sqliteTxn) Delete(key []byte) error {
+	if t.readOnly {
+		return errReadOnlyTxn
+	}
+	for _, stmt := range []string{
+		"DELETE FROM links WHERE key = ?",
+		"DELETE FROM reservations WHERE key = ?",
+		"DELETE FROM metadata WHERE key = ?",
+	} {
+		if _, err := t.tx.Exec(stmt, string(key)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// run runs fn in a transaction on the single connection, so fn must not
+// start another one
+func (e *sqliteEngine) run(readOnly bool, fn func(txn kvTxn) error) error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	tx, err := e.db.Begin()
+	if err != nil {
+		return err
+	}
+	err = fn(&sqliteTxn{tx: tx, readOnly: readOnly, now: time.Now().Unix()})
+	if err != nil || readOnly {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (e *sqliteEngine) View(fn func(txn kvTxn) error) error {
+	return e.run(true, fn)
+}
+
+func (e *sqliteEngine) Update(fn func(txn kvTxn) error) error {
+	return e.run(false, fn)
+}
+
+// Iterate pages through the keys in order, so that fn may use the
+// engine without deadlocking on its single connection
+func (e *sqliteEngine) Iterate(prefix []byte, fn func(key []byte, val kvValue) error) error {
+	after := string(prefix)
+	first := true
+	for {
+		type row struct {
+			key string
+			val kvValue
+		}
+		rows := make([]row, 0, SQLITE_ITERATE_PAGE)
+		err := e.View(func(txn kvTxn) error {
+			res, err := txn.(*sqliteTxn).tx.Query(`
+				SELECT key, v, ttl FROM (
+					SELECT key, record AS v, ttl FROM links WHERE ttl IS NULL OR ttl > ?1
+					UNION ALL SELECT key, record, expires_at FROM reservations WHERE expires_at > ?1
+					UNION ALL SELECT key, value, ttl FROM metadata WHERE ttl IS NULL OR ttl > ?1
+				) WHERE (key > ?2 OR (?3 AND key = ?2)) ORDER BY key LIMIT ?4`,
+				time.Now().Unix(), after, first, SQLITE_ITERATE_PAGE,
+			)
+			if err != nil {
+				return err
+			}
+			defer res.Close()
+			for res.Next() {
+				var r row
+				var ttl sql.NullInt64
+				if err := res.Scan(&r.key, &r.val.Value, &ttl); err != nil {
+					return err
+				}
+				r.val.ExpiresAt = uint64(ttl.Int64)
+				rows = append(rows, r)
+			}
+			return res.Err()
+		})
+		if err != nil {
+			return err
+		}
+		for _, r := range rows {
+			if !strings.HasPrefix(r.key, string(prefix)) {
+				return nil
+			}
+			if err := fn([]byte(r.key), r.val); err != nil {
+				return err
+			}
+		}
+		if len(rows) < SQLITE_ITERATE_PAGE {
+			return nil
+		}
+		after, first = rows[len(rows)-1].key, false
+	}
+}
+
+// Sequence leases values from a counter kept in metadata. A lease is a
+// transaction of its own, so counters cannot advance inside another one
+func (e *sqliteEngine) Sequence(name []byte) (KeyCounter, error) {
+	return &leasedCounter{lease: func() (uint64, error) {
+		var start uint64
+		err := e.Update(func(txn kvTxn) error {
+			val, err := txn.Get(name)
+			if err == nil && len(val.Value) == 8 {
+				start = binary.BigEndian.Uint64(val.Value)
+			} else if err != nil && err != errKeyNotFound {
+				return err
+			}
+			var next [8]byte
+			binary.BigEndian.PutUint64(next[:], start+SEQUENCE_BANDWIDTH)
+			return txn.Set(name, next[:], 0)
+		})
+		return start, err
+	}}, nil
+}
+
+// fresh opens an empty database next to this one
+func (e *sqliteEngine) fresh() (kvEngine, error) {
+	path := e.path + RESTORE_SUFFIX
+	for _, suffix := range []string{"", "-wal", "-shm"} {
+		if err := os.RemoveAll(path + suffix); err != nil {
+			return nil, err
+		}
+	}
+	return openSQLiteEngine(path)
+}
+
+// replace relies on closing the last connection checkpointing the write
+// ahead log, so that the whole database is in its main file
+func (e *sqliteEngine) replace(next kvEngine) (kvEngine, error) {
+	return replaceEngine(e, next, e.path, next.(*sqliteEngine).path, func(path string) (kvEngine, error) {
+		db, err := openSQLiteEngine(path)
+		if err != nil {
+			return nil, err
+		}
+		return db, nil
+	})
+}
+
+func (e *sqliteEngine) Close() error {
+	return e.db.Close()
+}
@@ -0,0 +1,228 @@
+package shortener
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// a fresh engine is opened at its engine's path with this suffix, and
+// leftovers of an earlier attempt there are removed first
+const RESTORE_SUFFIX = ".restore"
+
+// replaceableEngine is an engine that can open an empty copy of itself
+// and be replaced by it
+type replaceableEngine interface {
+	kvEngine
+	// fresh opens an empty engine of the same kind next to this one
+	fresh() (kvEngine, error)
+	// replace closes the engine and next, which came from fresh, and
+	// reopens next in its place. It returns the engine left open, which
+	// is the old one again if next could not be moved in
+	replace(next kvEngine) (kvEngine, error)
+}
+
+// swapEngine forwards to an engine that can be replaced while in use, so
+// that a raft snapshot is restored into a fresh engine and swapped in at
+// once. Readers see either everything before the restore or everything
+// after it
+type swapEngine struct {
+	lock   sync.RWMutex
+	engine replaceableEngine
+
+	// counters of the current engine by name, as counters of a replaced
+	// engine are closed with it
+	seqLock sync.Mutex
+	seqs    map[string]KeyCounter
+
+	// the raft log index being applied, 0 if none. It is written with
+	// every update made while applying it
+	applying uint64
+
+	// seconds entries are kept in the engine past their expiry
+	grace uint64
+}
+
+func newSwapEngine(engine kvEngine, grace time.Duration) (*swapEngine, error) {
+	e, ok := engine.(replaceableEngine)
+	if !ok {
+		return nil, fmt.Errorf("engine %T cannot be replaced", engine)
+	}
+	return &swapEngine{engine: e, seqs: make(map[string]KeyCounter), grace: uint64(grace / time.Second)}, nil
+}
+
+func (s *swapEngine) View(fn func(txn kvTxn) error) error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.engine.View(func(txn kvTxn) error {
+		return fn(s.wrap(txn))
+	})
+}
+
+func (s *swapEngine) Update(fn func(txn kvTxn) error) error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	index := atomic.LoadUint64(&s.applying)
+	return s.engine.Update(func(txn kvTxn) error {
+		if err := fn(s.wrap(txn)); err != nil || index == 0 {
+			return err
+		}
+		return writeAppliedIndex(txn, index)
+	})
+}
+
+func (s *swapEngine) Iterate(prefix []byte, fn func(key []byte, val kvValue) error) error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.engine.Iterate(prefix, func(key []byte, val kvValue) error {
+		val.ExpiresAt = s.expiry(val.ExpiresAt)
+		return fn(key, val)
+	})
+}
+
+func (s *swapEngine) Sequence(name []byte) (KeyCounter, error) {
+	return &swapCounter{engine: s, name: string(name)}, nil
+}
+
+func (s *swapEngine) Reclaim(discardRatio float64) (int64, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.engine.Reclaim(discardRatio)
+}
+
+func (s *swapEngine) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.engine.Close()
+}
+
+// wrap adds the grace period to expiries written through txn and takes
+// it off expiries read from it
+func (s *swapEngine) wrap(txn kvTxn) kvTxn {
+	if s.grace == 0 {
+		return txn
+	}
+	return graceTxn{txn: txn, engine: s}
+}
+
+// expiry returns the expiry of an entry stored to expire at stored
+func (s *swapEngine) expiry(stored uint64) uint64 {
+	if stored == 0 {
+		return 0
+	}
+	return stored - s.grace
+}
+
+// graceTxn keeps entries past their expiry for a swapEngine's grace
+// period, which its callers never see
+type graceTxn struct {
+	txn    kvTxn
+	engine *swapEngine
+}
+
+func (t graceTxn) Get(key []byte) (kvValue, error) {
+	v, err := t.txn.Get(key)
+	v.ExpiresAt = t.engine.expiry(v.ExpiresAt)
+	return v, err
+}
+
+func (t graceTxn) Set(key, val []byte, expiresAt uint64) error {
+	if expiresAt != 0 {
+		expiresAt += t.engine.grace
+	}
+	return t.txn.Set(key, val, expiresAt)
+}
+
+func (t graceTxn) Delete(key []byte) error {
+	return t.txn.Delete(key)
+}
+
+// restore loads a fresh engine with load and swaps it in once load is
+// done. A failed load leaves the current engine as it was
+func (s *swapEngine) restore(load func(next kvEngine) error) error {
+	s.lock.RLock()
+	current := s.engine
+	s.lock.RUnlock()
+	next, err := current.fresh()
+	if err != nil {
+		return err
+	}
+	if err := load(next); err != nil {
+		next.Close()
+		return err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	replaced, err := current.replace(next)
+	if replaced != nil {
+		s.engine = replaced.(replaceableEngine)
+	}
+	s.seqLock.Lock()
+	s.seqs = make(map[string]KeyCounter)
+	s.seqLock.Unlock()
+	return err
+}
+
+// swapCounter advances the counter of whichever engine is current
+type swapCounter struct {
+	engine *swapEngine
+	name   string
+}
+
+func (c *swapCounter) Next() (uint64, error) {
+	c.engine.lock.RLock()
+	defer c.engine.lock.RUnlock()
+	c.engine.seqLock.Lock()
+	counter, ok := c.engine.seqs[c.name]
+	if !ok {
+		var err error
+		counter, err = c.engine.engine.Sequence([]byte(c.name))
+		if err != nil {
+			c.engine.seqLock.Unlock()
+			return 0, err
+		}
+		c.engine.seqs[c.name] = counter
+	}
+	c.engine.seqLock.Unlock()
+	return counter.Next()
+}
+
+// replaceFiles moves the engine at nextPath to path, in place of the one
+// there. Both must be closed. If next cannot be moved in, the old engine
+// is put back
+func replaceFiles(path, nextPath string) error {
+	old := path + ".old"
+	if err := os.RemoveAll(old); err != nil {
+		return err
+	}
+	if err := os.Rename(path, old); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Rename(nextPath, path); err != nil {
+		os.Rename(old, path)
+		return err
+	}
+	return os.RemoveAll(old)
+}
+
+// replaceEngine implements replace for engines kept at a path, which
+// open reopens
+func replaceEngine(
+	current, next kvEngine, path, nextPath string, open func(path string) (kvEngine, error),
+) (kvEngine, error) {
+	if err := next.Close(); err != nil {
+		return current, err
+	}
+	if err := current.Close(); err != nil {
+		return nil, err
+	}
+	moveErr := replaceFiles(path, nextPath)
+	reopened, err := open(path)
+	if moveErr != nil {
+		return reopened, moveErr
+	}
+	return reopened, err
+}
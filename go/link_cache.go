@@ -0,0 +1,229 @@
+package shortener
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+const (
+	DEFAULT_LRU_SIZE = 64 << 20 // bytes
+	// how long the local tier of a tiered cache may serve a key before
+	// asking memcached again, which bounds how stale it gets when another
+	// cache server invalidates the key
+	TIERED_LOCAL_TTL = 10 * time.Second
+	// memcached treats expirations over 30 days as unix timestamps
+	memcacheMaxRelative = 30 * 24 * time.Hour
+)
+
+var (
+	ErrCacheMiss = errors.New("cache miss")
+)
+
+// LinkCache caches query responses by key in front of the db servers
+type LinkCache interface {
+	// Get returns ErrCacheMiss if the key is not cached
+	Get(key string) ([]byte, error)
+	// Set caches value for ttl, or until evicted if ttl is 0
+	Set(key string, value []byte, ttl time.Duration) error
+	// Delete does not fail if the key is not cached
+	Delete(key string) error
+}
+
+type memcachedCache struct {
+	mc *memcache.Client
+}
+
+// NewMemcachedCache connects to the memcached instance at host, retrying
+// for a few seconds while it starts
+func NewMemcachedCache(host string) (LinkCache, error) {
+	mc := memcache.New(host)
+	var err error
+	for i := 0; i < 10; i++ {
+		err = mc.Ping()
+		if err == nil {
+			break
+		}
+		log.Printf("Unable to connect to cache server, retrying in 1s")
+		time.Sleep(1 * time.Second)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect to memcached server: %s", err)
+	}
+	return &memcachedCache{mc: mc}, nil
+}
+
+func (c *memcachedCache) Get(key string) ([]byte, error) {
+	it, err := c.mc.Get(key)
+	if err == memcache.ErrCacheMiss {
+		return nil, ErrCacheMiss
+	} else if err != nil {
+		return nil, err
+	}
+	return it.Value, nil
+}
+
+func (c *memcachedCache) Set(key string, value []byte, ttl time.Duration) error {
+	return c.mc.Set(&memcache.Item{
+		Key: key, Value: value, Expiration: memcacheExpiration(ttl, time.Now()),
+	})
+}
+
+func (c *memcachedCache) Delete(key string) error {
+	err := c.mc.Delete(key)
+	if err == memcache.ErrCacheMiss {
+		return nil
+	}
+	return err
+}
+
+// memcacheExpiration converts a ttl to a memcached expiration, which is
+// relative up to 30 days and a unix timestamp past that
+func memcacheExpiration(ttl time.Duration, now time.Time) int32 {
+	if ttl <= 0 {
+		return 0
+	}
+	if ttl <= memcacheMaxRelative {
+		// round up, as 0 would never expire
+		return int32((ttl + time.Second - 1) / time.Second)
+	}
+	expiresAt := now.Add(ttl).Unix()
+	if expiresAt > math.MaxInt32 {
+		return 0
+	}
+	return int32(expiresAt)
+}
+
+type lruEntry struct {
+	key   string
+	value []byte
+	// the zero time if the entry does not expire
+	expiresAt time.Time
+}
+
+// lruCache is an in process cache evicting the least recently used keys
+// once the values it holds add up to more than maxBytes
+type lruCache struct {
+	maxBytes int
+	bytes    int
+	order    *list.List
+	entries  map[string]*list.Element
+	lock     sync.Mutex
+}
+
+// NewLRUCache creates an in process cache holding up to maxBytes of keys
+// and values. Keys changed through another cache server are not evicted
+// from it, so on its own it only suits a single cache server
+func NewLRUCache(maxBytes int) LinkCache {
+	return &lruCache{
+		maxBytes: maxBytes,
+		order:    list.New(),
+		entries:  map[string]*list.Element{},
+	}
+}
+
+func (c *lruCache) Get(key string) ([]byte, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, ErrCacheMiss
+	}
+	entry := el.Value.(*lruEntry)
+	if !entry.expiresAt.IsZero() && !time.Now().Before(entry.expiresAt) {
+		c.remove(el)
+		return nil, ErrCacheMiss
+	}
+	c.order.MoveToFront(el)
+	return entry.value, nil
+}
+
+func (c *lruCache) Set(key string, value []byte, ttl time.Duration) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if el, ok := c.entries[key]; ok {
+		c.remove(el)
+	}
+	size := len(key) + len(value)
+	// a value that would evict everything else is not worth caching
+	if size > c.maxBytes {
+		return nil
+	}
+	entry := &lruEntry{key: key, value: value}
+	if ttl > 0 {
+		entry.expiresAt = time.Now().Add(ttl)
+	}
+	c.entries[key] = c.order.PushFront(entry)
+	c.bytes += size
+	for c.bytes > c.maxBytes {
+		c.remove(c.order.Back())
+	}
+	return nil
+}
+
+func (c *lruCache) Delete(key string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if el, ok := c.entries[key]; ok {
+		c.remove(el)
+	}
+	return nil
+}
+
+func (c *lruCache) remove(el *list.Element) {
+	entry := c.order.Remove(el).(*lruEntry)
+	delete(c.entries, entry.key)
+	c.bytes -= len(entry.key) + len(entry.value)
+}
+
+// tieredCache serves hot keys from a local cache, falling back to a
+// shared one. the local tier only holds keys for localTTL, so that keys
+// invalidated through other cache servers are not served for long
+type tieredCache struct {
+	local    LinkCache
+	shared   LinkCache
+	localTTL time.Duration
+}
+
+// NewTieredCache puts local in front of shared, keeping keys in local for
+// at most localTTL
+func NewTieredCache(local, shared LinkCache, localTTL time.Duration) LinkCache {
+	return &tieredCache{local: local, shared: shared, localTTL: localTTL}
+}
+
+func (c *tieredCache) Get(key string) ([]byte, error) {
+	value, err := c.local.Get(key)
+	if err == nil {
+		return value, nil
+	}
+	value, err = c.shared.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	c.local.Set(key, value, c.localTTL)
+	return value, nil
+}
+
+func (c *tieredCache) Set(key string, value []byte, ttl time.Duration) error {
+	if err := c.shared.Set(key, value, ttl); err != nil {
+		return err
+	}
+	localTTL := c.localTTL
+	if ttl > 0 && ttl < localTTL {
+		localTTL = ttl
+	}
+	return c.local.Set(key, value, localTTL)
+}
+
+func (c *tieredCache) Delete(key string) error {
+	if err := c.local.Delete(key); err != nil {
+		return err
+	}
+	return c.shared.Delete(key)
+}
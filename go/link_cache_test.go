@@ -0,0 +1,97 @@
+package shortener
+
+import (
+	"testing"
+	"time"
+)
+
+func checkCached(t *testing.T, cache LinkCache, key, expected string) {
+	t.Helper()
+	value, err := cache.Get(key)
+	if expected == "" {
+		if err != ErrCacheMiss {
+			t.Errorf("Expected %s to miss, got %q %v", key, value, err)
+		}
+		return
+	}
+	if err != nil || string(value) != expected {
+		t.Errorf("Expected %s to be %q, got %q %v", key, expected, value, err)
+	}
+}
+
+func TestLRUCache(t *testing.T) {
+	// room for three one byte keys with three byte values
+	cache := NewLRUCache(12)
+	cache.Set("a", []byte("aaa"), 0)
+	cache.Set("b", []byte("bbb"), 0)
+	cache.Set("c", []byte("ccc"), 0)
+	checkCached(t, cache, "a", "aaa")
+	// b is now the least recently used
+	cache.Set("d", []byte("ddd"), 0)
+	checkCached(t, cache, "b", "")
+	checkCached(t, cache, "a", "aaa")
+	checkCached(t, cache, "d", "ddd")
+
+	// replacing a key frees what it held
+	cache.Set("a", []byte("a"), 0)
+	cache.Set("e", []byte("e"), 0)
+	checkCached(t, cache, "c", "ccc")
+	checkCached(t, cache, "e", "e")
+
+	cache.Set("huge", make([]byte, 100), 0)
+	checkCached(t, cache, "huge", "")
+	checkCached(t, cache, "c", "ccc")
+
+	cache.Set("short", []byte("x"), 10*time.Millisecond)
+	checkCached(t, cache, "short", "x")
+	time.Sleep(20 * time.Millisecond)
+	checkCached(t, cache, "short", "")
+
+	cache.Delete("c")
+	cache.Delete("missing")
+	checkCached(t, cache, "c", "")
+}
+
+func TestTieredCache(t *testing.T) {
+	local, shared := NewLRUCache(1<<10), NewLRUCache(1<<10)
+	cache := NewTieredCache(local, shared, 20*time.Millisecond)
+	cache.Set("a", []byte("1"), 0)
+	checkCached(t, local, "a", "1")
+	checkCached(t, shared, "a", "1")
+
+	// another cache server changed the key, which the local tier serves
+	// until its ttl is up
+	shared.Set("a", []byte("2"), 0)
+	checkCached(t, cache, "a", "1")
+	time.Sleep(30 * time.Millisecond)
+	checkCached(t, cache, "a", "2")
+	checkCached(t, local, "a", "2")
+
+	// shared hits are copied into the local tier
+	shared.Set("b", []byte("3"), 0)
+	checkCached(t, cache, "b", "3")
+	checkCached(t, local, "b", "3")
+
+	cache.Delete("b")
+	checkCached(t, local, "b", "")
+	checkCached(t, shared, "b", "")
+}
+
+func TestMemcacheExpiration(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	cases := []struct {
+		ttl      time.Duration
+		expected int32
+	}{
+		{0, 0},
+		{1500 * time.Millisecond, 2},
+		{10 * time.Second, 10},
+		{60 * 24 * time.Hour, int32(now.Add(60 * 24 * time.Hour).Unix())},
+		{100 * 365 * 24 * time.Hour, 0},
+	}
+	for _, c := range cases {
+		if exp := memcacheExpiration(c.ttl, now); exp != c.expected {
+			t.Errorf("Expected %s to expire at %d, got %d", c.ttl, c.expected, exp)
+		}
+	}
+}
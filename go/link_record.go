@@ -0,0 +1,99 @@
+package shortener
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// the first byte of every encoded record is its format version. legacy
+// values are raw url strings (or empty for reserved keys), and no url
+// can start with a control character, so the two never get confused
+const (
+	LINK_RECORD_V1 byte = 0x01
+
+	LINK_RECORD_VERSION = LINK_RECORD_V1
+
+	// only the most recent destinations of a link are remembered
+	MAX_LINK_HISTORY = 32
+)
+
+const (
+	// key handed out to a cache server but not yet set
+	LINK_FLAG_RESERVED uint32 = 1 << iota
+	// link still exists but must not be followed
+	LINK_FLAG_DISABLED
+	// tombstone left by a deleted link, so that its key is never reused
+	LINK_FLAG_DELETED
+)
+
+// LinkRecord is the value stored for every key
+type LinkRecord struct {
+	URL string `json:"url,omitempty"`
+	// unix seconds, 0 if unknown (legacy records) or never
+	CreatedAt int64  `json:"createdAt,omitempty"`
+	ExpiresAt int64  `json:"expiresAt,omitempty"`
+	Creator   string `json:"creator,omitempty"`
+	Flags     uint32 `json:"flags,omitempty"`
+	// key of the hit counter for this link, empty if it is not counted
+	HitCounter string `json:"hitCounter,omitempty"`
+	// previous destinations, oldest first
+	History []LinkHistory `json:"history,omitempty"`
+}
+
+// LinkHistory is a destination a link pointed to before being updated
+type LinkHistory struct {
+	URL string `json:"url"`
+	// unix seconds
+	ReplacedAt int64 `json:"replacedAt"`
+}
+
+func (rec LinkRecord) Reserved() bool {
+	return rec.Flags&LINK_FLAG_RESERVED != 0
+}
+
+func (rec LinkRecord) Disabled() bool {
+	return rec.Flags&LINK_FLAG_DISABLED != 0
+}
+
+func (rec LinkRecord) Deleted() bool {
+	return rec.Flags&LINK_FLAG_DELETED != 0
+}
+
+// Expiry returns the expiry as a time, zero if the link never expires
+func (rec LinkRecord) Expiry() time.Time {
+	if rec.ExpiresAt == 0 {
+		return time.Time{}
+	}
+	return time.Unix(rec.ExpiresAt, 0)
+}
+
+func (rec LinkRecord) Expired(now time.Time) bool {
+	return rec.ExpiresAt != 0 && now.Unix() >= rec.ExpiresAt
+}
+
+// Encode encodes the record in the current format version
+func (rec LinkRecord) Encode() []byte {
+	// marshalling a struct of strings and ints cannot fail
+	raw, _ := json.Marshal(rec)
+	return append([]byte{LINK_RECORD_VERSION}, raw...)
+}
+
+// DecodeLinkRecord decodes a stored value of any format version,
+// including legacy raw url strings
+func DecodeLinkRecord(raw []byte) (LinkRecord, error) {
+	var rec LinkRecord
+	switch {
+	case len(raw) == 0:
+		rec.Flags = LINK_FLAG_RESERVED
+	case raw[0] == LINK_RECORD_V1:
+		if err := json.Unmarshal(raw[1:], &rec); err != nil {
+			return LinkRecord{}, fmt.Errorf("corrupt link record: %s", err.Error())
+		}
+	case raw[0] < ' ':
+		return LinkRecord{}, fmt.Errorf("unknown link record version: %d", raw[0])
+	default:
+		rec.URL = string(raw)
+	}
+	return rec, nil
+}
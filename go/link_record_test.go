@@ -0,0 +1,48 @@
+package shortener
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLinkRecordRoundTrip(t *testing.T) {
+	rec := LinkRecord{
+		URL:       "http://example.com",
+		CreatedAt: 1614556800,
+		ExpiresAt: 1617235200,
+		Creator:   "marketing",
+	}
+	raw := rec.Encode()
+	if raw[0] != LINK_RECORD_VERSION {
+		t.Errorf("Expected version byte %d, got: %d", LINK_RECORD_VERSION, raw[0])
+	}
+	got, err := DecodeLinkRecord(raw)
+	if err != nil {
+		t.Fatalf("Unable to decode record: %s", err.Error())
+	}
+	if !reflect.DeepEqual(got, rec) {
+		t.Errorf("Expected record %+v, got: %+v", rec, got)
+	}
+}
+
+func TestDecodeLegacyLinkRecord(t *testing.T) {
+	rec, err := DecodeLinkRecord([]byte("http://example.com"))
+	if err != nil {
+		t.Fatalf("Unable to decode legacy url: %s", err.Error())
+	}
+	if rec.URL != "http://example.com" || rec.Reserved() {
+		t.Errorf("Expected plain url record, got: %+v", rec)
+	}
+
+	rec, err = DecodeLinkRecord([]byte{})
+	if err != nil {
+		t.Fatalf("Unable to decode legacy reserved key: %s", err.Error())
+	}
+	if !rec.Reserved() {
+		t.Errorf("Expected empty value to decode as reserved, got: %+v", rec)
+	}
+
+	if _, err = DecodeLinkRecord([]byte{0x1f, '{', '}'}); err == nil {
+		t.Errorf("Expected error decoding unknown record version")
+	}
+}
@@ -0,0 +1,20 @@
+package shortener
+
+// LinkStore is the storage behind a MainServer
+type LinkStore interface {
+	Store(urlStr string, opts LinkOptions) (string, error)
+	StoreAlias(alias, urlStr string, opts LinkOptions) error
+	Query(key string) (LinkRecord, error)
+	Reserve(num int) ([]string, error)
+	SetReserve(key, urlStr string, opts LinkOptions) error
+	Release(keys []string) ([]string, error)
+	Update(key, urlStr string) error
+	Delete(key string) error
+	Disable(key string, disabled bool) error
+	Import(key string, rec LinkRecord) (bool, error)
+	Purge(key string) error
+	// Iterate calls fn with every key and its record, including reserved
+	// keys and tombstones, stopping at the first error fn returns
+	Iterate(fn func(key string, rec LinkRecord) error) error
+	Close() error
+}
@@ -0,0 +1,116 @@
+package shortener
+
+import (
+	"expvar"
+	"fmt"
+	"log"
+	"time"
+)
+
+const (
+	DEFAULT_MAINTENANCE_INTERVAL = 10 * time.Minute
+	// rewrite value log files once half of them is garbage, as recommended
+	// by badger for a lifetime write amplification of 2
+	DEFAULT_GC_DISCARD_RATIO = 0.5
+)
+
+// maintenance metrics, served from /debug/vars
+var (
+	maintenanceRuns           = expvar.NewInt("maintenance_runs")
+	maintenanceErrors         = expvar.NewInt("maintenance_errors")
+	maintenanceReclaimedBytes = expvar.NewInt("maintenance_reclaimed_bytes")
+)
+
+// MaintenanceOptions configures how a store reclaims the space held by
+// expired reservations, expired links and overwritten values
+type MaintenanceOptions struct {
+	// how often to reclaim space, 0 disables maintenance
+	Interval time.Duration
+	// how much of a badger value log file must be garbage before it is
+	// rewritten, between 0 and 1 exclusive
+	DiscardRatio float64
+}
+
+func DefaultMaintenanceOptions() MaintenanceOptions {
+	return MaintenanceOptions{
+		Interval:     DEFAULT_MAINTENANCE_INTERVAL,
+		DiscardRatio: DEFAULT_GC_DISCARD_RATIO,
+	}
+}
+
+// maintenanceLoop runs Reclaim on an engine until it is stopped
+type maintenanceLoop struct {
+	opts MaintenanceOptions
+	stop chan struct{}
+	done chan struct{}
+}
+
+func startMaintenance(db kvEngine, opts MaintenanceOptions) *maintenanceLoop {
+	m := &maintenanceLoop{opts: opts, stop: make(chan struct{}), done: make(chan struct{})}
+	go func() {
+		defer close(m.done)
+		ticker := time.NewTicker(opts.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-m.stop:
+				return
+			case <-ticker.C:
+				reclaim(db, opts.DiscardRatio)
+			}
+		}
+	}()
+	return m
+}
+
+// reclaim runs a single maintenance pass and records it
+func reclaim(db kvEngine, discardRatio float64) {
+	start := time.Now()
+	freed, err := db.Reclaim(discardRatio)
+	maintenanceRuns.Add(1)
+	if err != nil {
+		maintenanceErrors.Add(1)
+		log.Printf("Error reclaiming space: %s\n", err.Error())
+		return
+	}
+	if freed > 0 {
+		maintenanceReclaimedBytes.Add(freed)
+		log.Printf("Reclaimed %d bytes in %s\n", freed, time.Since(start))
+	}
+}
+
+// close stops the loop, waiting for a pass in progress to finish
+func (m *maintenanceLoop) close() {
+	close(m.stop)
+	<-m.done
+}
+
+// SetMaintenance replaces the store's maintenance schedule. Stores start
+// with DefaultMaintenanceOptions
+func (store *URLStore) SetMaintenance(opts MaintenanceOptions) error {
+	if opts.Interval < 0 {
+		return fmt.Errorf("invalid maintenance interval: %s", opts.Interval)
+	}
+	if opts.DiscardRatio <= 0 || opts.DiscardRatio >= 1 {
+		return fmt.Errorf("invalid discard ratio %f: must be between 0 and 1", opts.DiscardRatio)
+	}
+	store.maintLock.Lock()
+	defer store.maintLock.Unlock()
+	if store.maint != nil {
+		store.maint.close()
+		store.maint = nil
+	}
+	if opts.Interval > 0 {
+		store.maint = startMaintenance(store.db, opts)
+	}
+	return nil
+}
+
+func (store *URLStore) stopMaintenance() {
+	store.maintLock.Lock()
+	defer store.maintLock.Unlock()
+	if store.maint != nil {
+		store.maint.close()
+		store.maint = nil
+	}
+}
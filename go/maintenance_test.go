@@ -0,0 +1,74 @@
+package shortener
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestEngineReclaim(t *testing.T) {
+	testDB := "./test_db_reclaim"
+	t.Cleanup(func() {
+		os.RemoveAll(testDB)
+		os.Remove(testDB + ".bolt")
+		os.Remove(testDB + ".sqlite")
+	})
+	for name, open := range map[string]func() (kvEngine, error){
+		"badger": func() (kvEngine, error) { return openBadgerEngine(testDB) },
+		"bolt":   func() (kvEngine, error) { return openBoltEngine(testDB + ".bolt") },
+		"sqlite": func() (kvEngine, error) { return openSQLiteEngine(testDB + ".sqlite") },
+		"memory": func() (kvEngine, error) { return newMemoryEngine(), nil },
+	} {
+		db, err := open()
+		if err != nil {
+			t.Fatalf("%s: unable to open engine: %s", name, err.Error())
+		}
+		past := uint64(time.Now().Add(-time.Minute).Unix())
+		err = db.Update(func(txn kvTxn) error {
+			if err := txn.Set([]byte("live"), []byte("http://example.com"), 0); err != nil {
+				return err
+			}
+			return txn.Set([]byte("expired"), LinkRecord{Flags: LINK_FLAG_RESERVED}.Encode(), past)
+		})
+		if err != nil {
+			t.Fatalf("%s: unable to write: %s", name, err.Error())
+		}
+		freed, err := db.Reclaim(DEFAULT_GC_DISCARD_RATIO)
+		if err != nil {
+			t.Errorf("%s: unable to reclaim: %s", name, err.Error())
+		} else if (name == "bolt" || name == "memory") && freed <= 0 {
+			t.Errorf("%s: expected expired value to be freed, got: %d", name, freed)
+		}
+		keys := 0
+		db.Iterate(nil, func(key []byte, val kvValue) error {
+			keys++
+			return nil
+		})
+		if keys != 1 {
+			t.Errorf("%s: expected only the live key to be left, got: %d keys", name, keys)
+		}
+		db.Close()
+	}
+}
+
+func TestURLStoreMaintenance(t *testing.T) {
+	store, err := NewMemoryURLStore()
+	if err != nil {
+		t.Fatalf("Unable to create test store: %s", err.Error())
+	}
+	if err := store.SetMaintenance(MaintenanceOptions{Interval: time.Minute, DiscardRatio: 1}); err == nil {
+		t.Errorf("Expected an error for a discard ratio of 1")
+	}
+	runs := maintenanceRuns.Value()
+	err = store.SetMaintenance(MaintenanceOptions{Interval: time.Millisecond, DiscardRatio: 0.5})
+	if err != nil {
+		t.Fatalf("Unable to set maintenance: %s", err.Error())
+	}
+	waitFor(t, func() bool { return maintenanceRuns.Value() != runs })
+	if err := store.Close(); err != nil {
+		t.Errorf("Unable to close store: %s", err.Error())
+	}
+	if store.maint != nil {
+		t.Errorf("Expected maintenance to stop on close")
+	}
+}
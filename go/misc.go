@@ -52,6 +52,17 @@ func CheckAll(urls []string) error {
 	return nil
 }
 
+// SplitList splits a comma separated flag value, dropping empty entries
+func SplitList(s string) []string {
+	ret := []string{}
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			ret = append(ret, item)
+		}
+	}
+	return ret
+}
+
 func SingleJoiningSlash(a, b string) string {
 	aslash := strings.HasSuffix(a, "/")
 	bslash := strings.HasPrefix(b, "/")
@@ -0,0 +1,252 @@
+package shortener
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"log"
+	"net/url"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	OUTBOX_MIN_BACKOFF = 1 * time.Second
+	OUTBOX_MAX_BACKOFF = 5 * time.Minute
+	// how many entries are sent to db servers at once
+	OUTBOX_CONCURRENCY = 8
+)
+
+var boltOutboxBucket = []byte("outbox")
+
+// outbox metrics, served from /debug/vars
+var (
+	outboxDepth   = expvar.NewInt("outbox_depth")
+	outboxRetries = expvar.NewInt("outbox_retries")
+	outboxDropped = expvar.NewInt("outbox_dropped")
+)
+
+// errOutboxRejected marks a write the db server answered and refused,
+// which no retry will change
+var errOutboxRejected = errors.New("rejected by db server")
+
+// outboxEntry is a setReserve waiting to reach the db server that
+// reserved its key
+type outboxEntry struct {
+	Host string `json:"host"`
+	// the form sent to SETRESERVE_ENDPOINT
+	Args     string `json:"args"`
+	Attempts int    `json:"attempts"`
+	// unix nanoseconds
+	NextAttempt int64 `json:"nextAttempt"`
+}
+
+// outbox persists setReserve calls in a bbolt file until the db server
+// accepted them, so that links handed out by a cache server are not lost
+// while the db server is unreachable, nor when the cache server restarts
+type outbox struct {
+	db *bolt.DB
+	// send returns errOutboxRejected if the db server refused the entry
+	send       func(entry outboxEntry) error
+	minBackoff time.Duration
+	maxBackoff time.Duration
+
+	wake chan struct{}
+	stop chan struct{}
+	done chan struct{}
+}
+
+func openOutbox(path string, send func(entry outboxEntry) error) (*outbox, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 10 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	depth := 0
+	err = db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(boltOutboxBucket)
+		if err != nil {
+			return err
+		}
+		depth = b.Stats().KeyN
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	outboxDepth.Add(int64(depth))
+	o := &outbox{
+		db: db, send: send,
+		minBackoff: OUTBOX_MIN_BACKOFF, maxBackoff: OUTBOX_MAX_BACKOFF,
+		wake: make(chan struct{}, 1), stop: make(chan struct{}), done: make(chan struct{}),
+	}
+	go o.run()
+	return o, nil
+}
+
+// push durably queues a setReserve for the db server at host
+func (o *outbox) push(host string, args url.Values) error {
+	raw, err := json.Marshal(outboxEntry{Host: host, Args: args.Encode(), NextAttempt: time.Now().UnixNano()})
+	if err != nil {
+		return err
+	}
+	err = o.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltOutboxBucket)
+		id, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		return b.Put(outboxID(id), raw)
+	})
+	if err != nil {
+		return err
+	}
+	outboxDepth.Add(1)
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func outboxID(id uint64) []byte {
+	var ret [8]byte
+	binary.BigEndian.PutUint64(ret[:], id)
+	return ret[:]
+}
+
+func (o *outbox) run() {
+	defer close(o.done)
+	for {
+		next, err := o.flush()
+		if err != nil {
+			log.Printf("Error flushing outbox: %s\n", err.Error())
+			next = time.Now().Add(o.minBackoff)
+		}
+		var timer <-chan time.Time
+		if !next.IsZero() {
+			timer = time.After(time.Until(next))
+		}
+		select {
+		case <-o.stop:
+			return
+		case <-o.wake:
+		case <-timer:
+		}
+	}
+}
+
+// flush sends every entry that is due, and returns when the next one will
+// be, or the zero time if the outbox is empty
+func (o *outbox) flush() (time.Time, error) {
+	type due struct {
+		id    []byte
+		entry outboxEntry
+	}
+	var next time.Time
+	now := time.Now().UnixNano()
+	pending := []due{}
+	err := o.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltOutboxBucket).ForEach(func(k, v []byte) error {
+			var entry outboxEntry
+			if err := json.Unmarshal(v, &entry); err != nil {
+				return err
+			}
+			if entry.NextAttempt <= now {
+				pending = append(pending, due{append([]byte{}, k...), entry})
+			} else if next.IsZero() || entry.NextAttempt < next.UnixNano() {
+				next = time.Unix(0, entry.NextAttempt)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, OUTBOX_CONCURRENCY)
+	for _, d := range pending {
+		d := d
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			err := o.send(d.entry)
+			retry := err != nil && !errors.Is(err, errOutboxRejected)
+			if err != nil {
+				log.Printf("Error pushing shorten to %s: %s\n", d.entry.Host, err.Error())
+			}
+			if errors.Is(err, errOutboxRejected) {
+				outboxDropped.Add(1)
+			}
+			if retry {
+				d.entry.Attempts++
+				d.entry.NextAttempt = time.Now().Add(o.backoff(d.entry.Attempts)).UnixNano()
+			}
+			if err := o.settle(d.id, d.entry, retry); err != nil {
+				log.Printf("Error updating outbox: %s\n", err.Error())
+				return
+			}
+			lock.Lock()
+			defer lock.Unlock()
+			if retry && (next.IsZero() || d.entry.NextAttempt < next.UnixNano()) {
+				next = time.Unix(0, d.entry.NextAttempt)
+			}
+		}()
+	}
+	wg.Wait()
+	return next, nil
+}
+
+// settle reschedules an entry to be retried, or removes it otherwise
+func (o *outbox) settle(id []byte, entry outboxEntry, retry bool) error {
+	if retry {
+		outboxRetries.Add(1)
+		raw, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		return o.db.Update(func(tx *bolt.Tx) error {
+			return tx.Bucket(boltOutboxBucket).Put(id, raw)
+		})
+	}
+	err := o.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltOutboxBucket).Delete(id)
+	})
+	if err == nil {
+		outboxDepth.Add(-1)
+	}
+	return err
+}
+
+// backoff doubles with every failed attempt, up to maxBackoff
+func (o *outbox) backoff(attempts int) time.Duration {
+	backoff := o.minBackoff
+	for i := 1; i < attempts && backoff < o.maxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > o.maxBackoff {
+		return o.maxBackoff
+	}
+	return backoff
+}
+
+// close stops sending. entries still queued are sent once the outbox is
+// opened again
+func (o *outbox) close() error {
+	close(o.stop)
+	<-o.done
+	depth := 0
+	o.db.View(func(tx *bolt.Tx) error {
+		depth = tx.Bucket(boltOutboxBucket).Stats().KeyN
+		return nil
+	})
+	outboxDepth.Add(-int64(depth))
+	return o.db.Close()
+}
@@ -0,0 +1,105 @@
+package shortener
+
+import (
+	"errors"
+	"net/url"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeDBServer records the setReserves an outbox sends, failing while down
+type fakeDBServer struct {
+	lock     sync.Mutex
+	down     bool
+	attempts map[string]int
+	accepted map[string]string
+}
+
+func newFakeDBServer() *fakeDBServer {
+	return &fakeDBServer{attempts: map[string]int{}, accepted: map[string]string{}}
+}
+
+func (f *fakeDBServer) send(entry outboxEntry) error {
+	args, _ := url.ParseQuery(entry.Args)
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	key := args.Get("key")
+	f.attempts[key]++
+	if key == "rejected" {
+		return errOutboxRejected
+	}
+	if f.down {
+		return errors.New("connection refused")
+	}
+	f.accepted[key] = args.Get("url")
+	return nil
+}
+
+func (f *fakeDBServer) setDown(down bool) {
+	f.lock.Lock()
+	f.down = down
+	f.lock.Unlock()
+}
+
+func (f *fakeDBServer) get(key string) (string, int) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.accepted[key], f.attempts[key]
+}
+
+func TestOutbox(t *testing.T) {
+	path := "./test_outbox.db"
+	t.Cleanup(func() { os.Remove(path) })
+	db := newFakeDBServer()
+	db.setDown(true)
+	o, err := openOutbox(path, db.send)
+	if err != nil {
+		t.Fatalf("Unable to open outbox: %s", err.Error())
+	}
+	o.minBackoff, o.maxBackoff = 10*time.Millisecond, 40*time.Millisecond
+	depth := outboxDepth.Value()
+	for _, key := range []string{"a", "b", "rejected"} {
+		if err := o.push("db:8082", setReserveArgs(key, "http://example.com/"+key, LinkOptions{})); err != nil {
+			t.Fatalf("Unable to push: %s", err.Error())
+		}
+	}
+	// rejected entries are dropped, the others retried while the db is down
+	waitFor(t, func() bool {
+		_, attempts := db.get("a")
+		return attempts >= 3 && outboxDepth.Value() == depth+2
+	})
+	if _, attempts := db.get("rejected"); attempts != 1 {
+		t.Errorf("Expected a rejected entry to be sent once, got %d attempts", attempts)
+	}
+	if err := o.close(); err != nil {
+		t.Fatalf("Unable to close outbox: %s", err.Error())
+	}
+	if outboxDepth.Value() != depth {
+		t.Errorf("Expected closing to take the outbox off the depth, got %d", outboxDepth.Value()-depth)
+	}
+
+	// queued entries survive a restart
+	db.setDown(false)
+	o, err = openOutbox(path, db.send)
+	if err != nil {
+		t.Fatalf("Unable to reopen outbox: %s", err.Error())
+	}
+	defer o.close()
+	waitFor(t, func() bool { return outboxDepth.Value() == depth })
+	for _, key := range []string{"a", "b"} {
+		if urlStr, _ := db.get(key); urlStr != "http://example.com/"+key {
+			t.Errorf("Expected %s to be delivered after the restart, got %q", key, urlStr)
+		}
+	}
+}
+
+func TestOutboxBackoff(t *testing.T) {
+	o := &outbox{minBackoff: time.Second, maxBackoff: 5 * time.Second}
+	for attempts, expected := range []time.Duration{time.Second, time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second} {
+		if backoff := o.backoff(attempts); backoff != expected {
+			t.Errorf("Expected a backoff of %s after %d attempts, got %s", expected, attempts, backoff)
+		}
+	}
+}
@@ -0,0 +1,630 @@
+package shortener
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb/v2"
+)
+
+const (
+	RAFT_APPLY_TIMEOUT = 10 * time.Second
+	// how long a read waits for the node to apply a client's minIndex
+	RAFT_READ_TIMEOUT    = 5 * time.Second
+	RAFT_SNAPSHOT_RETAIN = 2
+	RAFT_MAX_POOL        = 3
+	// entries written per transaction when restoring a snapshot
+	RAFT_RESTORE_BATCH = 1000
+	// how long raft nodes keep entries past their expiry. Writes are
+	// checked against the time the leader proposed them at, so a node
+	// applying them late still finds what the leader found, for as long
+	// as it is no further behind than this
+	RAFT_EXPIRY_GRACE = 7 * 24 * time.Hour
+
+	// set on writes a follower forwarded, so that they are never forwarded
+	// twice while leadership changes
+	RAFT_FORWARDED_HEADER = "X-Raft-Forwarded"
+)
+
+var (
+	ErrNotLeader = errors.New("not the raft leader")
+	ErrStaleRead = errors.New("timed out waiting for replication")
+)
+
+// raftAppliedKey holds the index of the last raft log entry whose writes
+// are in the engine
+var raftAppliedKey = []byte(META_PREFIX + "raft/applied")
+
+// ReplicatedLinkStore is a LinkStore whose writes go through a replicated
+// log. Writes fail with ErrNotLeader anywhere but on the leader, and
+// reads are served by every node from its own copy
+type ReplicatedLinkStore interface {
+	LinkStore
+	IsLeader() bool
+	// Leader returns the http address of the leader, empty if unknown
+	Leader() string
+	// AppliedIndex returns the index of the last write the node applied.
+	// After a write it is at least the index of the write
+	AppliedIndex() uint64
+	// WaitForIndex waits until the node has applied index, failing with
+	// ErrStaleRead after timeout
+	WaitForIndex(index uint64, timeout time.Duration) error
+}
+
+// RaftPeer is a node of a raft cluster
+type RaftPeer struct {
+	// the address the node's MainServer listens on, which is also its raft
+	// server ID so that followers know where to forward writes
+	HTTPAddr string
+	RaftAddr string
+}
+
+// ParseRaftPeers parses a comma separated list of httpAddr=raftAddr pairs
+func ParseRaftPeers(s string) ([]RaftPeer, error) {
+	peers := []RaftPeer{}
+	for _, item := range SplitList(s) {
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid raft peer, expected httpAddr=raftAddr: %s", item)
+		}
+		peers = append(peers, RaftPeer{HTTPAddr: parts[0], RaftAddr: parts[1]})
+	}
+	return peers, nil
+}
+
+func raftConfiguration(peers []RaftPeer) raft.Configuration {
+	conf := raft.Configuration{}
+	for _, p := range peers {
+		conf.Servers = append(conf.Servers, raft.Server{
+			ID: raft.ServerID(p.HTTPAddr), Address: raft.ServerAddress(p.RaftAddr),
+		})
+	}
+	return conf
+}
+
+// raft log operations
+const (
+	raftOpStore      = "store"
+	raftOpAlias      = "alias"
+	raftOpReserve    = "reserve"
+	raftOpSetReserve = "setReserve"
+	raftOpUpdate     = "update"
+	raftOpDelete     = "delete"
+	raftOpDisable    = "disable"
+	raftOpImport     = "import"
+	raftOpPurge      = "purge"
+	raftOpRelease    = "release"
+)
+
+// raftCommand is a write in the raft log. Everything that is not
+// deterministic, keys and times, is decided by the leader before the
+// write is proposed, so that every node applies it the same way. Expiry
+// is checked against Time as well, not against the applying node's clock
+type raftCommand struct {
+	Op       string     `json:"op"`
+	Key      string     `json:"key,omitempty"`
+	Keys     []string   `json:"keys,omitempty"`
+	Record   LinkRecord `json:"record"`
+	URL      string     `json:"url,omitempty"`
+	Dedupe   bool       `json:"dedupe,omitempty"`
+	Disabled bool       `json:"disabled,omitempty"`
+	// unix seconds, set by apply on every command
+	Time int64 `json:"time,omitempty"`
+	// the length picked keys had, so that every node grows keys with the
+	// leader
+	KeyLen int `json:"keyLen,omitempty"`
+}
+
+// raftResult is what applying a raftCommand returned
+type raftResult struct {
+	key      string
+	keys     []string
+	imported bool
+	err      error
+}
+
+// linkFSM applies the raft log to a URLStore
+type linkFSM struct {
+	store *URLStore
+	// the store's engine, which restores replace
+	engine *swapEngine
+	// the index of the last entry applied. the engine outlives the raft
+	// log, which a restarted node replays from its last snapshot, so
+	// entries up to it are already in the engine and are skipped
+	applied uint64
+}
+
+func newLinkFSM(store *URLStore) (*linkFSM, error) {
+	engine, err := store.swappable()
+	if err != nil {
+		return nil, err
+	}
+	applied, err := readAppliedIndex(engine)
+	if err != nil {
+		return nil, err
+	}
+	return &linkFSM{store: store, engine: engine, applied: applied}, nil
+}
+
+// readAppliedIndex reads the index of the last raft log entry written to
+// db, 0 if there is none
+func readAppliedIndex(db kvEngine) (uint64, error) {
+	var index uint64
+	err := db.View(func(txn kvTxn) error {
+		val, err := txn.Get(raftAppliedKey)
+		if err == errKeyNotFound {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if len(val.Value) != 8 {
+			return errors.New("corrupt raft applied index")
+		}
+		index = binary.BigEndian.Uint64(val.Value)
+		return nil
+	})
+	return index, err
+}
+
+func writeAppliedIndex(txn kvTxn, index uint64) error {
+	var raw [8]byte
+	binary.BigEndian.PutUint64(raw[:], index)
+	return txn.Set(raftAppliedKey, raw[:], 0)
+}
+
+// Apply applies an entry, writing its index in the same transactions as
+// its writes. Entries that fail write nothing, and fail the same way when
+// they are replayed
+func (f *linkFSM) Apply(l *raft.Log) interface{} {
+	if l.Index <= f.applied {
+		return raftResult{}
+	}
+	f.applied = l.Index
+	atomic.StoreUint64(&f.engine.applying, l.Index)
+	defer atomic.StoreUint64(&f.engine.applying, 0)
+
+	var cmd raftCommand
+	if err := json.Unmarshal(l.Data, &cmd); err != nil {
+		return raftResult{err: fmt.Errorf("corrupt raft command: %s", err.Error())}
+	}
+	now := time.Unix(cmd.Time, 0)
+	res := raftResult{key: cmd.Key}
+	switch cmd.Op {
+	case raftOpStore:
+		res.key, res.err = f.store.storeKey(cmd.Key, cmd.KeyLen, cmd.Record, cmd.Dedupe, now)
+	case raftOpAlias:
+		res.err = f.store.storeAlias(cmd.Key, cmd.Record, now)
+	case raftOpReserve:
+		res.err = f.store.reserveKeys(cmd.Keys, cmd.KeyLen, now)
+	case raftOpSetReserve:
+		res.err = f.store.setReserved(cmd.Key, cmd.Record, now)
+	case raftOpUpdate:
+		res.err = f.store.updateLink(cmd.Key, cmd.URL, now)
+	case raftOpDelete:
+		res.err = f.store.deleteLink(cmd.Key, now)
+	case raftOpDisable:
+		res.err = f.store.disableLink(cmd.Key, cmd.Disabled, now)
+	case raftOpImport:
+		res.imported, res.err = f.store.importLink(cmd.Key, cmd.Record, now)
+	case raftOpPurge:
+		res.err = f.store.purge(cmd.Key, now)
+	case raftOpRelease:
+		res.keys, res.err = f.store.release(cmd.Keys, now)
+	default:
+		res.err = fmt.Errorf("unknown raft command: %s", cmd.Op)
+	}
+	return res
+}
+
+// kvEntry is a raw engine entry in a snapshot
+type kvEntry struct {
+	Key       []byte
+	Value     []byte
+	ExpiresAt uint64
+}
+
+// Snapshot writes every entry still in the engine to a temporary file. raft persists
+// snapshots while it keeps applying writes, so they have to be copied, and
+// a file keeps large stores out of memory
+func (f *linkFSM) Snapshot() (raft.FSMSnapshot, error) {
+	file, err := ioutil.TempFile("", "link-snapshot-")
+	if err != nil {
+		return nil, err
+	}
+	snap := &linkSnapshot{file: file}
+	buf := bufio.NewWriter(file)
+	enc := gob.NewEncoder(buf)
+	err = f.store.db.Iterate(nil, func(key []byte, val kvValue) error {
+		return enc.Encode(kvEntry{Key: key, Value: val.Value, ExpiresAt: val.ExpiresAt})
+	})
+	if err == nil {
+		err = buf.Flush()
+	}
+	if err != nil {
+		snap.Release()
+		return nil, err
+	}
+	return snap, nil
+}
+
+// Restore loads a snapshot into a fresh engine, which replaces the
+// store's once it holds every entry. Until then the store keeps serving
+// what it had, and a restore that fails or crashes leaves it untouched.
+// Snapshots hold entries past their expiry, and the grace period is
+// added back as they are written
+func (f *linkFSM) Restore(rc io.ReadCloser) error {
+	defer rc.Close()
+	dec := gob.NewDecoder(bufio.NewReader(rc))
+	err := f.engine.restore(func(next kvEngine) error {
+		for done := false; !done; {
+			err := next.Update(func(txn kvTxn) error {
+				txn = f.engine.wrap(txn)
+				for i := 0; i < RAFT_RESTORE_BATCH; i++ {
+					var e kvEntry
+					if err := dec.Decode(&e); err == io.EOF {
+						done = true
+						return nil
+					} else if err != nil {
+						return err
+					}
+					if err := txn.Set(e.Key, e.Value, e.ExpiresAt); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if f.applied, err = readAppliedIndex(f.engine); err != nil {
+		return err
+	}
+	keyLen, err := f.store.readKeyLen()
+	if err != nil {
+		return err
+	}
+	f.store.alloc.raise(keyLen)
+	return nil
+}
+
+// linkSnapshot is a snapshot spilled to a temporary file
+type linkSnapshot struct {
+	file *os.File
+}
+
+func (s *linkSnapshot) Persist(sink raft.SnapshotSink) error {
+	if _, err := s.file.Seek(0, io.SeekStart); err != nil {
+		sink.Cancel()
+		return err
+	}
+	if _, err := io.Copy(sink, s.file); err != nil {
+		sink.Cancel()
+		return err
+	}
+	return sink.Close()
+}
+
+func (s *linkSnapshot) Release() {
+	s.file.Close()
+	os.Remove(s.file.Name())
+}
+
+// swappable wraps the store's engine in a swapEngine, moving maintenance
+// over to it. The store must not be in use yet
+func (store *URLStore) swappable() (*swapEngine, error) {
+	store.maintLock.Lock()
+	defer store.maintLock.Unlock()
+	engine, err := newSwapEngine(store.db, RAFT_EXPIRY_GRACE)
+	if err != nil {
+		return nil, err
+	}
+	store.db = engine
+	if store.maint != nil {
+		store.maint.close()
+		store.maint = startMaintenance(engine, store.maint.opts)
+	}
+	return engine, nil
+}
+
+// RaftStore replicates a URLStore over a raft cluster
+type RaftStore struct {
+	store   *URLStore
+	raft    *raft.Raft
+	closers []io.Closer
+}
+
+// NewRaftStore starts a raft node around store, which the RaftStore takes
+// ownership of. conf may be nil for raft's defaults, and its LocalID is
+// set to id. With bootstrap, a new cluster is formed from peers, which
+// must include this node, unless the node already has raft state
+func NewRaftStore(
+	store *URLStore, id string, conf *raft.Config, transport raft.Transport,
+	logs raft.LogStore, stable raft.StableStore, snaps raft.SnapshotStore,
+	bootstrap bool, peers []RaftPeer,
+) (*RaftStore, error) {
+	if conf == nil {
+		conf = raft.DefaultConfig()
+	}
+	conf.LocalID = raft.ServerID(id)
+	fsm, err := newLinkFSM(store)
+	if err != nil {
+		return nil, err
+	}
+	r, err := raft.NewRaft(conf, fsm, logs, stable, snaps, transport)
+	if err != nil {
+		return nil, err
+	}
+	if bootstrap {
+		err := r.BootstrapCluster(raftConfiguration(peers)).Error()
+		if err != nil && err != raft.ErrCantBootstrap {
+			r.Shutdown()
+			return nil, err
+		}
+	}
+	return &RaftStore{store: store, raft: r}, nil
+}
+
+// OpenRaftStore starts a raft node that talks to its peers over TCP on
+// bindAddr, and keeps its log and snapshots in dir
+func OpenRaftStore(store *URLStore, httpAddr, bindAddr, dir string, bootstrap bool, peers []RaftPeer) (*RaftStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	addr, err := net.ResolveTCPAddr("tcp", bindAddr)
+	if err != nil {
+		return nil, err
+	}
+	transport, err := raft.NewTCPTransport(bindAddr, addr, RAFT_MAX_POOL, RAFT_APPLY_TIMEOUT, os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+	logs, err := raftboltdb.NewBoltStore(filepath.Join(dir, "raft.db"))
+	if err != nil {
+		transport.Close()
+		return nil, err
+	}
+	snaps, err := raft.NewFileSnapshotStore(dir, RAFT_SNAPSHOT_RETAIN, os.Stderr)
+	if err != nil {
+		transport.Close()
+		logs.Close()
+		return nil, err
+	}
+	rs, err := NewRaftStore(store, httpAddr, nil, transport, logs, logs, snaps, bootstrap, peers)
+	if err != nil {
+		transport.Close()
+		logs.Close()
+		return nil, err
+	}
+	rs.closers = []io.Closer{transport, logs}
+	return rs, nil
+}
+
+// apply proposes cmd to the cluster and waits for it to be applied
+func (rs *RaftStore) apply(cmd raftCommand) raftResult {
+	if cmd.Time == 0 {
+		cmd.Time = time.Now().Unix()
+	}
+	raw, err := json.Marshal(cmd)
+	if err != nil {
+		return raftResult{err: err}
+	}
+	f := rs.raft.Apply(raw, RAFT_APPLY_TIMEOUT)
+	if err := f.Error(); err == raft.ErrNotLeader || err == raft.ErrLeadershipLost {
+		return raftResult{err: fmt.Errorf("%w: %s", ErrNotLeader, err.Error())}
+	} else if err != nil {
+		return raftResult{err: err}
+	}
+	return f.Response().(raftResult)
+}
+
+// applyPicked proposes a command for keys picked by the leader, picking
+// new ones for as long as they were taken by the time it was applied
+func (rs *RaftStore) applyPicked(num int, cmd func(keys []string) raftCommand) raftResult {
+	var res raftResult
+	for i := 0; i < MAX_KEY_RETRIES; i++ {
+		if !rs.IsLeader() {
+			return raftResult{err: ErrNotLeader}
+		}
+		keys, keyLen, err := rs.store.pickKeys(num)
+		if err != nil {
+			return raftResult{err: err}
+		}
+		picked := cmd(keys)
+		picked.KeyLen = keyLen
+		res = rs.apply(picked)
+		if !errors.Is(res.err, errKeyTaken) {
+			return res
+		}
+	}
+	return res
+}
+
+func (rs *RaftStore) Store(urlStr string, opts LinkOptions) (string, error) {
+	if !ValidUrl(urlStr) {
+		return "", fmt.Errorf("%w: %s", ErrInvalidURL, urlStr)
+	}
+	rec := opts.record(urlStr)
+	res := rs.applyPicked(1, func(keys []string) raftCommand {
+		return raftCommand{Op: raftOpStore, Key: keys[0], Record: rec, Dedupe: opts.Dedupe}
+	})
+	return res.key, res.err
+}
+
+func (rs *RaftStore) StoreAlias(alias, urlStr string, opts LinkOptions) error {
+	if err := rs.store.checkAlias(alias, urlStr); err != nil {
+		return err
+	}
+	return rs.apply(raftCommand{Op: raftOpAlias, Key: alias, Record: opts.record(urlStr)}).err
+}
+
+func (rs *RaftStore) Query(key string) (LinkRecord, error) {
+	return rs.store.Query(key)
+}
+
+func (rs *RaftStore) Reserve(num int) ([]string, error) {
+	if num <= 0 || num > MAX_RESERVE_NUM {
+		return []string{}, fmt.Errorf("invalid num %d", num)
+	}
+	var reserved []string
+	now := time.Now().Unix()
+	res := rs.applyPicked(num, func(keys []string) raftCommand {
+		reserved = keys
+		return raftCommand{Op: raftOpReserve, Keys: keys, Time: now}
+	})
+	if res.err != nil {
+		return []string{}, res.err
+	}
+	return reserved, nil
+}
+
+func (rs *RaftStore) SetReserve(key, urlStr string, opts LinkOptions) error {
+	if !ValidKey(key) {
+		return fmt.Errorf("invalid key: %s", key)
+	}
+	if !ValidUrl(urlStr) {
+		return fmt.Errorf("%w: %s", ErrInvalidURL, urlStr)
+	}
+	return rs.apply(raftCommand{Op: raftOpSetReserve, Key: key, Record: opts.record(urlStr)}).err
+}
+
+func (rs *RaftStore) Release(keys []string) ([]string, error) {
+	res := rs.apply(raftCommand{Op: raftOpRelease, Keys: keys})
+	if res.err != nil {
+		return []string{}, res.err
+	}
+	return res.keys, nil
+}
+
+func (rs *RaftStore) Update(key, urlStr string) error {
+	if !ValidUrl(urlStr) {
+		return fmt.Errorf("%w: %s", ErrInvalidURL, urlStr)
+	}
+	return rs.apply(raftCommand{Op: raftOpUpdate, Key: key, URL: urlStr}).err
+}
+
+func (rs *RaftStore) Delete(key string) error {
+	return rs.apply(raftCommand{Op: raftOpDelete, Key: key}).err
+}
+
+func (rs *RaftStore) Disable(key string, disabled bool) error {
+	return rs.apply(raftCommand{Op: raftOpDisable, Key: key, Disabled: disabled}).err
+}
+
+func (rs *RaftStore) Import(key string, rec LinkRecord) (bool, error) {
+	res := rs.apply(raftCommand{Op: raftOpImport, Key: key, Record: rec})
+	return res.imported, res.err
+}
+
+func (rs *RaftStore) Purge(key string) error {
+	return rs.apply(raftCommand{Op: raftOpPurge, Key: key}).err
+}
+
+func (rs *RaftStore) Iterate(fn func(key string, rec LinkRecord) error) error {
+	return rs.store.Iterate(fn)
+}
+
+// Backup backs up this node's copy of the store. Restoring a snapshot
+// starts a new database, so the backup after one has to be a full one
+func (rs *RaftStore) Backup(w io.Writer, since uint64) (uint64, error) {
+	return rs.store.Backup(w, since)
+}
+
+func (rs *RaftStore) IsLeader() bool {
+	return rs.raft.State() == raft.Leader
+}
+
+func (rs *RaftStore) Leader() string {
+	_, id := rs.raft.LeaderWithID()
+	return string(id)
+}
+
+func (rs *RaftStore) AppliedIndex() uint64 {
+	return rs.raft.AppliedIndex()
+}
+
+func (rs *RaftStore) WaitForIndex(index uint64, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for rs.raft.AppliedIndex() < index {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%w: index %d not applied after %s", ErrStaleRead, index, timeout)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	return nil
+}
+
+// Close leaves the cluster running without this node
+func (rs *RaftStore) Close() error {
+	err := rs.raft.Shutdown().Error()
+	for _, c := range rs.closers {
+		if cerr := c.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if cerr := rs.store.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// leaderOnly forwards writes to the leader when the server is a follower
+// of a raft cluster
+func (ms *MainServer) leaderOnly(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rs, ok := ms.store.(ReplicatedLinkStore)
+		if !ok || rs.IsLeader() {
+			h(w, r)
+			return
+		}
+		leader := rs.Leader()
+		if leader == "" || r.Header.Get(RAFT_FORWARDED_HEADER) != "" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("503 - Service Unavailable"))
+			return
+		}
+		proxy, err := SimplePostForwarder("http://" + leader)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		r.Header.Set(RAFT_FORWARDED_HEADER, "true")
+		proxy.ServeHTTP(w, r)
+	}
+}
+
+// appliedIndex returns the raft index reads must reach to see a write the
+// server just made, 0 if the server is not replicated
+func (ms *MainServer) appliedIndex() uint64 {
+	if rs, ok := ms.store.(ReplicatedLinkStore); ok {
+		return rs.AppliedIndex()
+	}
+	return 0
+}
+
+// awaitIndex waits for the server to apply minIndex, if it is replicated
+func (ms *MainServer) awaitIndex(minIndex uint64) error {
+	if rs, ok := ms.store.(ReplicatedLinkStore); ok && minIndex > 0 {
+		return rs.WaitForIndex(minIndex, RAFT_READ_TIMEOUT)
+	}
+	return nil
+}
@@ -0,0 +1,351 @@
+package shortener
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+type raftTestNode struct {
+	store  *RaftStore
+	server *MainServer
+	http   *httptest.Server
+}
+
+// testRaftConfig elects leaders quickly
+func testRaftConfig() *raft.Config {
+	conf := raft.DefaultConfig()
+	conf.HeartbeatTimeout = 50 * time.Millisecond
+	conf.ElectionTimeout = 50 * time.Millisecond
+	conf.LeaderLeaseTimeout = 50 * time.Millisecond
+	conf.CommitTimeout = 5 * time.Millisecond
+	conf.LogOutput = ioutil.Discard
+	return conf
+}
+
+// newRaftTestCluster starts n nodes on in memory transports, with a
+// MainServer in front of each
+func newRaftTestCluster(t *testing.T, n int) []*raftTestNode {
+	nodes := make([]*raftTestNode, n)
+	peers := []RaftPeer{}
+	transports := []*raft.InmemTransport{}
+	for i := range nodes {
+		node := &raftTestNode{}
+		node.http = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			node.server.mux.ServeHTTP(w, r)
+		}))
+		nodes[i] = node
+		addr, transport := raft.NewInmemTransport("")
+		transports = append(transports, transport)
+		peers = append(peers, RaftPeer{HTTPAddr: strings.TrimPrefix(node.http.URL, "http://"), RaftAddr: string(addr)})
+	}
+	for i, a := range transports {
+		for j, b := range transports {
+			if i != j {
+				a.Connect(b.LocalAddr(), b)
+			}
+		}
+	}
+	for i, node := range nodes {
+		store, _ := NewMemoryURLStore()
+		logs := raft.NewInmemStore()
+		rs, err := NewRaftStore(
+			store, peers[i].HTTPAddr, testRaftConfig(), transports[i], logs, logs, raft.NewInmemSnapshotStore(), i == 0, peers,
+		)
+		if err != nil {
+			t.Fatalf("Unable to start raft node: %s", err.Error())
+		}
+		node.store = rs
+		node.server = NewMainServerWithStore(rs)
+	}
+	t.Cleanup(func() {
+		for _, node := range nodes {
+			node.http.Close()
+			node.server.Close()
+		}
+	})
+	return nodes
+}
+
+// waitForLeader returns the leader followed by the followers
+func waitForLeader(t *testing.T, nodes []*raftTestNode) (*raftTestNode, []*raftTestNode) {
+	var leader *raftTestNode
+	var followers []*raftTestNode
+	waitFor(t, func() bool {
+		for i, node := range nodes {
+			if node.store.IsLeader() && node.store.Leader() != "" {
+				leader = node
+				followers = append(append([]*raftTestNode{}, nodes[:i]...), nodes[i+1:]...)
+				return true
+			}
+		}
+		return false
+	})
+	return leader, followers
+}
+
+func TestRaftStore(t *testing.T) {
+	leader, followers := waitForLeader(t, newRaftTestCluster(t, 3))
+
+	key, err := leader.store.Store("http://example.com", LinkOptions{})
+	if err != nil {
+		t.Fatalf("Unable to store url: %s", err.Error())
+	}
+	index := leader.store.AppliedIndex()
+	for _, f := range followers {
+		if err := f.store.WaitForIndex(index, time.Second); err != nil {
+			t.Fatalf("Follower did not catch up: %s", err.Error())
+		}
+		if rec, err := f.store.Query(key); err != nil || rec.URL != "http://example.com" {
+			t.Errorf("Expected replicated link, got: %+v, %v", rec, err)
+		}
+	}
+	if _, err := followers[0].store.Store("http://example.com", LinkOptions{}); !errors.Is(err, ErrNotLeader) {
+		t.Errorf("Expected ErrNotLeader from a follower, got: %v", err)
+	}
+	if err := leader.store.StoreAlias(key, "http://example.com", LinkOptions{}); !errors.Is(err, ErrAliasInUse) {
+		t.Errorf("Expected ErrAliasInUse, got: %v", err)
+	}
+	if err := followers[0].store.WaitForIndex(index+100, 10*time.Millisecond); !errors.Is(err, ErrStaleRead) {
+		t.Errorf("Expected ErrStaleRead, got: %v", err)
+	}
+}
+
+func TestRaftRestart(t *testing.T) {
+	testDB := "./test_db_raft_restart"
+	t.Cleanup(func() { os.RemoveAll(testDB) })
+	// the log outlives the node, and no snapshot is taken, so the whole
+	// log is replayed on top of the store on restart
+	logs := raft.NewInmemStore()
+	snaps := raft.NewInmemSnapshotStore()
+	peers := []RaftPeer{{HTTPAddr: "node", RaftAddr: "raft-node"}}
+	start := func() *RaftStore {
+		store, err := NewURLStore(testDB)
+		if err != nil {
+			t.Fatalf("Unable to open test store: %s", err.Error())
+		}
+		_, transport := raft.NewInmemTransport("raft-node")
+		rs, err := NewRaftStore(store, "node", testRaftConfig(), transport, logs, logs, snaps, true, peers)
+		if err != nil {
+			t.Fatalf("Unable to start raft node: %s", err.Error())
+		}
+		waitFor(t, rs.IsLeader)
+		return rs
+	}
+
+	rs := start()
+	key, err := rs.Store("http://a.com", LinkOptions{})
+	if err != nil {
+		t.Fatalf("Unable to store url: %s", err.Error())
+	}
+	if err := rs.Update(key, "http://b.com"); err != nil {
+		t.Fatalf("Unable to update link: %s", err.Error())
+	}
+	index := rs.AppliedIndex()
+	if err := rs.Close(); err != nil {
+		t.Fatalf("Unable to close raft node: %s", err.Error())
+	}
+
+	rs = start()
+	defer rs.Close()
+	if err := rs.WaitForIndex(index, time.Second); err != nil {
+		t.Fatalf("Node did not catch up: %s", err.Error())
+	}
+	rec, err := rs.Query(key)
+	if err != nil || rec.URL != "http://b.com" || len(rec.History) != 1 || rec.History[0].URL != "http://a.com" {
+		t.Errorf("Expected the update to be applied once, got: %+v, %v", rec, err)
+	}
+}
+
+func TestRaftKeyGrowth(t *testing.T) {
+	leader, followers := waitForLeader(t, newRaftTestCluster(t, 3))
+	leader.store.store.SetKeyGenerator(crowdedKeyGenerator{NewSeededKeyGenerator(1)})
+	growKeys(t, leader.store)
+
+	index := leader.store.AppliedIndex()
+	for _, node := range append(followers, leader) {
+		if err := node.store.WaitForIndex(index, time.Second); err != nil {
+			t.Fatalf("Node did not catch up: %s", err.Error())
+		}
+		if keyLen, err := node.store.store.readKeyLen(); err != nil || keyLen != KEY_LEN+1 {
+			t.Errorf("Expected replicated key length %d, got: %d, %v", KEY_LEN+1, keyLen, err)
+		}
+		if keyLen := node.store.store.alloc.keyLen(); keyLen != KEY_LEN+1 {
+			t.Errorf("Expected keys to grow to %d digits, got: %d", KEY_LEN+1, keyLen)
+		}
+	}
+}
+
+func TestRaftMainServer(t *testing.T) {
+	leader, followers := waitForLeader(t, newRaftTestCluster(t, 3))
+	follower := followers[0]
+
+	// writes sent to a follower are forwarded to the leader
+	resp, err := http.PostForm(follower.http.URL+RESERVE_ENDPOINT, url.Values{"num": {"2"}})
+	if err != nil {
+		t.Fatalf("Unable to reserve: %s", err.Error())
+	}
+	var reserved ReserveResponse
+	json.NewDecoder(resp.Body).Decode(&reserved)
+	resp.Body.Close()
+	if !reserved.Succeeded || len(reserved.Keys) != 2 || reserved.Index == 0 {
+		t.Fatalf("Expected 2 reserved keys, got: %+v", reserved)
+	}
+
+	args := url.Values{"key": {reserved.Keys[0]}, "url": {"http://example.com"}}
+	resp, err = http.PostForm(follower.http.URL+SETRESERVE_ENDPOINT, args)
+	if err != nil {
+		t.Fatalf("Unable to set reserved key: %s", err.Error())
+	}
+	var set SetShortenQueryResponse
+	json.NewDecoder(resp.Body).Decode(&set)
+	resp.Body.Close()
+	if !set.Succeeded || set.Index <= reserved.Index {
+		t.Fatalf("Expected reserved key to be set, got: %+v", set)
+	}
+
+	// reads are served locally, after the follower catches up to minIndex
+	for _, node := range []*raftTestNode{leader, follower, followers[1]} {
+		args := url.Values{"key": {reserved.Keys[0]}, "minIndex": {strconv.FormatUint(set.Index, 10)}}
+		jsonResp, _, err := HttpTestPostSetQueryShorten(node.server.mux, QUERY_ENDPOINT, args)
+		if err != nil || !jsonResp.Succeeded || jsonResp.OriginalURL != "http://example.com" {
+			t.Errorf("Expected replicated link, got: %+v, %v", jsonResp, err)
+		}
+	}
+	args = url.Values{"key": {reserved.Keys[0]}, "minIndex": {"abc"}}
+	if _, rec, _ := HttpTestPostSetQueryShorten(follower.server.mux, QUERY_ENDPOINT, args); rec.Code != 400 {
+		t.Errorf("Expected status 400 for a bad minIndex, got: %d", rec.Code)
+	}
+}
+
+type testSnapshotSink struct {
+	bytes.Buffer
+}
+
+func (s *testSnapshotSink) ID() string    { return "test" }
+func (s *testSnapshotSink) Cancel() error { return nil }
+func (s *testSnapshotSink) Close() error  { return nil }
+
+func TestRaftSnapshotRestore(t *testing.T) {
+	src, _ := NewMemoryURLStore()
+	key, err := src.Store("http://example.com", LinkOptions{})
+	if err != nil {
+		t.Fatalf("Unable to store url: %s", err.Error())
+	}
+	srcFSM, err := newLinkFSM(src)
+	if err != nil {
+		t.Fatalf("Unable to create fsm: %s", err.Error())
+	}
+	snap, err := srcFSM.Snapshot()
+	if err != nil {
+		t.Fatalf("Unable to snapshot: %s", err.Error())
+	}
+	sink := &testSnapshotSink{}
+	if err := snap.Persist(sink); err != nil {
+		t.Fatalf("Unable to persist snapshot: %s", err.Error())
+	}
+	snap.Release()
+	persisted := sink.Bytes()
+
+	testDB := "./test_db_restore"
+	t.Cleanup(func() {
+		os.RemoveAll(testDB)
+		os.Remove(testDB + ".bolt")
+	})
+	for name, open := range map[string]func() (*URLStore, error){
+		"badger": func() (*URLStore, error) { return NewURLStore(testDB) },
+		"bolt":   func() (*URLStore, error) { return NewBoltURLStore(testDB + ".bolt") },
+		"memory": NewMemoryURLStore,
+	} {
+		dst, err := open()
+		if err != nil {
+			t.Fatalf("%s: unable to create test store: %s", name, err.Error())
+		}
+		stale, _ := dst.Store("http://example.com/stale", LinkOptions{})
+		fsm, err := newLinkFSM(dst)
+		if err != nil {
+			t.Fatalf("%s: unable to create fsm: %s", name, err.Error())
+		}
+		// a broken snapshot leaves the store as it was
+		broken := ioutil.NopCloser(bytes.NewReader(persisted[:len(persisted)-1]))
+		if err := fsm.Restore(broken); err == nil {
+			t.Errorf("%s: expected an error restoring a truncated snapshot", name)
+		}
+		if _, err := dst.Query(stale); err != nil {
+			t.Errorf("%s: expected a failed restore to keep the store, got: %v", name, err)
+		}
+
+		if err := fsm.Restore(ioutil.NopCloser(bytes.NewReader(persisted))); err != nil {
+			t.Fatalf("%s: unable to restore snapshot: %s", name, err.Error())
+		}
+		if rec, err := dst.Query(key); err != nil || rec.URL != "http://example.com" {
+			t.Errorf("%s: expected restored link, got: %+v, %v", name, rec, err)
+		}
+		if _, err := dst.Query(stale); err == nil {
+			t.Errorf("%s: expected restore to drop links missing from the snapshot", name)
+		}
+		if _, err := dst.Store("http://example.com/after", LinkOptions{}); err != nil {
+			t.Errorf("%s: unable to store url after restoring: %s", name, err.Error())
+		}
+		if _, err := dst.Backup(ioutil.Discard, 0); name == "badger" && err != nil {
+			t.Errorf("%s: unable to back up after restoring: %s", name, err.Error())
+		}
+		if err := dst.Close(); err != nil {
+			t.Errorf("%s: unable to close store: %s", name, err.Error())
+		}
+	}
+}
+
+func TestRaftApplyTime(t *testing.T) {
+	store, _ := NewMemoryURLStore()
+	fsm, err := newLinkFSM(store)
+	if err != nil {
+		t.Fatalf("Unable to create fsm: %s", err.Error())
+	}
+	var index uint64
+	apply := func(cmd raftCommand) raftResult {
+		raw, err := json.Marshal(cmd)
+		if err != nil {
+			t.Fatalf("Unable to encode command: %s", err.Error())
+		}
+		index++
+		return fsm.Apply(&raft.Log{Index: index, Data: raw}).(raftResult)
+	}
+	keys, keyLen, err := store.pickKeys(2)
+	if err != nil {
+		t.Fatalf("Unable to pick keys: %s", err.Error())
+	}
+	// entries proposed long ago, applied by a node that was down since
+	proposed := time.Now().Add(-RESERVE_EXPIRY - time.Hour)
+	res := apply(raftCommand{Op: raftOpReserve, Keys: keys, KeyLen: keyLen, Time: proposed.Unix()})
+	if res.err != nil {
+		t.Fatalf("Unable to reserve keys: %s", res.err.Error())
+	}
+	rec := LinkOptions{}.record("http://example.com")
+	res = apply(raftCommand{Op: raftOpSetReserve, Key: keys[0], Record: rec, Time: proposed.Add(time.Hour).Unix()})
+	if res.err != nil {
+		t.Errorf("Expected the key to be reserved when the write was proposed, got: %s", res.err.Error())
+	}
+	res = apply(raftCommand{Op: raftOpSetReserve, Key: keys[1], Record: rec, Time: time.Now().Unix()})
+	if res.err == nil {
+		t.Errorf("Expected an expired reservation to fail")
+	}
+
+	if got, err := store.Query(keys[0]); err != nil || got.URL != "http://example.com" {
+		t.Errorf("Expected the reserved key to be set, got: %+v, %v", got, err)
+	}
+	if _, err := store.Query(keys[1]); !errors.Is(err, ErrLinkNotFound) {
+		t.Errorf("Expected the expired reservation to be gone, got: %v", err)
+	}
+}
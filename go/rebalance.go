@@ -0,0 +1,216 @@
+package shortener
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// RebalanceSummary reports what Rebalance did with every link it read
+type RebalanceSummary struct {
+	// links already on the shard owning them
+	Kept  int `json:"kept"`
+	Moved int `json:"moved"`
+	// keys reserved by cache servers stay where they are. Cache servers
+	// started with the new shards only use reserved keys their shard
+	// still owns and release the rest, so none is set on a shard queries
+	// no longer go to
+	Reserved int `json:"reserved"`
+	// the new owner already holds a different link under the key
+	Conflicts int `json:"conflicts"`
+	Failed    int `json:"failed"`
+
+	ConflictKeys []string `json:"conflictKeys,omitempty"`
+	Errors       []string `json:"errors,omitempty"`
+}
+
+func (s *RebalanceSummary) conflict(key string) {
+	s.Conflicts++
+	if len(s.ConflictKeys) < MAX_IMPORT_REPORTED {
+		s.ConflictKeys = append(s.ConflictKeys, key)
+	}
+}
+
+func (s *RebalanceSummary) fail(key string, msg string) {
+	s.Failed++
+	if len(s.Errors) < MAX_IMPORT_REPORTED {
+		s.Errors = append(s.Errors, fmt.Sprintf("%s: %s", key, msg))
+	}
+}
+
+// Rebalance moves links between running db servers after the shards
+// changed. It exports every link from each of the sources, imports the
+// ones shards assigns to another host into that host, and once they are
+// there purges them from the source. Sources are usually the shards
+// before the change, and running it again with the new shards as sources
+// moves links written to the old owners in the meantime. With dryRun,
+// links are only counted
+func Rebalance(client *http.Client, shards *Rendezvous, sources []string, dryRun bool) (RebalanceSummary, error) {
+	var summary RebalanceSummary
+	for _, source := range sources {
+		r := &rebalancer{
+			client: client, shards: shards, source: source, dryRun: dryRun,
+			summary: &summary, pending: map[string][]ExportedLink{},
+		}
+		if err := r.run(); err != nil {
+			return summary, fmt.Errorf("rebalancing %s: %w", source, err)
+		}
+	}
+	return summary, nil
+}
+
+// rebalancer moves the links of a single source
+type rebalancer struct {
+	client  *http.Client
+	shards  *Rendezvous
+	source  string
+	dryRun  bool
+	summary *RebalanceSummary
+
+	// links waiting to be imported, by the host they go to
+	pending map[string][]ExportedLink
+	// keys imported elsewhere, purged once the export is done so that
+	// the source is not written to while it is being read
+	moved []string
+}
+
+func (r *rebalancer) run() error {
+	resp, err := r.client.Get(SingleJoiningSlash(dbServerURL(r.source), EXPORT_ENDPOINT) + "?format=" + TRANSFER_FORMAT_JSONL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("export failed: %s", resp.Status)
+	}
+	dec, err := newLinkDecoder(resp.Body, TRANSFER_FORMAT_JSONL)
+	if err != nil {
+		return err
+	}
+	read := 0
+	for {
+		link, err := dec.decode()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		read++
+		owner := r.shards.Owner(link.Key)
+		switch {
+		case owner == r.source:
+			r.summary.Kept++
+		case link.Reserved:
+			r.summary.Reserved++
+		case r.dryRun:
+			r.summary.Moved++
+		default:
+			r.pending[owner] = append(r.pending[owner], link)
+			if len(r.pending[owner]) >= MAX_IMPORT_REPORTED {
+				if err := r.flush(owner); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	// a missing count means the export broke off part way through
+	if count := resp.Trailer.Get(EXPORT_COUNT_TRAILER); count != strconv.Itoa(read) {
+		return fmt.Errorf("export truncated after %d links", read)
+	}
+	for owner := range r.pending {
+		if err := r.flush(owner); err != nil {
+			return err
+		}
+	}
+	for _, key := range r.moved {
+		jsonResp, _, err := PostSetShortenQuery(
+			r.client, SingleJoiningSlash(dbServerURL(r.source), PURGE_ENDPOINT),
+			url.Values{"key": {key}},
+		)
+		if err != nil {
+			return err
+		}
+		if !jsonResp.Succeeded {
+			r.summary.fail(key, "moved but not purged: "+jsonResp.ErrorMsg)
+			continue
+		}
+		r.summary.Moved++
+	}
+	return nil
+}
+
+// flush imports the links pending for owner. batches are no larger than
+// the number of conflicts an import reports, so every conflicting key is
+// known. if any link failed, the batch is imported again link by link to
+// find out which, which imports nothing twice as imports are idempotent
+func (r *rebalancer) flush(owner string) error {
+	links := r.pending[owner]
+	delete(r.pending, owner)
+	if len(links) == 0 {
+		return nil
+	}
+	summary, err := r.importLinks(owner, links)
+	if err != nil {
+		return err
+	}
+	if summary.Failed > 0 && len(links) > 1 {
+		for _, link := range links {
+			r.pending[owner] = []ExportedLink{link}
+			if err := r.flush(owner); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if summary.Failed > 0 {
+		r.summary.fail(links[0].Key, summary.Errors[0])
+		return nil
+	}
+	conflicts := make(map[string]bool, len(summary.ConflictKeys))
+	for _, key := range summary.ConflictKeys {
+		conflicts[key] = true
+		r.summary.conflict(key)
+	}
+	for _, link := range links {
+		if !conflicts[link.Key] {
+			r.moved = append(r.moved, link.Key)
+		}
+	}
+	return nil
+}
+
+func (r *rebalancer) importLinks(owner string, links []ExportedLink) (ImportSummary, error) {
+	var buf bytes.Buffer
+	enc, err := newLinkEncoder(&buf, TRANSFER_FORMAT_JSONL)
+	if err != nil {
+		return ImportSummary{}, err
+	}
+	for _, link := range links {
+		if err := enc.encode(link); err != nil {
+			return ImportSummary{}, err
+		}
+	}
+	if err := enc.flush(); err != nil {
+		return ImportSummary{}, err
+	}
+	resp, err := r.client.Post(
+		SingleJoiningSlash(dbServerURL(owner), IMPORT_ENDPOINT)+"?format="+TRANSFER_FORMAT_JSONL,
+		"application/x-ndjson", &buf,
+	)
+	if err != nil {
+		return ImportSummary{}, err
+	}
+	defer resp.Body.Close()
+	var jsonResp ImportResponse
+	if err := json.NewDecoder(resp.Body).Decode(&jsonResp); err != nil {
+		return ImportSummary{}, fmt.Errorf("importing into %s: %s", owner, err.Error())
+	}
+	if !jsonResp.Succeeded {
+		return ImportSummary{}, fmt.Errorf("importing into %s: %s", owner, jsonResp.ErrorMsg)
+	}
+	return jsonResp.Summary, nil
+}
@@ -0,0 +1,264 @@
+package shortener
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+const (
+	DEFAULT_REDIS_PREFIX = "shortener:"
+	// how long a key is served from the local tier of a redis cache. evictions
+	// are broadcast, so this only bounds how stale a key gets when one is
+	// missed while the subscription reconnects
+	REDIS_LOCAL_TTL = 1 * time.Minute
+	REDIS_RETRY     = 1 * time.Second
+	// bounds every connect, read and write but those of the subscription,
+	// which is idle until a key is deleted
+	REDIS_TIMEOUT = 5 * time.Second
+	// how often the subscription is pinged. a subscription that received
+	// nothing for two of these, pongs included, is lost and resubscribed
+	REDIS_HEALTH_CHECK = 30 * time.Second
+)
+
+var errCacheClosed = errors.New("cache closed")
+
+// RedisCache caches responses in redis shared by every cache server, with
+// a local tier in front of it for hot keys. deletes are published on a
+// redis channel, and every cache server subscribed to it evicts the key
+// from its local tier
+type RedisCache struct {
+	pool    *redis.Pool
+	prefix  string
+	channel string
+	// nil to always ask redis
+	local       LinkCache
+	healthCheck time.Duration
+
+	lock sync.Mutex
+	// the subscription, closed to stop it
+	sub  redis.Conn
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewRedisCache connects to the redis instance at host, namespacing keys
+// with prefix as the instance may be shared with other applications. If
+// local is not nil, keys are kept in it and evicted as other cache servers
+// delete them
+func NewRedisCache(host, prefix string, local LinkCache) (*RedisCache, error) {
+	return newRedisCache(host, prefix, local, REDIS_HEALTH_CHECK)
+}
+
+func newRedisCache(host, prefix string, local LinkCache, healthCheck time.Duration) (*RedisCache, error) {
+	pool := &redis.Pool{
+		Dial: func() (redis.Conn, error) {
+			return redis.Dial(
+				"tcp", host, redis.DialConnectTimeout(REDIS_TIMEOUT),
+				redis.DialReadTimeout(REDIS_TIMEOUT), redis.DialWriteTimeout(REDIS_TIMEOUT),
+			)
+		},
+		MaxIdle:     16,
+		IdleTimeout: 4 * time.Minute,
+	}
+	var err error
+	for i := 0; i < 10; i++ {
+		conn := pool.Get()
+		_, err = conn.Do("PING")
+		conn.Close()
+		if err == nil {
+			break
+		}
+		log.Printf("Unable to connect to redis server, retrying in 1s")
+		time.Sleep(1 * time.Second)
+	}
+	if err != nil {
+		pool.Close()
+		return nil, fmt.Errorf("unable to connect to redis server: %s", err)
+	}
+	ret := &RedisCache{
+		pool: pool, prefix: prefix, channel: prefix + "invalidate", local: local, healthCheck: healthCheck,
+		stop: make(chan struct{}), done: make(chan struct{}),
+	}
+	if local == nil {
+		close(ret.done)
+		return ret, nil
+	}
+	// the first subscription is made before returning, so that no delete
+	// published once we are running is missed
+	psc, err := ret.subscribe()
+	if err != nil {
+		pool.Close()
+		return nil, fmt.Errorf("unable to subscribe to %s: %s", ret.channel, err)
+	}
+	go ret.listen(psc)
+	return ret, nil
+}
+
+func (c *RedisCache) Get(key string) ([]byte, error) {
+	if c.local != nil {
+		if value, err := c.local.Get(key); err == nil {
+			return value, nil
+		}
+	}
+	conn := c.pool.Get()
+	defer conn.Close()
+	value, err := redis.Bytes(conn.Do("GET", c.prefix+key))
+	if err == redis.ErrNil {
+		return nil, ErrCacheMiss
+	} else if err != nil {
+		return nil, err
+	}
+	if c.local != nil {
+		c.local.Set(key, value, REDIS_LOCAL_TTL)
+	}
+	return value, nil
+}
+
+func (c *RedisCache) Set(key string, value []byte, ttl time.Duration) error {
+	conn := c.pool.Get()
+	defer conn.Close()
+	var err error
+	if ttl > 0 {
+		// round up, as redis rejects an expiry of 0
+		_, err = conn.Do("SET", c.prefix+key, value, "PX", int64((ttl+time.Millisecond-1)/time.Millisecond))
+	} else {
+		_, err = conn.Do("SET", c.prefix+key, value)
+	}
+	if err != nil {
+		return err
+	}
+	if c.local != nil {
+		localTTL := REDIS_LOCAL_TTL
+		if ttl > 0 && ttl < localTTL {
+			localTTL = ttl
+		}
+		return c.local.Set(key, value, localTTL)
+	}
+	return nil
+}
+
+// Delete removes the key from redis and tells every cache server to
+// evict it, this one included
+func (c *RedisCache) Delete(key string) error {
+	if c.local != nil {
+		c.local.Delete(key)
+	}
+	conn := c.pool.Get()
+	defer conn.Close()
+	if _, err := conn.Do("DEL", c.prefix+key); err != nil {
+		return err
+	}
+	_, err := conn.Do("PUBLISH", c.channel, key)
+	return err
+}
+
+func (c *RedisCache) subscribe() (redis.PubSubConn, error) {
+	conn, err := c.pool.Dial()
+	if err != nil {
+		return redis.PubSubConn{}, err
+	}
+	psc := redis.PubSubConn{Conn: conn}
+	if err := psc.Subscribe(c.channel); err != nil {
+		conn.Close()
+		return redis.PubSubConn{}, err
+	}
+	// wait for redis to confirm the subscription
+	switch v := psc.Receive().(type) {
+	case redis.Subscription:
+	case error:
+		conn.Close()
+		return redis.PubSubConn{}, v
+	default:
+		conn.Close()
+		return redis.PubSubConn{}, fmt.Errorf("unexpected reply %v", v)
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	select {
+	case <-c.stop:
+		conn.Close()
+		return redis.PubSubConn{}, errCacheClosed
+	default:
+	}
+	c.sub = conn
+	return psc, nil
+}
+
+// listen evicts every key published on the channel, resubscribing
+// whenever the connection is lost until the cache is closed
+func (c *RedisCache) listen(psc redis.PubSubConn) {
+	defer close(c.done)
+	for {
+		err := c.receive(psc)
+		psc.Close()
+		select {
+		case <-c.stop:
+			return
+		default:
+		}
+		log.Printf("Lost redis subscription, resubscribing: %s\n", err.Error())
+		for {
+			select {
+			case <-c.stop:
+				return
+			case <-time.After(REDIS_RETRY):
+			}
+			psc, err = c.subscribe()
+			if err == errCacheClosed {
+				return
+			} else if err == nil {
+				break
+			}
+			log.Printf("Error resubscribing to redis: %s\n", err.Error())
+		}
+	}
+}
+
+// receive evicts published keys until the subscription fails. redis never
+// closes a connection it lost track of, so the subscription is pinged, and
+// is taken as lost once neither messages nor pongs arrive
+func (c *RedisCache) receive(psc redis.PubSubConn) error {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(c.healthCheck)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				// a failed ping fails the receive as well
+				if err := psc.Ping(""); err != nil {
+					return
+				}
+			}
+		}
+	}()
+	for {
+		switch v := psc.ReceiveWithTimeout(2 * c.healthCheck).(type) {
+		case redis.Message:
+			c.local.Delete(string(v.Data))
+		case error:
+			return v
+		}
+	}
+}
+
+// Close stops listening for evictions and closes the connections to redis
+func (c *RedisCache) Close() error {
+	c.lock.Lock()
+	close(c.stop)
+	if c.sub != nil {
+		// unblocks the receive of the listener
+		c.sub.Close()
+	}
+	c.lock.Unlock()
+	<-c.done
+	return c.pool.Close()
+}
@@ -0,0 +1,161 @@
+package shortener
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func TestRedisCache(t *testing.T) {
+	mr := miniredis.RunT(t)
+	// two cache servers sharing one redis
+	localA, localB := NewLRUCache(1<<10), NewLRUCache(1<<10)
+	a, err := NewRedisCache(mr.Addr(), DEFAULT_REDIS_PREFIX, localA)
+	if err != nil {
+		t.Fatalf("Unable to create redis cache: %s", err.Error())
+	}
+	defer a.Close()
+	b, err := NewRedisCache(mr.Addr(), DEFAULT_REDIS_PREFIX, localB)
+	if err != nil {
+		t.Fatalf("Unable to create redis cache: %s", err.Error())
+	}
+	defer b.Close()
+
+	if err := a.Set("key", []byte("first"), 0); err != nil {
+		t.Fatalf("Unable to set key: %s", err.Error())
+	}
+	if raw, err := mr.Get(DEFAULT_REDIS_PREFIX + "key"); err != nil || raw != "first" {
+		t.Errorf("Expected the key to be stored under the prefix, got %q %v", raw, err)
+	}
+	checkCached(t, b, "key", "first")
+	checkCached(t, localB, "key", "first")
+
+	// a delete through one cache server is broadcast to the other
+	if err := a.Delete("key"); err != nil {
+		t.Fatalf("Unable to delete key: %s", err.Error())
+	}
+	waitFor(t, func() bool {
+		_, err := localB.Get("key")
+		return err == ErrCacheMiss
+	})
+	checkCached(t, b, "key", "")
+
+	a.Set("expiring", []byte("soon"), 1500*time.Millisecond)
+	if ttl := mr.TTL(DEFAULT_REDIS_PREFIX + "expiring"); ttl != 1500*time.Millisecond {
+		t.Errorf("Expected the key to expire in 1.5s, got %s", ttl)
+	}
+	mr.FastForward(2 * time.Second)
+	checkCached(t, b, "expiring", "")
+
+	// evictions keep being delivered once the subscription is restored
+	mr.Close()
+	if err := mr.Restart(); err != nil {
+		t.Fatalf("Unable to restart redis: %s", err.Error())
+	}
+	b.Set("restored", []byte("value"), 0)
+	waitFor(t, func() bool {
+		// the delete may be published before the subscription is back,
+		// so keep setting and deleting the key until it goes through
+		localB.Set("restored", []byte("value"), 0)
+		a.Delete("restored")
+		time.Sleep(50 * time.Millisecond)
+		_, err := localB.Get("restored")
+		return err == ErrCacheMiss
+	})
+}
+
+// stallingProxy forwards connections to a redis server. stall stops
+// forwarding on the connections open so far without closing them, like a
+// peer that went away without a word
+type stallingProxy struct {
+	listener net.Listener
+	target   string
+	gen      int32
+}
+
+func newStallingProxy(t *testing.T, target string) *stallingProxy {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to listen: %s", err.Error())
+	}
+	p := &stallingProxy{listener: listener, target: target}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			upstream, err := net.Dial("tcp", target)
+			if err != nil {
+				conn.Close()
+				continue
+			}
+			gen := atomic.LoadInt32(&p.gen)
+			go p.forward(gen, conn, upstream)
+			go p.forward(gen, upstream, conn)
+		}
+	}()
+	return p
+}
+
+func (p *stallingProxy) forward(gen int32, from, to net.Conn) {
+	buf := make([]byte, 4096)
+	for {
+		n, err := from.Read(buf)
+		if err != nil {
+			to.Close()
+			return
+		}
+		if atomic.LoadInt32(&p.gen) == gen {
+			to.Write(buf[:n])
+		}
+	}
+}
+
+func (p *stallingProxy) stall() {
+	atomic.AddInt32(&p.gen, 1)
+}
+
+func TestRedisCacheHealthCheck(t *testing.T) {
+	mr := miniredis.RunT(t)
+	proxy := newStallingProxy(t, mr.Addr())
+	local := NewLRUCache(1 << 10)
+	cache, err := newRedisCache(proxy.listener.Addr().String(), DEFAULT_REDIS_PREFIX, local, 50*time.Millisecond)
+	if err != nil {
+		t.Fatalf("Unable to create redis cache: %s", err.Error())
+	}
+	defer cache.Close()
+
+	// the stalled subscription is noticed and replaced, so evictions
+	// published afterwards arrive again
+	proxy.stall()
+	waitFor(t, func() bool {
+		local.Set("key", []byte("value"), 0)
+		mr.Publish(cache.channel, "key")
+		time.Sleep(20 * time.Millisecond)
+		_, err := local.Get("key")
+		return err == ErrCacheMiss
+	})
+}
+
+func TestRedisCacheWithoutLocal(t *testing.T) {
+	mr := miniredis.RunT(t)
+	cache, err := NewRedisCache(mr.Addr(), "test:", nil)
+	if err != nil {
+		t.Fatalf("Unable to create redis cache: %s", err.Error())
+	}
+	cache.Set("key", []byte("value"), 0)
+	checkCached(t, cache, "key", "value")
+	// changes made by other cache servers are seen at once
+	mr.Set("test:key", "changed")
+	checkCached(t, cache, "key", "changed")
+	cache.Delete("key")
+	checkCached(t, cache, "key", "")
+	if err := cache.Close(); err != nil {
+		t.Errorf("Unable to close redis cache: %s", err.Error())
+	}
+}
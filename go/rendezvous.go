@@ -0,0 +1,69 @@
+package shortener
+
+import (
+	"errors"
+	"hash/fnv"
+)
+
+// Rendezvous routes keys to one of a set of hosts with rendezvous (highest
+// random weight) hashing. Every host scores every key, and a key belongs
+// to the host with the highest score, so adding a host only moves the
+// keys the new host wins, and removing one only moves the keys it had
+type Rendezvous struct {
+	hosts []string
+}
+
+func NewRendezvous(hosts []string) (*Rendezvous, error) {
+	if len(hosts) == 0 {
+		return nil, errors.New("rendezvous hashing needs at least one host")
+	}
+	seen := make(map[string]bool, len(hosts))
+	for _, h := range hosts {
+		if seen[h] {
+			return nil, errors.New("duplicate rendezvous host: " + h)
+		}
+		seen[h] = true
+	}
+	return &Rendezvous{hosts: append([]string{}, hosts...)}, nil
+}
+
+func (r *Rendezvous) Hosts() []string {
+	return append([]string{}, r.hosts...)
+}
+
+// Owner returns the host key belongs to
+func (r *Rendezvous) Owner(key string) string {
+	var owner string
+	var best uint64
+	for i, h := range r.hosts {
+		// ties go to the smallest host, whatever order hosts are listed in
+		if score := rendezvousScore(h, key); i == 0 || score > best || score == best && h < owner {
+			owner, best = h, score
+		}
+	}
+	return owner
+}
+
+// OwnedBy returns a filter accepting the keys that belong to host
+func (r *Rendezvous) OwnedBy(host string) func(key []byte) bool {
+	return func(key []byte) bool {
+		return r.Owner(string(key)) == host
+	}
+}
+
+// rendezvousScore hashes host and key together. fnv alone mixes the last
+// bytes poorly, and keys that only differ at the end are common, so the
+// hash goes through the splitmix64 finalizer as well
+func rendezvousScore(host, key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(host))
+	h.Write([]byte{0})
+	h.Write([]byte(key))
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
@@ -0,0 +1,158 @@
+package shortener
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRendezvous(t *testing.T) {
+	if _, err := NewRendezvous(nil); err == nil {
+		t.Errorf("Expected an empty host list to fail")
+	}
+	if _, err := NewRendezvous([]string{"a", "a"}); err == nil {
+		t.Errorf("Expected duplicate hosts to fail")
+	}
+	three, _ := NewRendezvous([]string{"a:1", "b:1", "c:1"})
+	reordered, _ := NewRendezvous([]string{"c:1", "a:1", "b:1"})
+	four, _ := NewRendezvous([]string{"a:1", "b:1", "c:1", "d:1"})
+
+	counts := map[string]int{}
+	moved := 0
+	const num = 30000
+	for i := 0; i < num; i++ {
+		key := fmt.Sprintf("key%d", i)
+		owner := three.Owner(key)
+		counts[owner]++
+		if reordered.Owner(key) != owner {
+			t.Fatalf("Owner of %s depends on the order of hosts", key)
+		}
+		if newOwner := four.Owner(key); newOwner != owner {
+			if newOwner != "d:1" {
+				t.Fatalf("Adding a host moved %s from %s to %s", key, owner, newOwner)
+			}
+			moved++
+		}
+	}
+	for host, count := range counts {
+		if count < num/3*9/10 || count > num/3*11/10 {
+			t.Errorf("Uneven distribution: %s owns %d of %d keys", host, count, num)
+		}
+	}
+	if moved < num/4*9/10 || moved > num/4*11/10 {
+		t.Errorf("Expected about a quarter of the keys to move to a new host, %d of %d did", moved, num)
+	}
+}
+
+func newShardServers(t *testing.T, num int) []*shardServer {
+	shards := []*shardServer{}
+	for i := 0; i < num; i++ {
+		store, err := NewMemoryURLStore()
+		if err != nil {
+			t.Fatalf("Unable to create test store: %s", err.Error())
+		}
+		shard := &shardServer{store: store, server: NewMainServerWithStore(store)}
+		shard.http = httptest.NewServer(shard.server.mux)
+		shard.host = strings.TrimPrefix(shard.http.URL, "http://")
+		shards = append(shards, shard)
+	}
+	return shards
+}
+
+func shardHosts(shards []*shardServer) []string {
+	hosts := []string{}
+	for _, shard := range shards {
+		hosts = append(hosts, shard.host)
+	}
+	return hosts
+}
+
+func TestRebalance(t *testing.T) {
+	shards := newShardServers(t, 3)
+	for _, shard := range shards {
+		defer shard.http.Close()
+		defer shard.server.Close()
+	}
+	before, _ := NewRendezvous(shardHosts(shards[:2]))
+	for _, shard := range shards[:2] {
+		shard.store.SetKeyFilter(before.OwnedBy(shard.host))
+	}
+
+	keys := map[string]string{}
+	for i := 0; i < 200; i++ {
+		urlStr := fmt.Sprintf("http://example.com/%d", i)
+		key, err := shards[i%2].store.Store(urlStr, LinkOptions{Dedupe: true})
+		if err != nil {
+			t.Fatalf("Unable to store url: %s", err.Error())
+		}
+		keys[key] = urlStr
+	}
+	reserved, err := shards[0].store.Reserve(20)
+	if err != nil {
+		t.Fatalf("Unable to reserve keys: %s", err.Error())
+	}
+
+	after, _ := NewRendezvous(shardHosts(shards))
+	for _, shard := range shards {
+		shard.store.SetKeyFilter(after.OwnedBy(shard.host))
+	}
+	dry, err := Rebalance(&http.Client{}, after, before.Hosts(), true)
+	if err != nil {
+		t.Fatalf("Unable to dry run rebalance: %s", err.Error())
+	}
+	if dry.Moved == 0 || dry.Moved+dry.Kept+dry.Reserved != len(keys)+len(reserved) {
+		t.Fatalf("Unexpected dry run summary: %+v", dry)
+	}
+	summary, err := Rebalance(&http.Client{}, after, before.Hosts(), false)
+	if err != nil {
+		t.Fatalf("Unable to rebalance: %s", err.Error())
+	}
+	if summary.Moved != dry.Moved || summary.Failed != 0 || summary.Conflicts != 0 {
+		t.Errorf("Expected the dry run's %d links to move, got %+v", dry.Moved, summary)
+	}
+
+	for key, urlStr := range keys {
+		for _, shard := range shards {
+			rec, err := shard.store.Query(key)
+			if shard.host != after.Owner(key) {
+				if !errors.Is(err, ErrLinkNotFound) {
+					t.Errorf("Expected %s to be gone from %s, got %v", key, shard.host, err)
+				}
+			} else if err != nil || rec.URL != urlStr {
+				t.Errorf("Expected %s to point at %s on its owner, got %v %v", key, urlStr, rec.URL, err)
+			}
+		}
+		// moved links are still deduplicated on their new owner
+		owner := shards[0]
+		for _, shard := range shards {
+			if shard.host == after.Owner(key) {
+				owner = shard
+			}
+		}
+		if again, err := owner.store.Store(urlStr, LinkOptions{Dedupe: true}); err != nil || again != key {
+			t.Errorf("Expected %s to be deduplicated to %s, got %s %v", urlStr, key, again, err)
+		}
+	}
+	// reserved keys stay with the shard their cache server reserved them
+	// from, and move once they are set and rebalanced again
+	misplaced := 0
+	for _, key := range reserved {
+		if err := shards[0].store.SetReserve(key, "http://example.com", LinkOptions{}); err != nil {
+			t.Errorf("Expected reserved key %s to stay settable: %s", key, err.Error())
+		}
+		if after.Owner(key) != shards[0].host {
+			misplaced++
+		}
+	}
+
+	again, err := Rebalance(&http.Client{}, after, after.Hosts(), false)
+	if err != nil {
+		t.Fatalf("Unable to rebalance again: %s", err.Error())
+	}
+	if again.Moved != misplaced || again.Failed != 0 {
+		t.Errorf("Expected only the %d set reserved keys to move, got %+v", misplaced, again)
+	}
+}
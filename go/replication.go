@@ -0,0 +1,578 @@
+package shortener
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/dgraph-io/badger"
+)
+
+const (
+	// changes per batch while a follower catches up
+	CHANGES_BATCH_SIZE = 1000
+	// live batches buffered for a follower before it is cut off, to be
+	// caught up again when it reconnects. badger stalls writes while a
+	// subscriber does not keep up, so followers must never block it
+	CHANGES_MAX_PENDING = 64
+	// how often an idle stream sends an empty batch, which tells the
+	// follower the primary has nothing newer
+	CHANGES_HEARTBEAT    = 5 * time.Second
+	CHANGES_DEFAULT_WAIT = 30 * time.Second
+	CHANGES_MAX_WAIT     = 2 * time.Minute
+
+	REPLICA_MIN_BACKOFF = 1 * time.Second
+	REPLICA_MAX_BACKOFF = 30 * time.Second
+)
+
+// keys under replicationPrefix are bookkeeping of the node that wrote
+// them and are never shipped. a replica keeps the cursor it has applied changes up
+// to in replicationCursorKey, and a primary writes replicationProbeKey to
+// find out when a subscription has started
+var (
+	replicationPrefix    = []byte(META_PREFIX + "replication/")
+	replicationCursorKey = []byte(META_PREFIX + "replication/cursor")
+	replicationProbeKey  = []byte(META_PREFIX + "replication/probe")
+)
+
+var (
+	ErrChangesUnsupported = errors.New("storage backend does not support change streams")
+	errFollowerBehind     = errors.New("follower fell behind the change stream")
+)
+
+// replication metrics, served from /debug/vars
+var (
+	replicationFollowers = expvar.NewInt("replication_followers")
+	replicationErrors    = expvar.NewInt("replication_errors")
+	// unix milliseconds on the replica's clock it applied the last batch
+	// at, and the last batch the primary had nothing newer than. a process
+	// runs at most one replica
+	replicationLastBatch int64
+	replicationCaughtUp  int64
+)
+
+func init() {
+	expvar.Publish("replication_lag_ms", expvar.Func(func() interface{} {
+		return replicationLag(
+			unixMillis(time.Now()), atomic.LoadInt64(&replicationLastBatch), atomic.LoadInt64(&replicationCaughtUp),
+		)
+	}))
+}
+
+func unixMillis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// replicationLag returns how long ago the replica was last known to have
+// everything the primary had. while the last batch was current and the
+// stream is alive, the primary has had nothing newer since, so the lag
+// only grows once the replica falls behind or misses heartbeats
+func replicationLag(now, lastBatch, caughtUp int64) int64 {
+	if caughtUp == 0 {
+		return 0
+	}
+	alive := now-lastBatch < int64(2*CHANGES_HEARTBEAT/time.Millisecond)
+	if lastBatch == caughtUp && alive {
+		return 0
+	}
+	return now - caughtUp
+}
+
+// Change is a single write to a store's engine, as shipped to replicas
+type Change struct {
+	Key   []byte `json:"key"`
+	Value []byte `json:"value,omitempty"`
+	// unix seconds, 0 if the value never expires
+	ExpiresAt uint64 `json:"expiresAt,omitempty"`
+	Version   uint64 `json:"version"`
+	Deleted   bool   `json:"deleted,omitempty"`
+}
+
+// ChangeBatch is a batch of changes in a change stream. Once a follower
+// applied it, it has every change up to and including version Cursor
+type ChangeBatch struct {
+	Cursor uint64 `json:"cursor"`
+	// the primary had no changes newer than Cursor when it sent the batch
+	Current bool     `json:"current,omitempty"`
+	Changes []Change `json:"changes"`
+}
+
+// ChangeStore is a LinkStore that can stream the changes made to it
+type ChangeStore interface {
+	// Changes calls fn with every change newer than version since, and
+	// then with new changes as they are made, until ctx is done or fn
+	// fails. Idle streams get an empty batch every CHANGES_HEARTBEAT
+	Changes(ctx context.Context, since uint64, fn func(batch ChangeBatch) error) error
+}
+
+// Changes streams the store's changes. Only the badger backend supports
+// change streams
+func (store *URLStore) Changes(ctx context.Context, since uint64, fn func(batch ChangeBatch) error) error {
+	e, ok := store.db.(*badgerEngine)
+	if !ok {
+		return ErrChangesUnsupported
+	}
+	return e.changes(ctx, since, fn)
+}
+
+// changes subscribes to new writes before catching up, so that nothing
+// written in between is missed. writes the catch up already saw arrive
+// from the subscription as well, and are dropped by their version
+func (e *badgerEngine) changes(ctx context.Context, since uint64, fn func(batch ChangeBatch) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	live := make(chan []Change, CHANGES_MAX_PENDING)
+	subscribed := make(chan error, 1)
+	probe := []byte(strconv.FormatInt(time.Now().UnixNano(), 10))
+	probed := make(chan struct{})
+	seenProbe := false
+	go func() {
+		subscribed <- e.db.Subscribe(ctx, func(list *badger.KVList) error {
+			changes := make([]Change, 0, len(list.Kv))
+			for _, kv := range list.Kv {
+				if !seenProbe && bytes.Equal(kv.Key, replicationProbeKey) && bytes.Equal(kv.Value, probe) {
+					seenProbe = true
+					close(probed)
+				}
+				if shippedKey(kv.Key) {
+					// values are never empty, so an empty one is a delete
+					changes = append(changes, Change{
+						Key: kv.Key, Value: kv.Value, ExpiresAt: kv.ExpiresAt,
+						Version: kv.Version, Deleted: len(kv.Value) == 0,
+					})
+				}
+			}
+			select {
+			case live <- changes:
+				return nil
+			default:
+				return errFollowerBehind
+			}
+		}, []byte{})
+	}()
+
+	// badger registers subscribers in the background, so probe until the
+	// subscription sees a write
+	for registered := false; !registered; {
+		err := e.db.Update(func(txn *badger.Txn) error {
+			return txn.Set(replicationProbeKey, probe)
+		})
+		if err != nil {
+			return err
+		}
+		select {
+		case <-probed:
+			registered = true
+		case err := <-subscribed:
+			return err
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	idle := func() bool { return len(live) == 0 }
+	cursor, err := e.catchUp(since, idle, fn)
+	if err != nil {
+		return err
+	}
+	heartbeat := time.NewTicker(CHANGES_HEARTBEAT)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case err := <-subscribed:
+			if err == nil {
+				err = errors.New("change stream closed")
+			}
+			return err
+		case <-heartbeat.C:
+			if err := fn(ChangeBatch{Cursor: cursor, Current: idle(), Changes: []Change{}}); err != nil {
+				return err
+			}
+		case changes := <-live:
+			fresh := changes[:0]
+			for _, c := range changes {
+				if c.Version > cursor {
+					fresh = append(fresh, c)
+				}
+			}
+			if len(fresh) == 0 {
+				continue
+			}
+			// badger publishes writes in the order it commits them
+			cursor = fresh[len(fresh)-1].Version
+			if err := fn(ChangeBatch{Cursor: cursor, Current: idle(), Changes: fresh}); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// catchUp sends the latest version of every key changed after since, and
+// returns the cursor the stream continues from. keys come in key order
+// rather than version order, so the cursor only moves past since with
+// the last batch, and a follower interrupted part way catches up again.
+// the last batch is current if idle reports no live changes pending
+func (e *badgerEngine) catchUp(since uint64, idle func() bool, fn func(batch ChangeBatch) error) (uint64, error) {
+	cursor := since
+	batch := make([]Change, 0, CHANGES_BATCH_SIZE)
+	err := e.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.AllVersions = true
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		var last []byte
+		for it.Rewind(); it.Valid(); it.Next() {
+			item := it.Item()
+			// the first version of a key is its latest one
+			if bytes.Equal(item.Key(), last) {
+				continue
+			}
+			last = item.KeyCopy(last[:0])
+			if item.Version() <= since || !shippedKey(item.Key()) {
+				continue
+			}
+			c := Change{Key: item.KeyCopy(nil), Version: item.Version(), Deleted: item.IsDeletedOrExpired()}
+			if !c.Deleted {
+				val, err := readBadgerItem(item)
+				if err != nil {
+					return err
+				}
+				c.Value, c.ExpiresAt = val.Value, val.ExpiresAt
+			}
+			if c.Version > cursor {
+				cursor = c.Version
+			}
+			batch = append(batch, c)
+			if len(batch) == CHANGES_BATCH_SIZE {
+				if err := fn(ChangeBatch{Cursor: since, Changes: batch}); err != nil {
+					return err
+				}
+				batch = make([]Change, 0, CHANGES_BATCH_SIZE)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	if len(batch) > 0 || cursor > since {
+		if err := fn(ChangeBatch{Cursor: cursor, Current: idle(), Changes: batch}); err != nil {
+			return 0, err
+		}
+	}
+	return cursor, nil
+}
+
+// shippedKey reports whether changes to key go to followers, which
+// excludes badger's own keys and replication bookkeeping
+func shippedKey(key []byte) bool {
+	return !bytes.HasPrefix(key, []byte("!badger!")) && !bytes.HasPrefix(key, replicationPrefix)
+}
+
+// changes streams the store's changes as JSON lines of ChangeBatch. With
+// follow=true the stream goes on until the follower disconnects. Without
+// it, the request is a long poll: it returns once there were changes
+// newer than since, or with an empty batch after wait
+func (ms *MainServer) changes(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("400 - Bad Request"))
+		return
+	}
+	var since uint64
+	if s := r.Form.Get("since"); s != "" {
+		since, err = strconv.ParseUint(s, 10, 64)
+	}
+	wait := CHANGES_DEFAULT_WAIT
+	if s := r.Form.Get("wait"); s != "" && err == nil {
+		wait, err = time.ParseDuration(s)
+	}
+	if err != nil || wait <= 0 || wait > CHANGES_MAX_WAIT {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("400 - Bad Request"))
+		return
+	}
+	follow := r.Form.Get("follow") == "true"
+	store, ok := ms.store.(ChangeStore)
+	if !ok {
+		w.WriteHeader(http.StatusNotImplemented)
+		w.Write([]byte("501 - Not Implemented"))
+		return
+	}
+
+	ctx, cancel := context.WithCancel(r.Context())
+	if !follow {
+		ctx, cancel = context.WithTimeout(r.Context(), wait)
+	}
+	defer cancel()
+	replicationFollowers.Add(1)
+	defer replicationFollowers.Add(-1)
+	flusher, _ := w.(http.Flusher)
+	enc := json.NewEncoder(w)
+	sent := false
+	cursor := since
+	err = store.Changes(ctx, since, func(batch ChangeBatch) error {
+		if !sent {
+			w.Header().Set("Content-Type", "application/x-ndjson")
+		}
+		if err := enc.Encode(batch); err != nil {
+			return err
+		}
+		sent, cursor = true, batch.Cursor
+		if flusher != nil {
+			flusher.Flush()
+		}
+		// a long poll returns with the catch up, or the first live batch
+		if !follow && batch.Cursor > since {
+			cancel()
+		}
+		return nil
+	})
+	switch {
+	case errors.Is(err, ErrChangesUnsupported):
+		w.WriteHeader(http.StatusNotImplemented)
+		w.Write([]byte("501 - Not Implemented"))
+	case !sent && ctx.Err() != nil && r.Context().Err() == nil:
+		// the long poll timed out without changes
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		enc.Encode(ChangeBatch{Cursor: cursor, Current: true, Changes: []Change{}})
+	case err != nil && ctx.Err() == nil:
+		// the follower finds out from the stream ending early, and resumes
+		// from the last cursor it got
+		log.Printf("Error streaming changes: %s\n", err.Error())
+	}
+}
+
+// Replica keeps a read only copy of a primary db server's links by
+// following its change stream. Writes are forwarded to the primary by the
+// MainServer, as they are for raft followers
+type Replica struct {
+	store   *URLStore
+	primary string
+	client  *http.Client
+	cursor  uint64
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// OpenReplica starts following the db server at primaryHost into store,
+// resuming from the cursor store last applied. The replica takes
+// ownership of store
+func OpenReplica(store *URLStore, primaryHost string) (*Replica, error) {
+	r := &Replica{
+		store: store, primary: primaryHost, client: &http.Client{},
+		stop: make(chan struct{}), done: make(chan struct{}),
+	}
+	err := store.db.View(func(txn kvTxn) error {
+		val, err := txn.Get(replicationCursorKey)
+		if err == errKeyNotFound {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if len(val.Value) != 8 {
+			return errors.New("corrupt replication cursor")
+		}
+		r.cursor = binary.BigEndian.Uint64(val.Value)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	go r.run()
+	return r, nil
+}
+
+func (r *Replica) run() {
+	defer close(r.done)
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-r.stop
+		cancel()
+	}()
+	backoff := REPLICA_MIN_BACKOFF
+	for {
+		applied, err := r.follow(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if applied {
+			backoff = REPLICA_MIN_BACKOFF
+		}
+		replicationErrors.Add(1)
+		log.Printf("Lost change stream from %s, retrying in %s: %v\n", r.primary, backoff, err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > REPLICA_MAX_BACKOFF {
+			backoff = REPLICA_MAX_BACKOFF
+		}
+	}
+}
+
+// follow applies the primary's change stream until it breaks, reporting
+// whether it applied anything
+func (r *Replica) follow(ctx context.Context) (bool, error) {
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf(
+		"http://%s%s?follow=true&since=%d", r.primary, CHANGES_ENDPOINT, r.AppliedIndex(),
+	), nil)
+	if err != nil {
+		return false, err
+	}
+	resp, err := r.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("change stream failed: %s", resp.Status)
+	}
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(nil, CHANGES_BATCH_SIZE*MAX_TRANSFER_LINE_LEN)
+	applied := false
+	for scanner.Scan() {
+		var batch ChangeBatch
+		if err := json.Unmarshal(scanner.Bytes(), &batch); err != nil {
+			return applied, err
+		}
+		if err := r.apply(batch); err != nil {
+			return applied, err
+		}
+		applied = true
+	}
+	if err := scanner.Err(); err != nil {
+		return applied, err
+	}
+	return applied, errors.New("change stream ended")
+}
+
+// apply writes a batch along with its cursor, so that a restarted replica
+// resumes right after it
+func (r *Replica) apply(batch ChangeBatch) error {
+	if len(batch.Changes) > 0 || batch.Cursor != r.AppliedIndex() {
+		err := r.store.db.Update(func(txn kvTxn) error {
+			for _, c := range batch.Changes {
+				var err error
+				if c.Deleted {
+					err = txn.Delete(c.Key)
+				} else {
+					err = txn.Set(c.Key, c.Value, c.ExpiresAt)
+				}
+				if err != nil {
+					return err
+				}
+			}
+			var cursor [8]byte
+			binary.BigEndian.PutUint64(cursor[:], batch.Cursor)
+			return txn.Set(replicationCursorKey, cursor[:], 0)
+		})
+		if err != nil {
+			return err
+		}
+		atomic.StoreUint64(&r.cursor, batch.Cursor)
+	}
+	now := unixMillis(time.Now())
+	if batch.Current {
+		atomic.StoreInt64(&replicationCaughtUp, now)
+	}
+	atomic.StoreInt64(&replicationLastBatch, now)
+	return nil
+}
+
+func (r *Replica) Store(urlStr string, opts LinkOptions) (string, error) {
+	return "", ErrNotLeader
+}
+
+func (r *Replica) StoreAlias(alias, urlStr string, opts LinkOptions) error {
+	return ErrNotLeader
+}
+
+func (r *Replica) Query(key string) (LinkRecord, error) {
+	return r.store.Query(key)
+}
+
+func (r *Replica) Reserve(num int) ([]string, error) {
+	return []string{}, ErrNotLeader
+}
+
+func (r *Replica) SetReserve(key, urlStr string, opts LinkOptions) error {
+	return ErrNotLeader
+}
+
+func (r *Replica) Release(keys []string) ([]string, error) {
+	return []string{}, ErrNotLeader
+}
+
+func (r *Replica) Update(key, urlStr string) error {
+	return ErrNotLeader
+}
+
+func (r *Replica) Delete(key string) error {
+	return ErrNotLeader
+}
+
+func (r *Replica) Disable(key string, disabled bool) error {
+	return ErrNotLeader
+}
+
+func (r *Replica) Import(key string, rec LinkRecord) (bool, error) {
+	return false, ErrNotLeader
+}
+
+func (r *Replica) Purge(key string) error {
+	return ErrNotLeader
+}
+
+func (r *Replica) Iterate(fn func(key string, rec LinkRecord) error) error {
+	return r.store.Iterate(fn)
+}
+
+func (r *Replica) IsLeader() bool {
+	return false
+}
+
+// Leader returns the primary, which every write is forwarded to
+func (r *Replica) Leader() string {
+	return r.primary
+}
+
+// AppliedIndex returns the primary's version the replica is caught up to
+func (r *Replica) AppliedIndex() uint64 {
+	return atomic.LoadUint64(&r.cursor)
+}
+
+func (r *Replica) WaitForIndex(index uint64, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for r.AppliedIndex() < index {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%w: version %d not applied after %s", ErrStaleRead, index, timeout)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	return nil
+}
+
+// Close stops following the primary and closes the store
+func (r *Replica) Close() error {
+	close(r.stop)
+	<-r.done
+	return r.store.Close()
+}
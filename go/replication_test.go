@@ -0,0 +1,209 @@
+package shortener
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// pollChanges long polls a change stream, returning every batch it got
+func pollChanges(t *testing.T, server *httptest.Server, query string) []ChangeBatch {
+	resp, err := http.Get(server.URL + CHANGES_ENDPOINT + "?" + query)
+	if err != nil {
+		t.Fatalf("Unable to poll changes: %s", err.Error())
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Unable to poll changes: %s", resp.Status)
+	}
+	batches := []ChangeBatch{}
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		var batch ChangeBatch
+		if err := json.Unmarshal(scanner.Bytes(), &batch); err != nil {
+			t.Fatalf("Unable to decode batch: %s", err.Error())
+		}
+		batches = append(batches, batch)
+	}
+	return batches
+}
+
+func changedKeys(batches []ChangeBatch) map[string]Change {
+	keys := map[string]Change{}
+	for _, batch := range batches {
+		for _, c := range batch.Changes {
+			keys[string(c.Key)] = c
+		}
+	}
+	return keys
+}
+
+func TestChangeStream(t *testing.T) {
+	testDB := "./test_db_changes"
+	t.Cleanup(func() { os.RemoveAll(testDB) })
+	store, err := NewURLStore(testDB)
+	if err != nil {
+		t.Fatalf("Unable to create test store: %s", err.Error())
+	}
+	server := NewMainServerWithStore(store)
+	defer server.Close()
+	primary := httptest.NewServer(server.mux)
+	defer primary.Close()
+
+	kept, _ := store.Store("http://example.com/kept", LinkOptions{})
+	purged, _ := store.Store("http://example.com/purged", LinkOptions{})
+	if err := store.Purge(purged); err != nil {
+		t.Fatalf("Unable to purge key: %s", err.Error())
+	}
+	batches := pollChanges(t, primary, "since=0")
+	cursor := batches[len(batches)-1].Cursor
+	keys := changedKeys(batches)
+	if c, ok := keys[kept]; !ok || c.Deleted || cursor == 0 {
+		t.Errorf("Expected the catch up to include %s and a cursor, got %+v", kept, batches)
+	}
+	if c, ok := keys[purged]; !ok || !c.Deleted {
+		t.Errorf("Expected the catch up to include the purge of %s, got %+v", purged, keys[purged])
+	}
+	for key := range keys {
+		if strings.HasPrefix(key, string(replicationPrefix)) {
+			t.Errorf("Expected replication bookkeeping not to be shipped, got %s", key)
+		}
+	}
+
+	// nothing newer than the cursor, so the poll times out
+	batches = pollChanges(t, primary, "wait=50ms&since="+strconv.FormatUint(cursor, 10))
+	if len(batches) != 1 || len(batches[0].Changes) != 0 || batches[0].Cursor != cursor || !batches[0].Current {
+		t.Errorf("Expected a single empty current batch at %d, got %+v", cursor, batches)
+	}
+
+	stored := make(chan string, 1)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		key, _ := store.Store("http://example.com/live", LinkOptions{})
+		stored <- key
+	}()
+	batches = pollChanges(t, primary, "wait=5s&since="+strconv.FormatUint(cursor, 10))
+	live := <-stored
+	if c, ok := changedKeys(batches)[live]; !ok || batches[len(batches)-1].Cursor < c.Version {
+		t.Errorf("Expected the poll to return the live write of %s, got %+v", live, batches)
+	}
+
+	for _, query := range []string{"since=abc", "wait=abc", "wait=1h"} {
+		resp, _ := http.Get(primary.URL + CHANGES_ENDPOINT + "?" + query)
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("Expected 400 for %s, got %s", query, resp.Status)
+		}
+	}
+	memory, _ := NewMemoryURLStore()
+	rec := httptest.NewRecorder()
+	NewMainServerWithStore(memory).mux.ServeHTTP(rec, httptest.NewRequest("GET", CHANGES_ENDPOINT, nil))
+	if rec.Code != http.StatusNotImplemented {
+		t.Errorf("Expected 501 from a memory store, got %d", rec.Code)
+	}
+}
+
+// waitForQuery polls the store until fn accepts the result of querying key
+func waitForQuery(t *testing.T, store LinkStore, key string, fn func(rec LinkRecord, err error) bool) {
+	t.Helper()
+	waitFor(t, func() bool { return fn(store.Query(key)) })
+}
+
+func TestReplicationLag(t *testing.T) {
+	heartbeat := int64(CHANGES_HEARTBEAT / time.Millisecond)
+	for _, c := range []struct {
+		name                     string
+		now, lastBatch, caughtUp int64
+		want                     int64
+	}{
+		{"never applied", 1000, 0, 0, 0},
+		{"caught up and idle", 1000 + heartbeat, 1000, 1000, 0},
+		{"behind", 5000, 4000, 1000, 4000},
+		{"missed heartbeats", 1000 + 3*heartbeat, 1000, 1000, 3 * heartbeat},
+	} {
+		if lag := replicationLag(c.now, c.lastBatch, c.caughtUp); lag != c.want {
+			t.Errorf("%s: expected a lag of %d, got: %d", c.name, c.want, lag)
+		}
+	}
+}
+
+func TestReplica(t *testing.T) {
+	testDB, replicaDB := "./test_db_primary", "./test_db_replica.bolt"
+	t.Cleanup(func() {
+		os.RemoveAll(testDB)
+		os.Remove(replicaDB)
+	})
+	store, err := NewURLStore(testDB)
+	if err != nil {
+		t.Fatalf("Unable to create test store: %s", err.Error())
+	}
+	server := NewMainServerWithStore(store)
+	defer server.Close()
+	primary := httptest.NewServer(server.mux)
+	defer primary.Close()
+	primaryHost := strings.TrimPrefix(primary.URL, "http://")
+
+	first, _ := store.Store("http://example.com/1", LinkOptions{})
+	replicaStore, err := NewBoltURLStore(replicaDB)
+	if err != nil {
+		t.Fatalf("Unable to create replica store: %s", err.Error())
+	}
+	replica, err := OpenReplica(replicaStore, primaryHost)
+	if err != nil {
+		t.Fatalf("Unable to open replica: %s", err.Error())
+	}
+	found := func(urlStr string) func(LinkRecord, error) bool {
+		return func(rec LinkRecord, err error) bool { return err == nil && rec.URL == urlStr }
+	}
+	waitForQuery(t, replica, first, found("http://example.com/1"))
+
+	// writes to the replica's server go to the primary
+	replicaServer := NewMainServerWithStore(replica)
+	resp, _, err := HttpTestPostSetQueryShorten(
+		replicaServer.mux, SHORTEN_ENDPOINT, url.Values{"url": {"http://example.com/2"}},
+	)
+	if err != nil || !resp.Succeeded {
+		t.Fatalf("Expected a write to the replica to be forwarded, got %+v %v", resp, err)
+	}
+	if rec, err := store.Query(resp.Key); err != nil || rec.URL != "http://example.com/2" {
+		t.Errorf("Expected the forwarded write on the primary, got %+v %v", rec, err)
+	}
+	waitForQuery(t, replica, resp.Key, found("http://example.com/2"))
+	if err := store.Purge(first); err != nil {
+		t.Fatalf("Unable to purge key: %s", err.Error())
+	}
+	waitForQuery(t, replica, first, func(rec LinkRecord, err error) bool { return errors.Is(err, ErrLinkNotFound) })
+	if _, err := replica.Store("http://example.com", LinkOptions{}); err != ErrNotLeader {
+		t.Errorf("Expected writes to the replica store to fail with ErrNotLeader, got %v", err)
+	}
+	cursor := replica.AppliedIndex()
+	if err := replica.Close(); err != nil {
+		t.Fatalf("Unable to close replica: %s", err.Error())
+	}
+
+	// a restarted replica resumes from its cursor
+	third, _ := store.Store("http://example.com/3", LinkOptions{})
+	replicaStore, err = NewBoltURLStore(replicaDB)
+	if err != nil {
+		t.Fatalf("Unable to reopen replica store: %s", err.Error())
+	}
+	replica, err = OpenReplica(replicaStore, primaryHost)
+	if err != nil {
+		t.Fatalf("Unable to reopen replica: %s", err.Error())
+	}
+	defer replica.Close()
+	if replica.AppliedIndex() != cursor {
+		t.Errorf("Expected the replica to resume from %d, got %d", cursor, replica.AppliedIndex())
+	}
+	waitForQuery(t, replica, third, found("http://example.com/3"))
+	if err := replica.WaitForIndex(replica.AppliedIndex(), time.Second); err != nil {
+		t.Errorf("Unable to wait for an applied cursor: %s", err.Error())
+	}
+}
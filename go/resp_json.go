@@ -2,24 +2,107 @@ package shortener
 
 import (
 	"encoding/json"
+	"errors"
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"time"
+)
+
+// machine readable error codes, so that clients can tell failures apart
+// without parsing ErrorMsg
+const (
+	ERR_CODE_INVALID_URL    = "invalidUrl"
+	ERR_CODE_INVALID_ALIAS  = "invalidAlias"
+	ERR_CODE_ALIAS_IN_USE   = "aliasInUse"
+	ERR_CODE_INVALID_EXPIRY = "invalidExpiry"
+	ERR_CODE_LINK_EXPIRED   = "linkExpired"
+	ERR_CODE_KEYS_EXHAUSTED = "keySpaceExhausted"
+	ERR_CODE_LINK_NOT_FOUND = "linkNotFound"
+	ERR_CODE_LINK_DISABLED  = "linkDisabled"
+	ERR_CODE_LINK_DELETED   = "linkDeleted"
+	ERR_CODE_NOT_LEADER     = "notLeader"
+	ERR_CODE_STALE_READ     = "staleRead"
+	ERR_CODE_WRONG_SHARD    = "wrongShard"
 )
 
 type SetShortenQueryResponse struct {
 	Succeeded bool   `json:"succeeded"`
 	ErrorMsg  string `json:"errorMsg"`
+	ErrorCode string `json:"errorCode,omitempty"`
 
 	Key         string `json:"key"`
 	OriginalURL string `json:"originalURL"`
+	// unix seconds, 0 if the link never expires
+	ExpiresAt int64 `json:"expiresAt,omitempty"`
+	// raft index of a replicated write, to pass as minIndex to queries
+	// that must see it
+	Index uint64 `json:"index,omitempty"`
+}
+
+// Gone reports whether the response is for a link that existed but may
+// no longer be followed
+func (resp *SetShortenQueryResponse) Gone() bool {
+	switch resp.ErrorCode {
+	case ERR_CODE_LINK_EXPIRED, ERR_CODE_LINK_DISABLED, ERR_CODE_LINK_DELETED:
+		return true
+	}
+	return false
+}
+
+// SetExpiresAt stores expiresAt in the response as unix seconds
+func (resp *SetShortenQueryResponse) SetExpiresAt(expiresAt time.Time) {
+	resp.ExpiresAt = 0
+	if !expiresAt.IsZero() {
+		resp.ExpiresAt = expiresAt.Unix()
+	}
 }
 
 type ReserveResponse struct {
 	Succeeded bool   `json:"succeeded"`
 	ErrorMsg  string `json:"errorMsg"`
 
-	Keys []string `json:"keys"`
+	Keys  []string `json:"keys"`
+	Index uint64   `json:"index,omitempty"`
+}
+
+type ImportResponse struct {
+	Succeeded bool   `json:"succeeded"`
+	ErrorMsg  string `json:"errorMsg"`
+
+	Summary ImportSummary `json:"summary"`
+}
+
+// ErrorCode maps an error to its machine readable code, or an empty
+// string if the error has none
+func ErrorCode(err error) string {
+	switch {
+	case errors.Is(err, ErrInvalidURL):
+		return ERR_CODE_INVALID_URL
+	case errors.Is(err, ErrInvalidAlias):
+		return ERR_CODE_INVALID_ALIAS
+	case errors.Is(err, ErrAliasInUse):
+		return ERR_CODE_ALIAS_IN_USE
+	case errors.Is(err, ErrInvalidExpiry):
+		return ERR_CODE_INVALID_EXPIRY
+	case errors.Is(err, ErrLinkExpired):
+		return ERR_CODE_LINK_EXPIRED
+	case errors.Is(err, ErrKeySpaceExhausted):
+		return ERR_CODE_KEYS_EXHAUSTED
+	case errors.Is(err, ErrLinkNotFound):
+		return ERR_CODE_LINK_NOT_FOUND
+	case errors.Is(err, ErrLinkDisabled):
+		return ERR_CODE_LINK_DISABLED
+	case errors.Is(err, ErrLinkDeleted):
+		return ERR_CODE_LINK_DELETED
+	case errors.Is(err, ErrNotLeader):
+		return ERR_CODE_NOT_LEADER
+	case errors.Is(err, ErrStaleRead):
+		return ERR_CODE_STALE_READ
+	case errors.Is(err, ErrWrongShard):
+		return ERR_CODE_WRONG_SHARD
+	}
+	return ""
 }
 
 func WriteJSON(w http.ResponseWriter, data interface{}) {
@@ -2,7 +2,9 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"log"
+	"strings"
 
 	shortener "github.com/Kh4n/url-shortener-unity/go"
 )
@@ -11,14 +13,43 @@ func main() {
 	memcachedHost := flag.String(
 		"memcachedHost", "localhost:11211", "the host of the memcached instance",
 	)
+	cacheKind := flag.String(
+		"cache", "memcached",
+		"cache backend: memcached, lru for an in process cache suiting a single cache server, "+
+			"tiered for an lru in front of memcached, or redis for an lru in front of redis kept in sync over pub/sub",
+	)
+	redisHost := flag.String("redisHost", "localhost:6379", "the host of the redis instance")
+	redisPrefix := flag.String(
+		"redisPrefix", shortener.DEFAULT_REDIS_PREFIX, "prefix of every key and channel this server uses in redis",
+	)
+	lruSize := flag.Int(
+		"lruSize", shortener.DEFAULT_LRU_SIZE, "how many bytes of responses the lru and tiered caches hold in process",
+	)
 	dbServerHost := flag.String(
-		"dbServerHost", "localhost:8082", "the host of the db server",
+		"dbServerHost", "localhost:8082",
+		"the host of the db server, or a comma separated list of db server shards",
 	)
 	port := flag.Int(
 		"port", 8081, "port to run this server on",
 	)
 	reserveAmt := flag.Int(
-		"reserveAmt", 100, "the number of keys this cache server will reserve from the main server",
+		"reserveAmt", 100, "the least number of keys this cache server reserves from the main server at once. grows with shorten throughput",
+	)
+	refillWatermark := flag.Int(
+		"refillWatermark", -1,
+		"reserve more keys once this few are left. defaults to a quarter of reserveAmt",
+	)
+	trackingParams := flag.String(
+		"trackingParams", strings.Join(shortener.DEFAULT_TRACKING_PARAMS, ","),
+		"comma separated query parameters stripped from urls. a trailing * matches by prefix",
+	)
+	outboxPath := flag.String(
+		"outboxPath", "./cache-outbox.db",
+		"file queueing shortens until the db server accepts them, so they survive outages and restarts",
+	)
+	keyFile := flag.String(
+		"keyFile", "",
+		"file unused reserved keys are saved to on shutdown and loaded from on start. empty releases them to the db server instead",
 	)
 	flag.Parse()
 	if *port < 0 {
@@ -27,12 +58,51 @@ func main() {
 	if *reserveAmt <= 0 {
 		log.Fatalf("Reserve amount must be > 0")
 	}
+	if *lruSize <= 0 {
+		log.Fatalf("LRU size must be > 0")
+	}
 
-	server, err := shortener.NewCacheServer(
-		*memcachedHost, *dbServerHost, uint32(*reserveAmt),
+	cache, err := openCache(*cacheKind, *memcachedHost, *redisHost, *redisPrefix, *lruSize)
+	if err != nil {
+		log.Fatalf("Error starting cache server: %s\n", err.Error())
+	}
+	server, err := shortener.NewCacheServerWithCache(
+		cache, shortener.SplitList(*dbServerHost), uint32(*reserveAmt),
 	)
 	if err != nil {
 		log.Fatalf("Error starting cache server: %s\n", err.Error())
 	}
+	if err := server.OpenOutbox(*outboxPath); err != nil {
+		log.Fatalf("Error opening outbox: %s\n", err.Error())
+	}
+	if *keyFile != "" {
+		if err := server.OpenKeyFile(*keyFile); err != nil {
+			log.Fatalf("Error loading keys: %s\n", err.Error())
+		}
+	}
+	if *refillWatermark >= 0 {
+		server.SetRefillWatermark(*refillWatermark)
+	}
+	server.SetCanonicalizer(shortener.NewCanonicalizer(shortener.SplitList(*trackingParams)))
 	log.Fatal(server.Start(uint(*port)))
 }
+
+func openCache(kind, memcachedHost, redisHost, redisPrefix string, lruSize int) (shortener.LinkCache, error) {
+	switch kind {
+	case "memcached":
+		return shortener.NewMemcachedCache(memcachedHost)
+	case "lru":
+		return shortener.NewLRUCache(lruSize), nil
+	case "tiered":
+		shared, err := shortener.NewMemcachedCache(memcachedHost)
+		if err != nil {
+			return nil, err
+		}
+		return shortener.NewTieredCache(
+			shortener.NewLRUCache(lruSize), shared, shortener.TIERED_LOCAL_TTL,
+		), nil
+	case "redis":
+		return shortener.NewRedisCache(redisHost, redisPrefix, shortener.NewLRUCache(lruSize))
+	}
+	return nil, fmt.Errorf("unknown cache backend: %s", kind)
+}
@@ -2,23 +2,165 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"log"
+	"os"
+	"strings"
 
 	shortener "github.com/Kh4n/url-shortener-unity/go"
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "restore":
+			restore(os.Args[2:])
+			return
+		case "export":
+			export(os.Args[2:])
+			return
+		case "import":
+			importLinks(os.Args[2:])
+			return
+		case "rebalance":
+			rebalance(os.Args[2:])
+			return
+		}
+	}
 	dbPath := flag.String(
-		"dbPath", "./badger-db", "path to database",
+		"dbPath", "./badger-db", "path to database: a directory for badger, a file for bolt",
+	)
+	storage := flag.String(
+		"storage", "badger", "storage backend: badger, bolt, sqlite, or memory (links are lost on exit)",
 	)
 	port := flag.Int("port", 8082, "the port to run the server on")
+	keyGen := flag.String(
+		"keyGen", "random",
+		"how keys are generated: random, or feistel for encrypted sequential keys. "+
+			"do not switch an existing database to feistel, as it may hand out keys already in use",
+	)
+	keySecret := flag.String(
+		"keySecret", "", "the secret used to encrypt keys with -keyGen=feistel",
+	)
+	trackingParams := flag.String(
+		"trackingParams", strings.Join(shortener.DEFAULT_TRACKING_PARAMS, ","),
+		"comma separated query parameters stripped from urls. a trailing * matches by prefix",
+	)
+	gcInterval := flag.Duration(
+		"gcInterval", shortener.DEFAULT_MAINTENANCE_INTERVAL,
+		"how often to reclaim space held by expired and overwritten links, 0 to never",
+	)
+	gcDiscardRatio := flag.Float64(
+		"gcDiscardRatio", shortener.DEFAULT_GC_DISCARD_RATIO,
+		"how much of a badger value log file must be garbage before it is rewritten",
+	)
+	raftAddr := flag.String(
+		"raftAddr", "", "the address to talk to other nodes of a raft cluster on. empty runs a single node",
+	)
+	raftDir := flag.String("raftDir", "./raft", "where to keep the raft log and snapshots")
+	raftPeers := flag.String(
+		"raftPeers", "",
+		"comma separated httpAddr=raftAddr pairs of every node in the cluster, including this one",
+	)
+	raftBootstrap := flag.Bool(
+		"raftBootstrap", false, "form a new cluster from -raftPeers, unless this node already has raft state",
+	)
+	advertise := flag.String(
+		"advertise", "", "the host:port other nodes reach this node's http api on, which is its raft ID",
+	)
+	shards := flag.String(
+		"shards", "", "comma separated hosts of every db server shard, as cache servers list them. empty holds every key",
+	)
+	shard := flag.String("shard", "", "which of -shards this server is")
+	replicaOf := flag.String(
+		"replicaOf", "", "the host of a badger db server to keep a read only copy of. writes are forwarded to it",
+	)
 	flag.Parse()
 	if *port < 0 {
 		log.Fatalf("Port must be >= 0")
 	}
-	server, err := shortener.NewMainServer(*dbPath)
+	if *raftAddr != "" && *replicaOf != "" {
+		log.Fatalf("-replicaOf cannot be used with -raftAddr")
+	}
+	if *raftAddr != "" && *keyGen == "feistel" {
+		// the feistel counter is not replicated, so a new leader would
+		// hand out keys the old one already used
+		log.Fatalf("-keyGen=feistel cannot be used with -raftAddr")
+	}
+	store, err := openStore(*storage, *dbPath)
+	if err != nil {
+		log.Fatalf("Error starting server: %s\n", err.Error())
+	}
+	err = store.SetMaintenance(shortener.MaintenanceOptions{
+		Interval: *gcInterval, DiscardRatio: *gcDiscardRatio,
+	})
 	if err != nil {
 		log.Fatalf("Error starting server: %s\n", err.Error())
 	}
+	if *shards != "" {
+		ring, err := shortener.NewRendezvous(shortener.SplitList(*shards))
+		if err != nil {
+			log.Fatalf("Error starting server: %s\n", err.Error())
+		}
+		owned := false
+		for _, host := range ring.Hosts() {
+			owned = owned || host == *shard
+		}
+		if !owned {
+			log.Fatalf("-shard must be one of -shards")
+		}
+		store.SetKeyFilter(ring.OwnedBy(*shard))
+	}
+	switch *keyGen {
+	case "random":
+	case "feistel":
+		counter, err := store.Sequence("feistel")
+		if err != nil {
+			log.Fatalf("Error starting server: %s\n", err.Error())
+		}
+		gen, err := shortener.NewFeistelKeyGenerator([]byte(*keySecret), counter)
+		if err != nil {
+			log.Fatalf("Error starting server: %s\n", err.Error())
+		}
+		store.SetKeyGenerator(gen)
+	default:
+		log.Fatalf("Unknown key generator: %s", *keyGen)
+	}
+	var linkStore shortener.LinkStore = store
+	if *replicaOf != "" {
+		linkStore, err = shortener.OpenReplica(store, *replicaOf)
+		if err != nil {
+			log.Fatalf("Error starting replica: %s\n", err.Error())
+		}
+	}
+	if *raftAddr != "" {
+		peers, err := shortener.ParseRaftPeers(*raftPeers)
+		if err != nil {
+			log.Fatalf("Error starting server: %s\n", err.Error())
+		}
+		if *advertise == "" {
+			log.Fatalf("-advertise is required with -raftAddr")
+		}
+		linkStore, err = shortener.OpenRaftStore(store, *advertise, *raftAddr, *raftDir, *raftBootstrap, peers)
+		if err != nil {
+			log.Fatalf("Error starting raft: %s\n", err.Error())
+		}
+	}
+	server := shortener.NewMainServerWithStore(linkStore)
+	server.SetCanonicalizer(shortener.NewCanonicalizer(shortener.SplitList(*trackingParams)))
 	log.Fatal(server.Start(uint(*port)))
 }
+
+func openStore(storage, dbPath string) (*shortener.URLStore, error) {
+	switch storage {
+	case "badger":
+		return shortener.NewURLStore(dbPath)
+	case "bolt":
+		return shortener.NewBoltURLStore(dbPath)
+	case "sqlite":
+		return shortener.NewSQLiteURLStore(dbPath)
+	case "memory":
+		return shortener.NewMemoryURLStore()
+	}
+	return nil, fmt.Errorf("unknown storage backend: %s", storage)
+}
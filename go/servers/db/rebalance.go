@@ -0,0 +1,46 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"log"
+	"net/http"
+	"os"
+
+	shortener "github.com/Kh4n/url-shortener-unity/go"
+)
+
+// rebalance moves links between running db servers after shards were
+// added or removed
+func rebalance(args []string) {
+	flags := flag.NewFlagSet("rebalance", flag.ExitOnError)
+	shards := flags.String("shards", "", "comma separated hosts of every shard, after the change")
+	from := flags.String(
+		"from", "", "comma separated hosts of the shards to move links off, usually the shards before the change. defaults to -shards",
+	)
+	dryRun := flags.Bool("dryRun", false, "only count the links that would move")
+	flags.Usage = func() {
+		log.Printf("Usage: %s rebalance -shards hosts [-from hosts] [-dryRun]\n", os.Args[0])
+		log.Println("Moves every link to the shard that owns it")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() > 0 || *shards == "" {
+		flags.Usage()
+		os.Exit(2)
+	}
+	ring, err := shortener.NewRendezvous(shortener.SplitList(*shards))
+	if err != nil {
+		log.Fatalf("Error parsing shards: %s\n", err.Error())
+	}
+	sources := ring.Hosts()
+	if *from != "" {
+		sources = shortener.SplitList(*from)
+	}
+	summary, err := shortener.Rebalance(&http.Client{}, ring, sources, *dryRun)
+	raw, _ := json.MarshalIndent(summary, "", "  ")
+	os.Stdout.Write(append(raw, '\n'))
+	if err != nil {
+		log.Fatalf("Error rebalancing: %s\n", err.Error())
+	}
+}
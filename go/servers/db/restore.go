@@ -0,0 +1,47 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"log"
+	"os"
+
+	shortener "github.com/Kh4n/url-shortener-unity/go"
+)
+
+// restore loads backups taken from /admin/backup into a fresh badger
+// directory: db restore -dbPath <dir> <full backup> [incremental backups...]
+func restore(args []string) {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	dbPath := flags.String(
+		"dbPath", "./badger-db", "the directory to restore into. it must not exist or be empty",
+	)
+	flags.Usage = func() {
+		log.Printf("Usage: %s restore [-dbPath dir] <full backup> [incremental backups...]\n", os.Args[0])
+		log.Println("Backups are loaded in order. Use - to read a backup from stdin")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	backups := make([]io.Reader, 0, flags.NArg())
+	for _, name := range flags.Args() {
+		if name == "-" {
+			backups = append(backups, os.Stdin)
+			continue
+		}
+		f, err := os.Open(name)
+		if err != nil {
+			log.Fatalf("Error opening backup: %s\n", err.Error())
+		}
+		defer f.Close()
+		backups = append(backups, f)
+	}
+	if err := shortener.RestoreBackup(*dbPath, backups...); err != nil {
+		log.Fatalf("Error restoring backup: %s\n", err.Error())
+	}
+	log.Printf("Restored %d backups into %s\n", len(backups), *dbPath)
+}
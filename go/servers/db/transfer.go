@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io"
+	"log"
+	"os"
+
+	shortener "github.com/Kh4n/url-shortener-unity/go"
+)
+
+// transferFlags parses the flags shared by export and import. The store
+// is opened directly, so the server must not be running on it
+func transferFlags(name, usage string, args []string) (store *shortener.URLStore, format, file string) {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	dbPath := flags.String("dbPath", "./badger-db", "path to database: a directory for badger, a file for bolt")
+	storage := flags.String("storage", "badger", "storage backend: badger, bolt, or sqlite")
+	formatFlag := flags.String("format", shortener.TRANSFER_FORMAT_JSONL, "jsonl, or csv (drops hit counters)")
+	flags.Usage = func() {
+		log.Printf("Usage: %s %s [flags] [file]\n", os.Args[0], name)
+		log.Println(usage)
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() > 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	store, err := openStore(*storage, *dbPath)
+	if err != nil {
+		log.Fatalf("Error opening store: %s\n", err.Error())
+	}
+	return store, *formatFlag, flags.Arg(0)
+}
+
+func export(args []string) {
+	store, format, file := transferFlags(
+		"export", "Writes every link to file, or stdout if it is omitted or -", args,
+	)
+	defer store.Close()
+	var w io.Writer = os.Stdout
+	if file != "" && file != "-" {
+		f, err := os.Create(file)
+		if err != nil {
+			log.Fatalf("Error creating export: %s\n", err.Error())
+		}
+		defer f.Close()
+		w = f
+	}
+	count, err := shortener.ExportLinks(store, w, format)
+	if err != nil {
+		store.Close()
+		log.Fatalf("Error exporting links: %s\n", err.Error())
+	}
+	log.Printf("Exported %d links\n", count)
+}
+
+func importLinks(args []string) {
+	store, format, file := transferFlags(
+		"import", "Imports links from file, or stdin if it is omitted or -, keeping their keys", args,
+	)
+	defer store.Close()
+	var r io.Reader = os.Stdin
+	if file != "" && file != "-" {
+		f, err := os.Open(file)
+		if err != nil {
+			log.Fatalf("Error opening import: %s\n", err.Error())
+		}
+		defer f.Close()
+		r = f
+	}
+	summary, err := shortener.ImportLinks(store, r, format)
+	raw, _ := json.MarshalIndent(summary, "", "  ")
+	os.Stdout.Write(append(raw, '\n'))
+	if err != nil {
+		store.Close()
+		log.Fatalf("Error importing links: %s\n", err.Error())
+	}
+}
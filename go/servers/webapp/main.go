@@ -13,13 +13,13 @@ func main() {
 		log.Fatalf("Port must be >= 0")
 	}
 	backendServerHost := flag.String(
-		"backendServerHost", "localhost:8081", "the host of the backend server (cache or db)",
+		"backendServerHost", "localhost:8081", "the host of the backend server (cache or db), or a comma separated list of them",
 	)
 	webDir := flag.String(
 		"webDir", "./web", "location of web directory",
 	)
 	flag.Parse()
-	server, err := shortener.NewWebappServer(*webDir, *backendServerHost)
+	server, err := shortener.NewShardedWebappServer(*webDir, shortener.SplitList(*backendServerHost))
 	if err != nil {
 		log.Fatalf("Error starting server: %s\n", err.Error())
 	}
@@ -0,0 +1,405 @@
+package shortener
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	TRANSFER_FORMAT_JSONL = "jsonl"
+	TRANSFER_FORMAT_CSV   = "csv"
+
+	// the trailer an export response reports its number of links in, so
+	// that clients can tell a complete export from a truncated one
+	EXPORT_COUNT_TRAILER = "X-Export-Count"
+
+	// import summaries only list this many conflicting keys and errors
+	MAX_IMPORT_REPORTED = 100
+	// a line holds a record along with its whole history
+	MAX_TRANSFER_LINE_LEN = (MAX_LINK_HISTORY + 2) * 2 * MAX_URL_LEN
+)
+
+// columns of a csv export. csv exports drop the hit counter, use jsonl to
+// move links without losing anything
+var CSV_TRANSFER_HEADER = []string{
+	"key", "url", "createdAt", "expiresAt", "creator", "reserved", "disabled", "deleted", "history",
+}
+
+// ExportedLink is a link along with its key, as written by ExportLinks
+type ExportedLink struct {
+	Key string `json:"key"`
+	// duplicates the reserved flag, for readers that do not decode flags
+	Reserved bool `json:"reserved"`
+	LinkRecord
+}
+
+// record returns the link's record with the reserved flag applied
+func (link ExportedLink) record() LinkRecord {
+	rec := link.LinkRecord
+	if link.Reserved {
+		rec.Flags |= LINK_FLAG_RESERVED
+	}
+	return rec
+}
+
+// ImportSummary reports what ImportLinks did with every link it read
+type ImportSummary struct {
+	Imported int `json:"imported"`
+	// the key already held the same link
+	Unchanged int `json:"unchanged"`
+	// reserved keys, which only mean something to the exporting store
+	Skipped   int `json:"skipped"`
+	Conflicts int `json:"conflicts"`
+	Failed    int `json:"failed"`
+
+	ConflictKeys []string `json:"conflictKeys,omitempty"`
+	Errors       []string `json:"errors,omitempty"`
+}
+
+func (s *ImportSummary) conflict(key string) {
+	s.Conflicts++
+	if len(s.ConflictKeys) < MAX_IMPORT_REPORTED {
+		s.ConflictKeys = append(s.ConflictKeys, key)
+	}
+}
+
+func (s *ImportSummary) fail(pos string, err error) {
+	s.Failed++
+	if len(s.Errors) < MAX_IMPORT_REPORTED {
+		s.Errors = append(s.Errors, fmt.Sprintf("%s: %s", pos, err.Error()))
+	}
+}
+
+// ExportLinks writes every link in the store to w in format, including
+// reserved keys and tombstones, and returns how many it wrote
+func ExportLinks(store LinkStore, w io.Writer, format string) (int, error) {
+	enc, err := newLinkEncoder(w, format)
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	err = store.Iterate(func(key string, rec LinkRecord) error {
+		count++
+		return enc.encode(ExportedLink{Key: key, Reserved: rec.Reserved(), LinkRecord: rec})
+	})
+	if err != nil {
+		return count, err
+	}
+	return count, enc.flush()
+}
+
+// ImportLinks imports links written by ExportLinks, keeping their keys.
+// Malformed lines, conflicts and links the store rejects are counted in
+// the summary without stopping the import. The error is only set if
+// reading r fails
+func ImportLinks(store LinkStore, r io.Reader, format string) (ImportSummary, error) {
+	var summary ImportSummary
+	dec, err := newLinkDecoder(r, format)
+	if err != nil {
+		return summary, err
+	}
+	for {
+		link, err := dec.decode()
+		if err == io.EOF {
+			return summary, nil
+		}
+		var bad badLinkError
+		if errors.As(err, &bad) {
+			summary.fail(dec.pos(), bad.err)
+			continue
+		} else if err != nil {
+			return summary, err
+		}
+
+		rec := link.record()
+		if rec.Reserved() {
+			summary.Skipped++
+			continue
+		}
+		imported, err := store.Import(link.Key, rec)
+		switch {
+		case errors.Is(err, ErrImportConflict):
+			summary.conflict(link.Key)
+		case err != nil:
+			summary.fail(dec.pos(), err)
+		case imported:
+			summary.Imported++
+		default:
+			summary.Unchanged++
+		}
+	}
+}
+
+// badLinkError wraps a malformed link, which does not stop an import
+type badLinkError struct {
+	err error
+}
+
+func (e badLinkError) Error() string {
+	return e.err.Error()
+}
+
+type linkEncoder interface {
+	encode(link ExportedLink) error
+	flush() error
+}
+
+type linkDecoder interface {
+	// decode returns io.EOF once every link has been read
+	decode() (ExportedLink, error)
+	// pos is where the last decoded link was, for errors
+	pos() string
+}
+
+func newLinkEncoder(w io.Writer, format string) (linkEncoder, error) {
+	switch format {
+	case TRANSFER_FORMAT_JSONL:
+		buf := bufio.NewWriter(w)
+		return &jsonlEncoder{buf: buf, enc: json.NewEncoder(buf)}, nil
+	case TRANSFER_FORMAT_CSV:
+		return &csvEncoder{w: csv.NewWriter(w)}, nil
+	}
+	return nil, fmt.Errorf("unknown format: %s", format)
+}
+
+func newLinkDecoder(r io.Reader, format string) (linkDecoder, error) {
+	switch format {
+	case TRANSFER_FORMAT_JSONL:
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(nil, MAX_TRANSFER_LINE_LEN)
+		return &jsonlDecoder{scanner: scanner}, nil
+	case TRANSFER_FORMAT_CSV:
+		cr := csv.NewReader(r)
+		cr.FieldsPerRecord = len(CSV_TRANSFER_HEADER)
+		cr.ReuseRecord = true
+		return &csvDecoder{r: cr}, nil
+	}
+	return nil, fmt.Errorf("unknown format: %s", format)
+}
+
+type jsonlEncoder struct {
+	buf *bufio.Writer
+	enc *json.Encoder
+}
+
+func (e *jsonlEncoder) encode(link ExportedLink) error {
+	return e.enc.Encode(link)
+}
+
+func (e *jsonlEncoder) flush() error {
+	return e.buf.Flush()
+}
+
+type jsonlDecoder struct {
+	scanner *bufio.Scanner
+	lines   int
+}
+
+func (d *jsonlDecoder) decode() (ExportedLink, error) {
+	for d.scanner.Scan() {
+		d.lines++
+		if len(d.scanner.Bytes()) == 0 {
+			continue
+		}
+		var link ExportedLink
+		if err := json.Unmarshal(d.scanner.Bytes(), &link); err != nil {
+			return ExportedLink{}, badLinkError{err}
+		}
+		return link, nil
+	}
+	if err := d.scanner.Err(); err != nil {
+		return ExportedLink{}, err
+	}
+	return ExportedLink{}, io.EOF
+}
+
+func (d *jsonlDecoder) pos() string {
+	return fmt.Sprintf("line %d", d.lines)
+}
+
+type csvEncoder struct {
+	w           *csv.Writer
+	wroteHeader bool
+	row         []string
+}
+
+// csvTime formats unix seconds as RFC 3339, leaving 0 empty
+func csvTime(t int64) string {
+	if t == 0 {
+		return ""
+	}
+	return time.Unix(t, 0).UTC().Format(time.RFC3339)
+}
+
+func parseCSVTime(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	return t.Unix(), err
+}
+
+func (e *csvEncoder) encode(link ExportedLink) error {
+	if !e.wroteHeader {
+		if err := e.w.Write(CSV_TRANSFER_HEADER); err != nil {
+			return err
+		}
+		e.wroteHeader = true
+	}
+	history := ""
+	if len(link.History) > 0 {
+		raw, _ := json.Marshal(link.History)
+		history = string(raw)
+	}
+	e.row = append(e.row[:0],
+		link.Key, link.URL, csvTime(link.CreatedAt), csvTime(link.ExpiresAt), link.Creator,
+		strconv.FormatBool(link.Reserved), strconv.FormatBool(link.Disabled()),
+		strconv.FormatBool(link.Deleted()), history,
+	)
+	return e.w.Write(e.row)
+}
+
+func (e *csvEncoder) flush() error {
+	if !e.wroteHeader {
+		if err := e.w.Write(CSV_TRANSFER_HEADER); err != nil {
+			return err
+		}
+	}
+	e.w.Flush()
+	return e.w.Error()
+}
+
+type csvDecoder struct {
+	r          *csv.Reader
+	readHeader bool
+	// quoted fields may span lines, so links are counted by record, the
+	// header not included
+	records int
+}
+
+func (d *csvDecoder) decode() (ExportedLink, error) {
+	if !d.readHeader {
+		header, err := d.r.Read()
+		if err != nil {
+			return ExportedLink{}, err
+		}
+		for i, col := range CSV_TRANSFER_HEADER {
+			if header[i] != col {
+				return ExportedLink{}, fmt.Errorf("unexpected csv header: %v", header)
+			}
+		}
+		d.readHeader = true
+	}
+	row, err := d.r.Read()
+	if err != io.EOF {
+		d.records++
+	}
+	var parseErr *csv.ParseError
+	if errors.As(err, &parseErr) {
+		return ExportedLink{}, badLinkError{err}
+	} else if err != nil {
+		return ExportedLink{}, err
+	}
+
+	link, err := parseCSVLink(row)
+	if err != nil {
+		return ExportedLink{}, badLinkError{err}
+	}
+	return link, nil
+}
+
+func parseCSVLink(row []string) (ExportedLink, error) {
+	link := ExportedLink{Key: row[0]}
+	link.URL = row[1]
+	link.Creator = row[4]
+	var err error
+	if link.CreatedAt, err = parseCSVTime(row[2]); err != nil {
+		return ExportedLink{}, err
+	}
+	if link.ExpiresAt, err = parseCSVTime(row[3]); err != nil {
+		return ExportedLink{}, err
+	}
+	flags := []uint32{LINK_FLAG_RESERVED, LINK_FLAG_DISABLED, LINK_FLAG_DELETED}
+	for i, flag := range flags {
+		set, err := strconv.ParseBool(row[5+i])
+		if err != nil {
+			return ExportedLink{}, err
+		}
+		if set {
+			link.Flags |= flag
+		}
+	}
+	link.Reserved = link.LinkRecord.Reserved()
+	if row[8] != "" {
+		if err := json.Unmarshal([]byte(row[8]), &link.History); err != nil {
+			return ExportedLink{}, err
+		}
+	}
+	return link, nil
+}
+
+func (d *csvDecoder) pos() string {
+	return fmt.Sprintf("record %d", d.records)
+}
+
+// transferFormat reads the format query parameter, defaulting to jsonl
+func transferFormat(r *http.Request) (string, bool) {
+	format := r.URL.Query().Get("format")
+	switch format {
+	case "":
+		return TRANSFER_FORMAT_JSONL, true
+	case TRANSFER_FORMAT_JSONL, TRANSFER_FORMAT_CSV:
+		return format, true
+	}
+	return "", false
+}
+
+func (ms *MainServer) export(w http.ResponseWriter, r *http.Request) {
+	format, ok := transferFormat(r)
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("400 - Bad Request"))
+		return
+	}
+	if format == TRANSFER_FORMAT_CSV {
+		w.Header().Set("Content-Type", "text/csv")
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	}
+	w.Header().Set("Content-Disposition", "attachment; filename=links."+format)
+	w.Header().Set("Trailer", EXPORT_COUNT_TRAILER)
+	count, err := ExportLinks(ms.store, w, format)
+	if err != nil {
+		log.Printf("Error streaming export: %s\n", err.Error())
+		return
+	}
+	w.Header().Set(EXPORT_COUNT_TRAILER, strconv.Itoa(count))
+}
+
+// importLinks reads an export from the request body, rather than a form
+func (ms *MainServer) importLinks(w http.ResponseWriter, r *http.Request) {
+	format, ok := transferFormat(r)
+	if r.Method != http.MethodPost || !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("400 - Bad Request"))
+		return
+	}
+	resp := ImportResponse{}
+	summary, err := ImportLinks(ms.store, r.Body, format)
+	resp.Summary = summary
+	if err != nil {
+		resp.Succeeded = false
+		resp.ErrorMsg = err.Error()
+	} else {
+		resp.Succeeded = true
+	}
+	WriteJSON(w, resp)
+}
@@ -0,0 +1,157 @@
+package shortener
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func transferTestStore(t *testing.T) (*URLStore, map[string]LinkRecord) {
+	store, err := NewMemoryURLStore()
+	if err != nil {
+		t.Fatalf("Unable to create test store: %s", err.Error())
+	}
+	expiry := time.Now().Add(time.Hour)
+	keys := []string{}
+	for _, opts := range []LinkOptions{{}, {Creator: "tester", ExpiresAt: expiry}, {}, {}} {
+		key, err := store.Store("http://example.com/"+opts.Creator, opts)
+		if err != nil {
+			t.Fatalf("Unable to store url: %s", err.Error())
+		}
+		keys = append(keys, key)
+	}
+	if err := store.Update(keys[0], "http://example.com/updated"); err != nil {
+		t.Fatalf("Unable to update link: %s", err.Error())
+	}
+	if err := store.Disable(keys[2], true); err != nil {
+		t.Fatalf("Unable to disable link: %s", err.Error())
+	}
+	if err := store.Delete(keys[3]); err != nil {
+		t.Fatalf("Unable to delete link: %s", err.Error())
+	}
+	if _, err := store.Reserve(1); err != nil {
+		t.Fatalf("Unable to reserve key: %s", err.Error())
+	}
+
+	links := map[string]LinkRecord{}
+	store.Iterate(func(key string, rec LinkRecord) error {
+		if !rec.Reserved() {
+			links[key] = rec
+		}
+		return nil
+	})
+	return store, links
+}
+
+func TestTransferRoundTrip(t *testing.T) {
+	for _, format := range []string{TRANSFER_FORMAT_JSONL, TRANSFER_FORMAT_CSV} {
+		src, links := transferTestStore(t)
+		var buf bytes.Buffer
+		count, err := ExportLinks(src, &buf, format)
+		if err != nil || count != 5 {
+			t.Fatalf("%s: expected 5 exported links, got: %d, %v", format, count, err)
+		}
+		export := buf.String()
+
+		dst, _ := NewMemoryURLStore()
+		summary, err := ImportLinks(dst, strings.NewReader(export), format)
+		if err != nil {
+			t.Fatalf("%s: unable to import: %s", format, err.Error())
+		}
+		CheckJSONResponse(t, summary, ImportSummary{Imported: 4, Skipped: 1})
+		for key, rec := range links {
+			var got LinkRecord
+			dst.db.View(func(txn kvTxn) error {
+				v, err := txn.Get([]byte(key))
+				if err == nil {
+					got, err = readRecord(v)
+				}
+				return err
+			})
+			if !reflect.DeepEqual(got, rec) {
+				t.Errorf("%s: expected %+v to be imported, got: %+v", format, rec, got)
+			}
+		}
+
+		summary, err = ImportLinks(dst, strings.NewReader(export), format)
+		if err != nil {
+			t.Fatalf("%s: unable to import: %s", format, err.Error())
+		}
+		CheckJSONResponse(t, summary, ImportSummary{Unchanged: 4, Skipped: 1})
+	}
+}
+
+func TestImportConflicts(t *testing.T) {
+	dst, _ := NewMemoryURLStore()
+	if err := dst.StoreAlias("taken", "http://example.com/mine", LinkOptions{}); err != nil {
+		t.Fatalf("Unable to store alias: %s", err.Error())
+	}
+	lines := strings.Join([]string{
+		`{"key":"taken","url":"http://example.com/theirs"}`,
+		`not json`,
+		`{"key":"bad key","url":"http://example.com"}`,
+		`{"key":"fresh","url":"http://example.com/fresh"}`,
+	}, "\n")
+	summary, err := ImportLinks(dst, strings.NewReader(lines), TRANSFER_FORMAT_JSONL)
+	if err != nil {
+		t.Fatalf("Unable to import: %s", err.Error())
+	}
+	if summary.Imported != 1 || summary.Conflicts != 1 || summary.Failed != 2 {
+		t.Errorf("Unexpected summary: %+v", summary)
+	}
+	CheckJSONResponse(t, summary.ConflictKeys, []string{"taken"})
+	if rec, err := dst.Query("taken"); err != nil || rec.URL != "http://example.com/mine" {
+		t.Errorf("Expected conflicting link to be kept, got: %+v, %v", rec, err)
+	}
+
+	// an empty history is the same as none
+	summary, err = ImportLinks(
+		dst, strings.NewReader(`{"key":"fresh","url":"http://example.com/fresh","history":[]}`), TRANSFER_FORMAT_JSONL,
+	)
+	if err != nil || summary.Unchanged != 1 {
+		t.Errorf("Expected the link to be unchanged, got: %+v, %v", summary, err)
+	}
+
+	// errors point at the record, as fields may span lines
+	rows := strings.Join(CSV_TRANSFER_HEADER, ",") + "\n" +
+		"multi,http://example.com/multi,,,\"two\nlines\",false,false,false,\n" +
+		"broken,http://example.com,yesterday,,,false,false,false,\n"
+	summary, err = ImportLinks(dst, strings.NewReader(rows), TRANSFER_FORMAT_CSV)
+	if err != nil {
+		t.Fatalf("Unable to import: %s", err.Error())
+	}
+	if summary.Imported != 1 || len(summary.Errors) != 1 || !strings.HasPrefix(summary.Errors[0], "record 2:") {
+		t.Errorf("Expected the second record to fail, got: %+v", summary)
+	}
+
+	if _, err := ImportLinks(dst, strings.NewReader("a,b\n"), TRANSFER_FORMAT_CSV); err == nil {
+		t.Errorf("Expected an error for a bad csv header")
+	}
+}
+
+func TestMainServerExportImport(t *testing.T) {
+	src, _ := transferTestStore(t)
+	server := NewMainServerWithStore(src)
+	defer server.Close()
+	rec := RecordGet(server.mux, EXPORT_ENDPOINT+"?format=csv", nil)
+	if rec.Code != 200 || rec.Result().Trailer.Get(EXPORT_COUNT_TRAILER) != "5" {
+		t.Fatalf("Expected an export of 5 links, got status %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec := RecordGet(server.mux, EXPORT_ENDPOINT+"?format=xml", nil); rec.Code != 400 {
+		t.Errorf("Expected status 400 for an unknown format, got: %d", rec.Code)
+	}
+
+	dst, _ := NewMemoryURLStore()
+	importer := NewMainServerWithStore(dst)
+	defer importer.Close()
+	req := httptest.NewRequest("POST", IMPORT_ENDPOINT+"?format=csv", rec.Body)
+	resp := httptest.NewRecorder()
+	importer.mux.ServeHTTP(resp, req)
+	var jsonResp ImportResponse
+	json.Unmarshal(resp.Body.Bytes(), &jsonResp)
+	CheckJSONResponse(t, jsonResp, ImportResponse{Succeeded: true, Summary: ImportSummary{Imported: 4, Skipped: 1}})
+}
@@ -1,12 +1,14 @@
 package shortener
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
-	"math/rand"
 	"net/url"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
-
-	"github.com/dgraph-io/badger"
 )
 
 // go does not support constant arrays. this should never be modified
@@ -23,18 +25,55 @@ var base62Lut = []byte{
 }
 
 const (
-	MAX_URL_LEN          = 1 << 13
-	MAX_RESERVE_NUM      = 1 << MAX_RESERVE_NUM_BITS
-	MAX_RESERVE_NUM_BITS = 16
-	MAX_KEY_NUM          = 3_521_614_606_208 // 62^7
+	MAX_URL_LEN     = 1 << 13
+	MAX_RESERVE_NUM = 1 << 16
+	MAX_KEY_NUM     = 3_521_614_606_208 // 62^7
+	KEY_LEN         = 7
+
+	MIN_ALIAS_LEN = 3
+	MAX_ALIAS_LEN = 64
 
 	// caches have an 8 hour margin to be safe
 	RESERVE_EXPIRY       = time.Hour * 24
 	CACHE_RESERVE_EXPIRY = time.Hour * 16
+
+	// expired links are kept for a while past their expiry so that
+	// queries can report them as expired rather than missing
+	EXPIRED_LINK_RETENTION = time.Hour * 24 * 30
+
+	// store bookkeeping lives under a prefix no valid key can start with
+	META_PREFIX  = "!meta/"
+	META_KEY_LEN = META_PREFIX + "keyLen"
+
+	// how many counter values a sequence leases at a time. unused values
+	// are lost on a crash, which only costs key space
+	SEQUENCE_BANDWIDTH = 1000
 )
 
-func genKey() uint64 {
-	return uint64(rand.Int63n(MAX_KEY_NUM))
+var (
+	ErrInvalidAlias   = errors.New("invalid alias")
+	ErrAliasInUse     = errors.New("alias already in use")
+	ErrInvalidExpiry  = errors.New("invalid expiry")
+	ErrLinkExpired    = errors.New("link expired")
+	ErrLinkNotFound   = errors.New("link not found")
+	ErrLinkDisabled   = errors.New("link disabled")
+	ErrLinkDeleted    = errors.New("link deleted")
+	ErrImportConflict = errors.New("key already in use by a different link")
+	ErrWrongShard     = errors.New("key belongs to another shard")
+
+	errKeyTaken = errors.New("key taken since it was picked")
+)
+
+// aliases that would shadow paths served by the webapp or that we may
+// want to route ourselves in the future. compared case insensitively
+var reservedAliases = map[string]bool{
+	"api":    true,
+	"admin":  true,
+	"js":     true,
+	"web":    true,
+	"static": true,
+	"index":  true,
+	"health": true,
 }
 
 // encodes ret with num coverted to a base62 number in reverse
@@ -48,37 +87,247 @@ func base62Encode(num uint64, ret *[]byte) {
 	*ret = append(*ret, base62Lut[num])
 }
 
+// LinkOptions holds the optional settings of a stored link
+type LinkOptions struct {
+	// zero means the link never expires
+	ExpiresAt time.Time
+	Creator   string
+	// reuse the key of an existing permanent link to the same url
+	Dedupe bool
+}
+
+// record builds the record for a newly created link
+func (opts LinkOptions) record(urlStr string) LinkRecord {
+	rec := LinkRecord{
+		URL:       urlStr,
+		CreatedAt: time.Now().Unix(),
+		Creator:   opts.Creator,
+	}
+	if !opts.ExpiresAt.IsZero() {
+		rec.ExpiresAt = opts.ExpiresAt.Unix()
+	}
+	return rec
+}
+
+// writeRecord stores a record. expiring links get a TTL past their
+// expiry so that the engine eventually reclaims them
+func writeRecord(txn kvTxn, key []byte, rec LinkRecord) error {
+	var expiresAt uint64
+	if rec.ExpiresAt != 0 {
+		expiresAt = uint64(rec.Expiry().Add(EXPIRED_LINK_RETENTION).Unix())
+	}
+	return txn.Set(key, rec.Encode(), expiresAt)
+}
+
+// readRecord decodes a stored record. legacy values kept their expiry
+// only in the TTL, so it is recovered from there
+func readRecord(val kvValue) (LinkRecord, error) {
+	rec, err := DecodeLinkRecord(val.Value)
+	if err == nil && len(val.Value) > 0 && val.Value[0] != LINK_RECORD_VERSION &&
+		!rec.Reserved() && val.ExpiresAt != 0 {
+		rec.ExpiresAt = int64(val.ExpiresAt) - int64(EXPIRED_LINK_RETENTION/time.Second)
+	}
+	return rec, err
+}
+
+// ParseExpiry parses an expiry given either as a duration from now
+// (eg. "72h") or as an absolute RFC 3339 time. An empty string means
+// the link never expires
+func ParseExpiry(s string, now time.Time) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	var expiresAt time.Time
+	if d, err := time.ParseDuration(s); err == nil {
+		expiresAt = now.Add(d)
+	} else if expiresAt, err = time.Parse(time.RFC3339, s); err != nil {
+		return time.Time{}, fmt.Errorf("%w: %s", ErrInvalidExpiry, s)
+	}
+	if !expiresAt.After(now) {
+		return time.Time{}, fmt.Errorf("%w: %s is in the past", ErrInvalidExpiry, s)
+	}
+	return expiresAt, nil
+}
+
+// URLStore implements LinkStore on top of a key value engine
 type URLStore struct {
-	db *badger.DB
+	db    kvEngine
+	alloc *keyAllocator
+
+	maint     *maintenanceLoop
+	maintLock sync.Mutex
+}
+
+// NewURLStore opens a store backed by badger, in the directory at path
+func NewURLStore(path string) (*URLStore, error) {
+	db, err := openBadgerEngine(path)
+	if err != nil {
+		return nil, err
+	}
+	return newURLStore(db)
+}
+
+// NewBoltURLStore opens a store backed by bbolt, in the file at path
+func NewBoltURLStore(path string) (*URLStore, error) {
+	db, err := openBoltEngine(path)
+	if err != nil {
+		return nil, err
+	}
+	return newURLStore(db)
+}
+
+// NewSQLiteURLStore opens a store backed by the SQLite database at path,
+// which can be queried with plain SQL while the server runs
+func NewSQLiteURLStore(path string) (*URLStore, error) {
+	db, err := openSQLiteEngine(path)
+	if err != nil {
+		return nil, err
+	}
+	return newURLStore(db)
+}
+
+// NewMemoryURLStore creates a store that only lives in memory
+func NewMemoryURLStore() (*URLStore, error) {
+	return newURLStore(newMemoryEngine())
 }
 
-func NewURLStore(path string) (ret *URLStore, err error) {
-	ret = new(URLStore)
-	ret.db, err = badger.Open(badger.DefaultOptions(path).WithTruncate(true))
+func newURLStore(db kvEngine) (*URLStore, error) {
+	ret := &URLStore{db: db}
+	keyLen, err := ret.readKeyLen()
 	if err != nil {
+		db.Close()
 		return nil, err
 	}
+	ret.alloc = newKeyAllocator(CryptoKeyGenerator{}, keyLen, ret.raiseKeyLen)
+	ret.maint = startMaintenance(db, DefaultMaintenanceOptions())
 	return ret, nil
 }
 
+// readKeyLen reads the length keys have grown to, KEY_LEN if they never grew
+func (store *URLStore) readKeyLen() (int, error) {
+	var keyLen int
+	err := store.db.View(func(txn kvTxn) error {
+		var err error
+		keyLen, err = storedKeyLen(txn)
+		return err
+	})
+	return keyLen, err
+}
+
+func storedKeyLen(txn kvTxn) (int, error) {
+	v, err := txn.Get([]byte(META_KEY_LEN))
+	if err == errKeyNotFound {
+		return KEY_LEN, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(string(v.Value))
+}
+
+// raiseKeyLen writes keyLen in txn if it is longer than the stored key
+// length, so that keys grow atomically with the first key that needed it.
+// txn is nil for keys picked without writing them, which carry the length
+// to wherever they are written instead
+func (store *URLStore) raiseKeyLen(txn kvTxn, keyLen int) error {
+	if txn == nil || keyLen <= KEY_LEN {
+		return nil
+	}
+	stored, err := storedKeyLen(txn)
+	if err != nil {
+		return err
+	} else if keyLen <= stored {
+		return nil
+	}
+	// keys picked by another node grow this one's as well
+	store.alloc.raise(keyLen)
+	return txn.Set([]byte(META_KEY_LEN), []byte(strconv.Itoa(keyLen)), 0)
+}
+
+// getAt reads key as of now, as raft nodes keep entries past their
+// expiry and check it against the time a write was proposed at
+func getAt(txn kvTxn, key []byte, now time.Time) (kvValue, error) {
+	v, err := txn.Get(key)
+	if err == nil && v.ExpiresAt != 0 && uint64(now.Unix()) >= v.ExpiresAt {
+		return kvValue{}, errKeyNotFound
+	}
+	return v, err
+}
+
+// keyExists returns an allocator existence check reading from txn as of
+// now
+func keyExists(txn kvTxn, now time.Time) func([]byte) (bool, error) {
+	return func(key []byte) (bool, error) {
+		_, err := getAt(txn, key, now)
+		if err == errKeyNotFound {
+			return false, nil
+		}
+		return err == nil, err
+	}
+}
+
 func (store *URLStore) Close() error {
+	store.stopMaintenance()
 	return store.db.Close()
 }
 
-// Store stores the url in DB, returning the created key
-func (store *URLStore) Store(urlStr string) (string, error) {
+// Sequence returns a persistent counter stored under name, for use by
+// counter based key generators
+func (store *URLStore) Sequence(name string) (KeyCounter, error) {
+	return store.db.Sequence([]byte(META_PREFIX + "seq/" + name))
+}
+
+// SetKeyGenerator replaces the default crypto/rand key generator. It must
+// be called before the store is used
+func (store *URLStore) SetKeyGenerator(gen KeyGenerator) {
+	store.alloc.gen = gen
+}
+
+// SetKeyFilter restricts the store to the keys filter accepts, for stores
+// holding one shard of the key space. Generated keys are only picked from
+// those keys, and aliases and imports outside them fail with
+// ErrWrongShard. It must be called before the store is used
+func (store *URLStore) SetKeyFilter(filter func(key []byte) bool) {
+	store.alloc.filter = filter
+}
+
+// ownsKey reports whether key belongs to this store's shard
+func (store *URLStore) ownsKey(key string) error {
+	if store.alloc.filter != nil && !store.alloc.filter([]byte(key)) {
+		return fmt.Errorf("%w: %s", ErrWrongShard, key)
+	}
+	return nil
+}
+
+// Store stores the url in DB, returning the created key. With
+// opts.Dedupe, the key of an existing permanent link is returned instead
+// if there is one
+func (store *URLStore) Store(urlStr string, opts LinkOptions) (string, error) {
 	if !ValidUrl(urlStr) {
-		return "", fmt.Errorf("invalid url: %s", urlStr)
+		return "", fmt.Errorf("%w: %s", ErrInvalidURL, urlStr)
 	}
-	key := make([]byte, 0, 7)
-	err := store.db.Update(func(txn *badger.Txn) error {
-		// keep generating keys until we find an unused one
-		base62Encode(genKey(), &key)
-		for _, err := txn.Get(key); err != badger.ErrKeyNotFound; {
-			base62Encode(genKey(), &key)
+	batch, err := store.alloc.batch(1)
+	if err != nil {
+		return "", err
+	}
+	key := make([]byte, 0, MAX_KEY_LEN)
+	err = store.db.Update(func(txn kvTxn) error {
+		if opts.Dedupe && opts.ExpiresAt.IsZero() {
+			existing, err := lookupDedupe(txn, urlStr)
+			if err != nil {
+				return err
+			} else if existing != "" {
+				key = append(key[:0], existing...)
+				return nil
+			}
 		}
-		err := txn.Set(key, []byte(urlStr))
-		return err
+		if err := batch.allocate(txn, &key, keyExists(txn, time.Now())); err != nil {
+			return err
+		}
+		rec := opts.record(urlStr)
+		if err := writeRecord(txn, key, rec); err != nil {
+			return err
+		}
+		return indexDedupe(txn, key, rec)
 	})
 	if err != nil {
 		return "", err
@@ -86,30 +335,165 @@ func (store *URLStore) Store(urlStr string) (string, error) {
 	return string(key), nil
 }
 
-// Queries a key for a URL
-func (store *URLStore) Query(key string) (string, error) {
-	var ret string
-	err := store.db.View(func(txn *badger.Txn) error {
-		v, err := txn.Get([]byte(key))
-		if err != nil {
+// StoreAlias stores the url in DB under a user chosen alias instead of a
+// generated key. The alias is only written if it is not already used by
+// another url or reserved for a cache server
+func (store *URLStore) StoreAlias(alias, urlStr string, opts LinkOptions) error {
+	if err := store.checkAlias(alias, urlStr); err != nil {
+		return err
+	}
+	return store.storeAlias(alias, opts.record(urlStr), time.Now())
+}
+
+// checkAlias validates an alias and the url it is for
+func (store *URLStore) checkAlias(alias, urlStr string) error {
+	if err := ValidAlias(alias); err != nil {
+		return err
+	}
+	if gen, ok := store.alloc.gen.(UniqueKeyGenerator); ok && gen.Owns(alias) {
+		return fmt.Errorf("%w: %s may collide with a generated key", ErrInvalidAlias, alias)
+	}
+	if err := store.ownsKey(alias); err != nil {
+		return err
+	}
+	if !ValidUrl(urlStr) {
+		return fmt.Errorf("%w: %s", ErrInvalidURL, urlStr)
+	}
+	return nil
+}
+
+func (store *URLStore) storeAlias(alias string, rec LinkRecord, now time.Time) error {
+	aliasBytes := []byte(alias)
+	return store.db.Update(func(txn kvTxn) error {
+		_, err := getAt(txn, aliasBytes, now)
+		if err == nil {
+			return fmt.Errorf("%w: %s", ErrAliasInUse, alias)
+		} else if err != errKeyNotFound {
 			return err
 		}
-		err = v.Value(func(val []byte) error {
-			ret = string(val)
-			return nil
-		})
-		// empty keys are generated via a "reserve" api call
+		return writeRecord(txn, aliasBytes, rec)
+	})
+}
+
+// Queries a key for its link record. Missing, expired, disabled and
+// deleted links fail with ErrLinkNotFound, ErrLinkExpired, ErrLinkDisabled
+// and ErrLinkDeleted
+func (store *URLStore) Query(key string) (LinkRecord, error) {
+	if !ValidKey(key) {
+		return LinkRecord{}, fmt.Errorf("invalid key: %s", key)
+	}
+	var ret LinkRecord
+	now := time.Now()
+	err := store.db.View(func(txn kvTxn) error {
+		v, err := getAt(txn, []byte(key), now)
+		if err == errKeyNotFound {
+			return fmt.Errorf("%w: %s", ErrLinkNotFound, key)
+		} else if err != nil {
+			return err
+		}
+		ret, err = readRecord(v)
+		// reserved keys are generated via a "reserve" api call
 		if err != nil {
 			return err
-		} else if len(ret) == 0 {
+		} else if ret.Reserved() {
 			return fmt.Errorf("key reserved for cache server: %s", key)
+		} else if ret.Deleted() {
+			return fmt.Errorf("%w: %s", ErrLinkDeleted, key)
+		} else if ret.Disabled() {
+			return fmt.Errorf("%w: %s", ErrLinkDisabled, key)
+		} else if ret.Expired(now) {
+			return fmt.Errorf("%w: %s", ErrLinkExpired, key)
 		}
 		return nil
 	})
 	if err != nil {
-		return "", err
+		return LinkRecord{}, err
 	}
-	return ret, err
+	return ret, nil
+}
+
+// Delete replaces a link with a tombstone. The key stays taken so that
+// it is never handed out again for a different url
+func (store *URLStore) Delete(key string) error {
+	return store.deleteLink(key, time.Now())
+}
+
+// deleteLink deletes a link existing as of now
+func (store *URLStore) deleteLink(key string, now time.Time) error {
+	return store.modifyLink(key, now, func(rec *LinkRecord) error {
+		*rec = LinkRecord{CreatedAt: rec.CreatedAt, Flags: LINK_FLAG_DELETED}
+		return nil
+	})
+}
+
+// Disable stops a link from being followed, or allows it again if
+// disabled is false
+func (store *URLStore) Disable(key string, disabled bool) error {
+	return store.disableLink(key, disabled, time.Now())
+}
+
+// disableLink disables or allows a link existing as of now
+func (store *URLStore) disableLink(key string, disabled bool, now time.Time) error {
+	return store.modifyLink(key, now, func(rec *LinkRecord) error {
+		if disabled {
+			rec.Flags |= LINK_FLAG_DISABLED
+		} else {
+			rec.Flags &^= LINK_FLAG_DISABLED
+		}
+		return nil
+	})
+}
+
+// Update points an existing link at a new url, keeping the key and
+// recording the previous url in the link's history
+func (store *URLStore) Update(key, urlStr string) error {
+	if !ValidUrl(urlStr) {
+		return fmt.Errorf("%w: %s", ErrInvalidURL, urlStr)
+	}
+	return store.updateLink(key, urlStr, time.Now())
+}
+
+// updateLink updates a link as of now, which becomes the time the
+// previous url was replaced at
+func (store *URLStore) updateLink(key, urlStr string, now time.Time) error {
+	return store.modifyLink(key, now, func(rec *LinkRecord) error {
+		rec.History = append(rec.History, LinkHistory{URL: rec.URL, ReplacedAt: now.Unix()})
+		if len(rec.History) > MAX_LINK_HISTORY {
+			rec.History = rec.History[len(rec.History)-MAX_LINK_HISTORY:]
+		}
+		rec.URL = urlStr
+		return nil
+	})
+}
+
+// modifyLink applies fn to the record of a link existing as of now,
+// failing with ErrLinkNotFound for missing, reserved and deleted keys
+func (store *URLStore) modifyLink(key string, now time.Time, fn func(rec *LinkRecord) error) error {
+	if !ValidKey(key) {
+		return fmt.Errorf("invalid key: %s", key)
+	}
+	keyBytes := []byte(key)
+	return store.db.Update(func(txn kvTxn) error {
+		v, err := getAt(txn, keyBytes, now)
+		if err == errKeyNotFound {
+			return fmt.Errorf("%w: %s", ErrLinkNotFound, key)
+		} else if err != nil {
+			return err
+		}
+		rec, err := readRecord(v)
+		if err != nil {
+			return err
+		} else if rec.Reserved() || rec.Deleted() {
+			return fmt.Errorf("%w: %s", ErrLinkNotFound, key)
+		}
+		if err := fn(&rec); err != nil {
+			return err
+		}
+		if err := writeRecord(txn, keyBytes, rec); err != nil {
+			return err
+		}
+		return indexDedupe(txn, keyBytes, rec)
+	})
 }
 
 // Reserves num keys and returns them. These keys can then be handed
@@ -119,18 +503,20 @@ func (store *URLStore) Reserve(num int) ([]string, error) {
 	if num <= 0 || num > MAX_RESERVE_NUM {
 		return []string{}, fmt.Errorf("invalid num %d", num)
 	}
+	batch, err := store.alloc.batch(num)
+	if err != nil {
+		return []string{}, err
+	}
 	ret := make([]string, 0, num)
-	err := store.db.Update(func(txn *badger.Txn) error {
-		key := make([]byte, 0, 7)
+	err = store.db.Update(func(txn kvTxn) error {
+		key := make([]byte, 0, MAX_KEY_LEN)
+		now := time.Now()
+		exists := keyExists(txn, now)
 		for i := 0; i < num; i++ {
-			base62Encode(genKey(), &key)
-			for _, err := txn.Get(key); err != badger.ErrKeyNotFound; {
-				base62Encode(genKey(), &key)
+			if err := batch.allocate(txn, &key, exists); err != nil {
+				return err
 			}
-			// set an expiration date so that we don't waste keys if a cache server goes down
-			e := badger.NewEntry(key, []byte("")).WithTTL(RESERVE_EXPIRY)
-			err := txn.SetEntry(e)
-			if err != nil {
+			if err := writeReserved(txn, key, now); err != nil {
 				return err
 			}
 			ret = append(ret, string(key))
@@ -143,22 +529,148 @@ func (store *URLStore) Reserve(num int) ([]string, error) {
 	return ret, nil
 }
 
+// writeReserved reserves key as of now. reservations expire so that we
+// don't waste keys if a cache server goes down
+func writeReserved(txn kvTxn, key []byte, now time.Time) error {
+	reserved := LinkRecord{CreatedAt: now.Unix(), Flags: LINK_FLAG_RESERVED}.Encode()
+	return txn.Set(key, reserved, uint64(now.Add(RESERVE_EXPIRY).Unix()))
+}
+
+// pickKeys allocates num unused keys without writing them, for writes
+// that are decided in one place and applied in another. The keys may be
+// taken by the time they are written, which storeKey and reserveKeys
+// report with errKeyTaken. It also returns the key length they were
+// picked at, to be written along with them
+func (store *URLStore) pickKeys(num int) ([]string, int, error) {
+	batch, err := store.alloc.batch(num)
+	if err != nil {
+		return nil, 0, err
+	}
+	ret := make([]string, 0, num)
+	picked := make(map[string]bool, num)
+	err = store.db.View(func(txn kvTxn) error {
+		key := make([]byte, 0, MAX_KEY_LEN)
+		exists := keyExists(txn, time.Now())
+		for len(ret) < num {
+			err := batch.allocate(nil, &key, func(k []byte) (bool, error) {
+				if picked[string(k)] {
+					return true, nil
+				}
+				return exists(k)
+			})
+			if err != nil {
+				return err
+			}
+			picked[string(key)] = true
+			ret = append(ret, string(key))
+		}
+		return nil
+	})
+	return ret, store.alloc.keyLen(), err
+}
+
+// storeKey stores rec under a key from pickKeys, picked at keyLen, as of
+// now. With dedupe, the key of an existing permanent link to the same url
+// is returned instead
+func (store *URLStore) storeKey(
+	key string, keyLen int, rec LinkRecord, dedupe bool, now time.Time,
+) (string, error) {
+	ret := key
+	err := store.db.Update(func(txn kvTxn) error {
+		if dedupe && rec.ExpiresAt == 0 {
+			existing, err := lookupDedupe(txn, rec.URL)
+			if err != nil {
+				return err
+			} else if existing != "" {
+				ret = existing
+				return nil
+			}
+		}
+		if taken, err := keyExists(txn, now)([]byte(key)); err != nil {
+			return err
+		} else if taken {
+			return fmt.Errorf("%w: %s", errKeyTaken, key)
+		}
+		if err := store.raiseKeyLen(txn, keyLen); err != nil {
+			return err
+		}
+		if err := writeRecord(txn, []byte(key), rec); err != nil {
+			return err
+		}
+		return indexDedupe(txn, []byte(key), rec)
+	})
+	return ret, err
+}
+
+// reserveKeys reserves keys from pickKeys, picked at keyLen, as of now
+func (store *URLStore) reserveKeys(keys []string, keyLen int, now time.Time) error {
+	return store.db.Update(func(txn kvTxn) error {
+		if err := store.raiseKeyLen(txn, keyLen); err != nil {
+			return err
+		}
+		exists := keyExists(txn, now)
+		for _, key := range keys {
+			if taken, err := exists([]byte(key)); err != nil {
+				return err
+			} else if taken {
+				return fmt.Errorf("%w: %s", errKeyTaken, key)
+			}
+			if err := writeReserved(txn, []byte(key), now); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Iterate calls fn with every key and its record, skipping the store's
+// own bookkeeping and entries kept past their expiry
+func (store *URLStore) Iterate(fn func(key string, rec LinkRecord) error) error {
+	now := uint64(time.Now().Unix())
+	return store.db.Iterate(nil, func(key []byte, val kvValue) error {
+		if !ValidKey(string(key)) || val.ExpiresAt != 0 && now >= val.ExpiresAt {
+			return nil
+		}
+		rec, err := readRecord(val)
+		if err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+		return fn(string(key), rec)
+	})
+}
+
 // SetReserve sets a shortened url key to the url, if the key is not in
 // use. This is for cache servers to use with their reserved keys
-func (store *URLStore) SetReserve(key string, urlStr string) error {
+func (store *URLStore) SetReserve(key string, urlStr string, opts LinkOptions) error {
 	if !ValidKey(key) {
 		return fmt.Errorf("invalid key: %s", key)
 	}
 	if !ValidUrl(urlStr) {
-		return fmt.Errorf("invalid url: %s", urlStr)
+		return fmt.Errorf("%w: %s", ErrInvalidURL, urlStr)
 	}
+	return store.setReserved(key, opts.record(urlStr), time.Now())
+}
+
+// setReserved replaces the reserved record of key with rec, if the key
+// is still reserved as of now
+func (store *URLStore) setReserved(key string, rec LinkRecord, now time.Time) error {
 	keyBytes := []byte(key)
-	err := store.db.Update(func(txn *badger.Txn) error {
-		if v, err := txn.Get(keyBytes); err == badger.ErrKeyNotFound || v.ValueSize() != 0 {
+	err := store.db.Update(func(txn kvTxn) error {
+		v, err := getAt(txn, keyBytes, now)
+		if err == errKeyNotFound {
+			return fmt.Errorf("invalid cache key: %s", key)
+		} else if err != nil {
+			return err
+		}
+		if rec, err := readRecord(v); err != nil {
+			return err
+		} else if !rec.Reserved() {
 			return fmt.Errorf("invalid cache key: %s", key)
 		}
-		err := txn.Set(keyBytes, []byte(urlStr))
-		return err
+		if err := writeRecord(txn, keyBytes, rec); err != nil {
+			return err
+		}
+		return indexDedupe(txn, keyBytes, rec)
 	})
 	if err != nil {
 		return err
@@ -166,16 +678,168 @@ func (store *URLStore) SetReserve(key string, urlStr string) error {
 	return nil
 }
 
-// Ensures that the keys are alphanumeric
+// Release returns keys a cache server reserved but never used, so that
+// they can be handed out again. It returns the keys that were released,
+// leaving out keys that were set since or whose reservation expired
+func (store *URLStore) Release(keys []string) ([]string, error) {
+	return store.release(keys, time.Now())
+}
+
+// release releases keys whose reservation is still live as of now
+func (store *URLStore) release(keys []string, now time.Time) ([]string, error) {
+	if len(keys) > MAX_RESERVE_NUM {
+		return []string{}, fmt.Errorf("invalid num %d", len(keys))
+	}
+	for _, key := range keys {
+		if !ValidKey(key) {
+			return []string{}, fmt.Errorf("invalid key: %s", key)
+		}
+	}
+	released := []string{}
+	err := store.db.Update(func(txn kvTxn) error {
+		for _, key := range keys {
+			v, err := getAt(txn, []byte(key), now)
+			if err == errKeyNotFound {
+				continue
+			} else if err != nil {
+				return err
+			}
+			if rec, err := readRecord(v); err != nil {
+				return err
+			} else if !rec.Reserved() {
+				continue
+			}
+			if err := txn.Delete([]byte(key)); err != nil {
+				return err
+			}
+			released = append(released, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return []string{}, err
+	}
+	return released, nil
+}
+
+// Import stores a record exported from another store under the same key.
+// It reports false without writing if the key already holds an identical
+// record, and fails with ErrImportConflict if it holds anything else.
+// Reserved records belong to the exporting store's cache servers and are
+// rejected
+func (store *URLStore) Import(key string, rec LinkRecord) (bool, error) {
+	return store.importLink(key, rec, time.Now())
+}
+
+// importLink imports rec under key, comparing it with what the key holds
+// as of now
+func (store *URLStore) importLink(key string, rec LinkRecord, now time.Time) (bool, error) {
+	if !ValidKey(key) {
+		return false, fmt.Errorf("invalid key: %s", key)
+	}
+	if rec.Reserved() {
+		return false, fmt.Errorf("reserved keys cannot be imported: %s", key)
+	}
+	if !rec.Deleted() && !ValidUrl(rec.URL) {
+		return false, fmt.Errorf("%w: %s", ErrInvalidURL, rec.URL)
+	}
+	if gen, ok := store.alloc.gen.(UniqueKeyGenerator); ok && gen.Owns(key) {
+		return false, fmt.Errorf("%w: %s may collide with a generated key", ErrImportConflict, key)
+	}
+	if err := store.ownsKey(key); err != nil {
+		return false, err
+	}
+	keyBytes := []byte(key)
+	imported := false
+	err := store.db.Update(func(txn kvTxn) error {
+		v, err := getAt(txn, keyBytes, now)
+		if err == nil {
+			existing, err := readRecord(v)
+			if err != nil {
+				return err
+			} else if !bytes.Equal(existing.Encode(), rec.Encode()) {
+				// compared encoded, so that an empty history matches a missing one
+				return fmt.Errorf("%w: %s", ErrImportConflict, key)
+			}
+			return nil
+		} else if err != errKeyNotFound {
+			return err
+		}
+		if err := writeRecord(txn, keyBytes, rec); err != nil {
+			return err
+		}
+		imported = true
+		return indexDedupe(txn, keyBytes, rec)
+	})
+	return imported, err
+}
+
+// Purge removes a key outright, unlike Delete which leaves a tombstone.
+// It is meant for keys that moved to another shard, which now answers for
+// them, and fails with ErrLinkNotFound if the key is not in the store
+func (store *URLStore) Purge(key string) error {
+	return store.purge(key, time.Now())
+}
+
+// purge removes key if it is in the store as of now
+func (store *URLStore) purge(key string, now time.Time) error {
+	if !ValidKey(key) {
+		return fmt.Errorf("invalid key: %s", key)
+	}
+	keyBytes := []byte(key)
+	return store.db.Update(func(txn kvTxn) error {
+		v, err := getAt(txn, keyBytes, now)
+		if err == errKeyNotFound {
+			return fmt.Errorf("%w: %s", ErrLinkNotFound, key)
+		} else if err != nil {
+			return err
+		}
+		rec, err := readRecord(v)
+		if err != nil {
+			return err
+		}
+		if !rec.Deleted() && !rec.Reserved() {
+			indexed, err := txn.Get(dedupeKey(rec.URL))
+			if err == nil && string(indexed.Value) == key {
+				if err := txn.Delete(dedupeKey(rec.URL)); err != nil {
+					return err
+				}
+			} else if err != nil && err != errKeyNotFound {
+				return err
+			}
+		}
+		return txn.Delete(keyBytes)
+	})
+}
+
+// Ensures that the keys are alphanumeric. Generated keys are always
+// base62, but aliases may also use '-' and '_'
 func ValidKey(key string) bool {
 	for _, c := range key {
-		if !(c >= '0' && c <= '9' || c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z') {
+		if !(c >= '0' && c <= '9' || c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c == '-' || c == '_') {
 			return false
 		}
 	}
 	return len(key) > 0
 }
 
+// ValidAlias checks a user chosen alias against the key, length and
+// reserved word policy, returning an error describing the violation
+func ValidAlias(alias string) error {
+	if len(alias) < MIN_ALIAS_LEN || len(alias) > MAX_ALIAS_LEN {
+		return fmt.Errorf(
+			"%w: must be between %d and %d characters", ErrInvalidAlias, MIN_ALIAS_LEN, MAX_ALIAS_LEN,
+		)
+	}
+	if !ValidKey(alias) {
+		return fmt.Errorf("%w: may only contain letters, digits, '-' and '_'", ErrInvalidAlias)
+	}
+	if reservedAliases[strings.ToLower(alias)] {
+		return fmt.Errorf("%w: %s is a reserved word", ErrInvalidAlias, alias)
+	}
+	return nil
+}
+
 func ValidUrl(urlStr string) bool {
 	if len(urlStr) > MAX_URL_LEN {
 		return false
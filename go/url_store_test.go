@@ -1,7 +1,13 @@
 package shortener
 
 import (
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestBase62Encode(t *testing.T) {
@@ -21,3 +27,522 @@ func TestBase62Encode(t *testing.T) {
 		t.Errorf("Expected 'R15J' as output, got: %s\n", string(enc))
 	}
 }
+
+func TestParseExpiry(t *testing.T) {
+	now := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+	for in, want := range map[string]time.Time{
+		"":                     {},
+		"72h":                  now.Add(72 * time.Hour),
+		"2021-04-01T00:00:00Z": time.Date(2021, 4, 1, 0, 0, 0, 0, time.UTC),
+	} {
+		got, err := ParseExpiry(in, now)
+		if err != nil {
+			t.Errorf("Unexpected error parsing %q: %s", in, err.Error())
+		} else if !got.Equal(want) {
+			t.Errorf("Expected %s parsing %q, got: %s", want, in, got)
+		}
+	}
+	for _, in := range []string{"-1h", "2020-01-01T00:00:00Z", "tomorrow"} {
+		if _, err := ParseExpiry(in, now); !errors.Is(err, ErrInvalidExpiry) {
+			t.Errorf("Expected ErrInvalidExpiry parsing %q, got: %v", in, err)
+		}
+	}
+}
+
+func TestURLStoreExpiry(t *testing.T) {
+	testDB := "./test_db_expiry"
+	store, err := NewURLStore(testDB)
+	if err != nil {
+		t.Fatalf("Unable to create test store: %s", err.Error())
+	}
+	t.Cleanup(func() {
+		store.Close()
+		os.RemoveAll(testDB)
+	})
+
+	expiresAt := time.Now().Add(time.Hour).Truncate(time.Second)
+	key, err := store.Store("http://example.com", LinkOptions{ExpiresAt: expiresAt})
+	if err != nil {
+		t.Fatalf("Unable to store url: %s", err.Error())
+	}
+	rec, err := store.Query(key)
+	if err != nil {
+		t.Fatalf("Unable to query key: %s", err.Error())
+	} else if !rec.Expiry().Equal(expiresAt) {
+		t.Errorf("Expected expiry %s, got: %s", expiresAt, rec.Expiry())
+	}
+
+	key, err = store.Store("http://example.com", LinkOptions{ExpiresAt: time.Now().Add(-time.Second)})
+	if err != nil {
+		t.Fatalf("Unable to store url: %s", err.Error())
+	}
+	if _, err = store.Query(key); !errors.Is(err, ErrLinkExpired) {
+		t.Errorf("Expected ErrLinkExpired, got: %v", err)
+	}
+}
+
+func TestKeyGenerators(t *testing.T) {
+	var key []byte
+	for _, gen := range []KeyGenerator{CryptoKeyGenerator{}, NewSeededKeyGenerator(1)} {
+		for i := 0; i < 100; i++ {
+			if err := gen.GenKey(KEY_LEN, &key); err != nil {
+				t.Fatalf("Unable to generate key: %s", err.Error())
+			}
+			if len(key) != KEY_LEN || !ValidKey(string(key)) {
+				t.Errorf("Expected a %d digit base62 key, got: %s", KEY_LEN, string(key))
+			}
+		}
+	}
+
+	var other []byte
+	a, b := NewSeededKeyGenerator(42), NewSeededKeyGenerator(42)
+	for i := 0; i < 10; i++ {
+		a.GenKey(KEY_LEN, &key)
+		b.GenKey(KEY_LEN, &other)
+		if string(key) != string(other) {
+			t.Errorf("Expected seeded generators to agree, got: %s and %s", string(key), string(other))
+		}
+	}
+}
+
+func TestKeyAllocator(t *testing.T) {
+	var key []byte
+	// every candidate of the starting length collides
+	crowded := func(key []byte) (bool, error) {
+		return len(key) == KEY_LEN, nil
+	}
+	grown := 0
+	alloc := newKeyAllocator(NewSeededKeyGenerator(1), KEY_LEN, func(txn kvTxn, length int) error {
+		grown = length
+		return nil
+	})
+	for i := 0; i < KEY_GROW_WINDOW/MAX_KEY_RETRIES; i++ {
+		if err := alloc.allocate(nil, &key, crowded); !errors.Is(err, ErrKeySpaceExhausted) {
+			t.Fatalf("Expected ErrKeySpaceExhausted, got: %v", err)
+		}
+	}
+	if err := alloc.allocate(nil, &key, crowded); err != nil {
+		t.Fatalf("Unable to allocate after growing: %s", err.Error())
+	}
+	if len(key) != KEY_LEN+1 {
+		t.Errorf("Expected a %d digit key, got: %s", KEY_LEN+1, string(key))
+	}
+	if grown != KEY_LEN+1 {
+		t.Errorf("Expected keys to grow to %d digits, got: %d", KEY_LEN+1, grown)
+	}
+}
+
+// crowdedKeyGenerator only has a single key of the starting length, so
+// that stores using it have to grow their keys
+type crowdedKeyGenerator struct {
+	longer *SeededKeyGenerator
+}
+
+func (gen crowdedKeyGenerator) GenKey(n int, key *[]byte) error {
+	if n == KEY_LEN {
+		*key = append((*key)[:0], strings.Repeat("a", KEY_LEN)...)
+		return nil
+	}
+	return gen.longer.GenKey(n, key)
+}
+
+// growKeys stores links with a crowdedKeyGenerator until keys grow,
+// returning the first longer key
+func growKeys(t *testing.T, store LinkStore) string {
+	// the first link takes the only key of the starting length
+	if _, err := store.Store("http://example.com", LinkOptions{}); err != nil {
+		t.Fatalf("Unable to store url: %s", err.Error())
+	}
+	// every attempt collides until the window is done
+	var key string
+	var err error
+	for i := 0; i <= KEY_GROW_WINDOW/MAX_KEY_RETRIES; i++ {
+		if key, err = store.Store("http://example.com", LinkOptions{}); !errors.Is(err, ErrKeySpaceExhausted) {
+			break
+		}
+	}
+	if err != nil {
+		t.Fatalf("Unable to store url after growing: %s", err.Error())
+	}
+	if len(key) != KEY_LEN+1 {
+		t.Fatalf("Expected a %d digit key, got: %s", KEY_LEN+1, key)
+	}
+	return key
+}
+
+func TestURLStoreKeyGrowth(t *testing.T) {
+	store, err := NewMemoryURLStore()
+	if err != nil {
+		t.Fatalf("Unable to create test store: %s", err.Error())
+	}
+	defer store.Close()
+	store.SetKeyGenerator(crowdedKeyGenerator{NewSeededKeyGenerator(1)})
+	growKeys(t, store)
+	if keyLen, err := store.readKeyLen(); err != nil || keyLen != KEY_LEN+1 {
+		t.Errorf("Expected stored key length %d, got: %d, %v", KEY_LEN+1, keyLen, err)
+	}
+}
+
+type testCounter uint64
+
+func (c *testCounter) Next() (uint64, error) {
+	*c++
+	return uint64(*c - 1), nil
+}
+
+func TestFeistelKeyGenerator(t *testing.T) {
+	gen, err := NewFeistelKeyGenerator([]byte("secret"), new(testCounter))
+	if err != nil {
+		t.Fatalf("Unable to create generator: %s", err.Error())
+	}
+	seen := make(map[string]bool)
+	var key []byte
+	for i := 0; i < 10000; i++ {
+		if err := gen.GenKey(KEY_LEN, &key); err != nil {
+			t.Fatalf("Unable to generate key: %s", err.Error())
+		}
+		if !gen.Owns(string(key)) {
+			t.Errorf("Expected a %d digit base62 key, got: %s", KEY_LEN, string(key))
+		}
+		if seen[string(key)] {
+			t.Fatalf("Key %s generated twice", string(key))
+		}
+		seen[string(key)] = true
+	}
+
+	// the last value of the key space still maps into it
+	if num := gen.permute(MAX_KEY_NUM - 1); num >= MAX_KEY_NUM {
+		t.Errorf("Expected permuted value below %d, got: %d", uint64(MAX_KEY_NUM), num)
+	}
+	exhausted := testCounter(MAX_KEY_NUM)
+	gen.counter = &exhausted
+	if err := gen.GenKey(KEY_LEN, &key); !errors.Is(err, ErrKeySpaceExhausted) {
+		t.Errorf("Expected ErrKeySpaceExhausted, got: %v", err)
+	}
+}
+
+func TestURLStoreDedupe(t *testing.T) {
+	testDB := "./test_db_dedupe"
+	store, err := NewURLStore(testDB)
+	if err != nil {
+		t.Fatalf("Unable to create test store: %s", err.Error())
+	}
+	t.Cleanup(func() {
+		store.Close()
+		os.RemoveAll(testDB)
+	})
+
+	first, err := store.Store("http://example.com/page", LinkOptions{})
+	if err != nil {
+		t.Fatalf("Unable to store url: %s", err.Error())
+	}
+	again, err := store.Store("HTTP://Example.com/page", LinkOptions{Dedupe: true})
+	if err != nil {
+		t.Fatalf("Unable to store url: %s", err.Error())
+	} else if again != first {
+		t.Errorf("Expected deduped key %s, got: %s", first, again)
+	}
+	fresh, err := store.Store("http://example.com/page", LinkOptions{})
+	if err != nil {
+		t.Fatalf("Unable to store url: %s", err.Error())
+	} else if fresh == first {
+		t.Errorf("Expected a new key without dedupe, got: %s", fresh)
+	}
+	expiring, err := store.Store("http://example.com/page", LinkOptions{
+		Dedupe: true, ExpiresAt: time.Now().Add(time.Hour),
+	})
+	if err != nil {
+		t.Fatalf("Unable to store url: %s", err.Error())
+	} else if expiring == first || expiring == fresh {
+		t.Errorf("Expected expiring link to get its own key, got: %s", expiring)
+	}
+}
+
+func TestURLStoreUpdate(t *testing.T) {
+	testDB := "./test_db_update"
+	store, err := NewURLStore(testDB)
+	if err != nil {
+		t.Fatalf("Unable to create test store: %s", err.Error())
+	}
+	t.Cleanup(func() {
+		store.Close()
+		os.RemoveAll(testDB)
+	})
+
+	key, err := store.Store("http://example.com/old", LinkOptions{})
+	if err != nil {
+		t.Fatalf("Unable to store url: %s", err.Error())
+	}
+	if err = store.Update(key, "http://example.com/new"); err != nil {
+		t.Fatalf("Unable to update url: %s", err.Error())
+	}
+	rec, err := store.Query(key)
+	if err != nil {
+		t.Fatalf("Unable to query key: %s", err.Error())
+	}
+	if rec.URL != "http://example.com/new" {
+		t.Errorf("Expected updated url, got: %s", rec.URL)
+	}
+	if len(rec.History) != 1 || rec.History[0].URL != "http://example.com/old" {
+		t.Errorf("Expected old url in history, got: %+v", rec.History)
+	}
+	if err = store.Update("BADKEY", "http://example.com"); !errors.Is(err, ErrLinkNotFound) {
+		t.Errorf("Expected ErrLinkNotFound, got: %v", err)
+	}
+}
+
+func TestURLStoreEngines(t *testing.T) {
+	testDB := "./test_db_engines"
+	t.Cleanup(func() {
+		os.RemoveAll(testDB)
+	})
+	for name, open := range map[string]func() (*URLStore, error){
+		"badger": func() (*URLStore, error) { return NewURLStore(testDB) },
+		"bolt":   func() (*URLStore, error) { return NewBoltURLStore(testDB + ".bolt") },
+		"sqlite": func() (*URLStore, error) { return NewSQLiteURLStore(testDB + ".sqlite") },
+		"memory": NewMemoryURLStore,
+	} {
+		store, err := open()
+		if err != nil {
+			t.Fatalf("%s: unable to create test store: %s", name, err.Error())
+		}
+		key, err := store.Store("http://example.com", LinkOptions{})
+		if err != nil {
+			t.Fatalf("%s: unable to store url: %s", name, err.Error())
+		}
+		if rec, err := store.Query(key); err != nil || rec.URL != "http://example.com" {
+			t.Errorf("%s: expected stored url, got: %+v, %v", name, rec, err)
+		}
+		if err := store.StoreAlias(key, "http://example.com", LinkOptions{}); !errors.Is(err, ErrAliasInUse) {
+			t.Errorf("%s: expected ErrAliasInUse, got: %v", name, err)
+		}
+		expired, err := store.Store("http://example.com", LinkOptions{ExpiresAt: time.Now().Add(-time.Second)})
+		if err != nil {
+			t.Fatalf("%s: unable to store url: %s", name, err.Error())
+		}
+		if _, err := store.Query(expired); !errors.Is(err, ErrLinkExpired) {
+			t.Errorf("%s: expected ErrLinkExpired, got: %v", name, err)
+		}
+		keys, err := store.Reserve(3)
+		if err != nil {
+			t.Fatalf("%s: unable to reserve keys: %s", name, err.Error())
+		}
+		if err := store.SetReserve(keys[0], "http://example.com/r", LinkOptions{}); err != nil {
+			t.Errorf("%s: unable to set reserved key: %s", name, err.Error())
+		}
+		if err := store.SetReserve(keys[0], "http://example.com/r", LinkOptions{}); err == nil {
+			t.Errorf("%s: expected error setting a reserved key twice", name)
+		}
+
+		seen := 0
+		err = store.Iterate(func(key string, rec LinkRecord) error {
+			seen++
+			return nil
+		})
+		if err != nil {
+			t.Errorf("%s: unable to iterate: %s", name, err.Error())
+		} else if seen != 5 {
+			t.Errorf("%s: expected 5 keys, got: %d", name, seen)
+		}
+		if err := store.Close(); err != nil {
+			t.Errorf("%s: unable to close store: %s", name, err.Error())
+		}
+	}
+	os.Remove(testDB + ".bolt")
+	os.Remove(testDB + ".sqlite")
+}
+
+// engines with a single writer hang if anything opens a second write
+// while a store's transaction is open, as leasing sequences or persisting
+// grown keys used to
+func TestURLStoreEngineKeys(t *testing.T) {
+	testDB := "./test_db_keys"
+	t.Cleanup(func() {
+		os.Remove(testDB + ".bolt")
+		os.Remove(testDB + ".sqlite")
+	})
+	for name, open := range map[string]func() (*URLStore, error){
+		"bolt":   func() (*URLStore, error) { return NewBoltURLStore(testDB + ".bolt") },
+		"sqlite": func() (*URLStore, error) { return NewSQLiteURLStore(testDB + ".sqlite") },
+		"memory": NewMemoryURLStore,
+	} {
+		store, err := open()
+		if err != nil {
+			t.Fatalf("%s: unable to create test store: %s", name, err.Error())
+		}
+		counter, err := store.Sequence("keys")
+		if err != nil {
+			t.Fatalf("%s: unable to create sequence: %s", name, err.Error())
+		}
+		gen, err := NewFeistelKeyGenerator([]byte("secret"), counter)
+		if err != nil {
+			t.Fatalf("%s: unable to create generator: %s", name, err.Error())
+		}
+		store.SetKeyGenerator(gen)
+		key, err := store.Store("http://example.com", LinkOptions{})
+		if err != nil {
+			t.Fatalf("%s: unable to store url: %s", name, err.Error())
+		}
+		// more keys than one lease holds
+		keys, err := store.Reserve(SEQUENCE_BANDWIDTH + 1)
+		if err != nil {
+			t.Fatalf("%s: unable to reserve keys: %s", name, err.Error())
+		}
+		seen := map[string]bool{key: true}
+		for _, key := range keys {
+			if seen[key] {
+				t.Fatalf("%s: key %s handed out twice", name, key)
+			}
+			seen[key] = true
+		}
+
+		store.SetKeyGenerator(crowdedKeyGenerator{NewSeededKeyGenerator(1)})
+		growKeys(t, store)
+		if keyLen, err := store.readKeyLen(); err != nil || keyLen != KEY_LEN+1 {
+			t.Errorf("%s: expected stored key length %d, got: %d, %v", name, KEY_LEN+1, keyLen, err)
+		}
+		if err := store.Close(); err != nil {
+			t.Errorf("%s: unable to close store: %s", name, err.Error())
+		}
+	}
+}
+
+func TestSQLiteEngineTables(t *testing.T) {
+	testDB := "./test_db_tables.sqlite"
+	t.Cleanup(func() {
+		os.Remove(testDB)
+		os.Remove(testDB + "-wal")
+		os.Remove(testDB + "-shm")
+	})
+	db, err := openSQLiteEngine(testDB)
+	if err != nil {
+		t.Fatalf("Unable to open test engine: %s", err.Error())
+	}
+	store, err := newURLStore(db)
+	if err != nil {
+		t.Fatalf("Unable to create test store: %s", err.Error())
+	}
+	defer store.Close()
+	key, err := store.Store("http://example.com", LinkOptions{Creator: "analyst"})
+	if err != nil {
+		t.Fatalf("Unable to store url: %s", err.Error())
+	}
+	reserved, err := store.Reserve(2)
+	if err != nil {
+		t.Fatalf("Unable to reserve keys: %s", err.Error())
+	}
+
+	var url, creator string
+	err = db.db.QueryRow("SELECT url, creator FROM links WHERE key = ?", key).Scan(&url, &creator)
+	if err != nil || url != "http://example.com" || creator != "analyst" {
+		t.Errorf("Expected link row, got: %q, %q, %v", url, creator, err)
+	}
+	var count int
+	if err := db.db.QueryRow("SELECT COUNT(*) FROM reservations").Scan(&count); err != nil || count != 2 {
+		t.Errorf("Expected 2 reservations, got: %d, %v", count, err)
+	}
+
+	if err := store.SetReserve(reserved[0], "http://example.com/r", LinkOptions{}); err != nil {
+		t.Fatalf("Unable to set reserved key: %s", err.Error())
+	}
+	if err := db.db.QueryRow("SELECT COUNT(*) FROM reservations").Scan(&count); err != nil || count != 1 {
+		t.Errorf("Expected set key to leave reservations, got: %d, %v", count, err)
+	}
+
+	// reservations past their TTL are hidden, then reclaimed
+	n, err := db.reclaim(time.Now().Add(RESERVE_EXPIRY + time.Minute))
+	if err != nil || n != 1 {
+		t.Errorf("Expected 1 reclaimed row, got: %d, %v", n, err)
+	}
+	if _, err := store.Query(reserved[1]); !errors.Is(err, ErrLinkNotFound) {
+		t.Errorf("Expected reclaimed key to be missing, got: %v", err)
+	}
+}
+
+func TestShardedURLStore(t *testing.T) {
+	ring, _ := NewRendezvous([]string{"a", "b", "c"})
+	store, err := NewMemoryURLStore()
+	if err != nil {
+		t.Fatalf("Unable to create test store: %s", err.Error())
+	}
+	defer store.Close()
+	store.SetKeyFilter(ring.OwnedBy("a"))
+
+	keys, err := store.Reserve(50)
+	if err != nil {
+		t.Fatalf("Unable to reserve keys: %s", err.Error())
+	}
+	for i := 0; i < 50; i++ {
+		key, err := store.Store(fmt.Sprintf("http://example.com/%d", i), LinkOptions{})
+		if err != nil {
+			t.Fatalf("Unable to store url: %s", err.Error())
+		}
+		keys = append(keys, key)
+	}
+	for _, key := range keys {
+		if ring.Owner(key) != "a" {
+			t.Errorf("Shard a generated %s, which belongs to %s", key, ring.Owner(key))
+		}
+	}
+	// filtered keys are not collisions, so keys must not grow
+	if store.alloc.keyLen() != KEY_LEN {
+		t.Errorf("Expected keys to stay %d digits, got %d", KEY_LEN, store.alloc.keyLen())
+	}
+
+	var mine, theirs string
+	for i := 0; mine == "" || theirs == ""; i++ {
+		alias := fmt.Sprintf("alias-%d", i)
+		if ring.Owner(alias) == "a" {
+			mine = alias
+		} else {
+			theirs = alias
+		}
+	}
+	if err := store.StoreAlias(mine, "http://example.com", LinkOptions{}); err != nil {
+		t.Errorf("Unable to store owned alias: %s", err.Error())
+	}
+	err = store.StoreAlias(theirs, "http://example.com", LinkOptions{})
+	if !errors.Is(err, ErrWrongShard) || ErrorCode(err) != ERR_CODE_WRONG_SHARD {
+		t.Errorf("Expected ErrWrongShard storing another shard's alias, got %v", err)
+	}
+	if _, err := store.Import(theirs, LinkRecord{URL: "http://example.com"}); !errors.Is(err, ErrWrongShard) {
+		t.Errorf("Expected ErrWrongShard importing another shard's key, got %v", err)
+	}
+}
+
+func TestURLStorePurge(t *testing.T) {
+	store, err := NewMemoryURLStore()
+	if err != nil {
+		t.Fatalf("Unable to create test store: %s", err.Error())
+	}
+	defer store.Close()
+	key, err := store.Store("http://example.com", LinkOptions{Dedupe: true})
+	if err != nil {
+		t.Fatalf("Unable to store url: %s", err.Error())
+	}
+	if err := store.Purge(key); err != nil {
+		t.Fatalf("Unable to purge key: %s", err.Error())
+	}
+	if _, err := store.Query(key); !errors.Is(err, ErrLinkNotFound) {
+		t.Errorf("Expected purged key to be gone, got %v", err)
+	}
+	if err := store.Purge(key); !errors.Is(err, ErrLinkNotFound) {
+		t.Errorf("Expected purging a missing key to fail with ErrLinkNotFound, got %v", err)
+	}
+	// the dedupe index must not point at the purged key any more
+	again, err := store.Store("http://example.com", LinkOptions{Dedupe: true})
+	if err != nil {
+		t.Fatalf("Unable to store url: %s", err.Error())
+	}
+	if again == key {
+		t.Errorf("Expected a new key after purging, got %s again", key)
+	}
+}
+
+// shardServer is a db server running on a memory store
+type shardServer struct {
+	host   string
+	store  *URLStore
+	server *MainServer
+	http   *httptest.Server
+}
@@ -2,11 +2,13 @@ package shortener
 
 import (
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"net/url"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 )
 
@@ -17,35 +19,72 @@ type WebappServer struct {
 	client *http.Client
 	home   http.Handler
 
-	backendServer string
+	backends *Rendezvous
+	proxies  map[string]http.Handler
 }
 
 func NewWebappServer(webDir, backendServerHost string) (*WebappServer, error) {
+	return NewShardedWebappServer(webDir, []string{backendServerHost})
+}
+
+// NewShardedWebappServer creates a webapp server in front of several
+// backends, routing every key with rendezvous hashing over
+// backendServerHosts the same way cache servers route to db servers
+func NewShardedWebappServer(webDir string, backendServerHosts []string) (*WebappServer, error) {
+	backends, err := NewRendezvous(backendServerHosts)
+	if err != nil {
+		return nil, err
+	}
 	ret := &WebappServer{
 		mux:    http.NewServeMux(),
 		client: &http.Client{},
 		home:   http.FileServer(http.Dir(webDir)),
 
-		backendServer: fmt.Sprintf("http://%s", backendServerHost),
+		backends: backends,
+		proxies:  map[string]http.Handler{},
 	}
-	proxy, err := SimplePostForwarder(ret.backendServer)
-	if err != nil {
-		return nil, fmt.Errorf("error creating webapp server: %s", err.Error())
+	for _, host := range backends.Hosts() {
+		backendServer := fmt.Sprintf("http://%s", host)
+		proxy, err := SimplePostForwarder(backendServer)
+		if err != nil {
+			return nil, fmt.Errorf("error creating webapp server: %s", err.Error())
+		}
+		ret.proxies[host] = proxy
+		err = CheckUrl(backendServer)
+		if err != nil {
+			return nil, fmt.Errorf("could not connect to backend server %s: %s", host, err.Error())
+		}
 	}
 
 	ret.mux.HandleFunc("/", ret.redirect)
-	ret.mux.HandleFunc(SHORTEN_ENDPOINT, proxy.ServeHTTP)
+	ret.mux.HandleFunc(SHORTEN_ENDPOINT, ret.shorten)
+
+	return ret, nil
+}
 
-	err = CheckUrl(ret.backendServer)
+// shorten forwards to the backend owning the alias, or the url if there
+// is none. the form has to be read to pick the backend, so it is encoded
+// again for the proxied request
+func (ws *WebappServer) shorten(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
 	if err != nil {
-		return nil, fmt.Errorf("could not connect to backend server: %s", err.Error())
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("400 - Bad Request"))
+		return
 	}
-
-	return ret, nil
+	key := r.Form.Get("alias")
+	if key == "" {
+		key = normalizeURL(r.Form.Get("url"))
+	}
+	body := r.PostForm.Encode()
+	r.Body = ioutil.NopCloser(strings.NewReader(body))
+	r.ContentLength = int64(len(body))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	ws.proxies[ws.backends.Owner(key)].ServeHTTP(w, r)
 }
 
 func (ws *WebappServer) Start(port uint) error {
-	c := make(chan os.Signal)
+	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		<-c
@@ -73,7 +112,7 @@ func (ws *WebappServer) redirect(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	jsonResp, _, err := PostSetShortenQuery(
-		ws.client, SingleJoiningSlash(ws.backendServer, QUERY_ENDPOINT),
+		ws.client, SingleJoiningSlash(fmt.Sprintf("http://%s", ws.backends.Owner(key)), QUERY_ENDPOINT),
 		url.Values{"key": {key}},
 	)
 	if err != nil {
@@ -83,6 +122,8 @@ func (ws *WebappServer) redirect(w http.ResponseWriter, r *http.Request) {
 	}
 	if jsonResp.Succeeded {
 		http.Redirect(w, r, jsonResp.OriginalURL, REDIRECT_STATUS)
+	} else if jsonResp.Gone() {
+		http.Error(w, "410 - Gone", http.StatusGone)
 	} else {
 		http.NotFound(w, r)
 	}
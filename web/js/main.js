@@ -16,6 +16,8 @@ function encodeForm(obj) {
 function shorten() {
     base = window.location.origin
     input = document.getElementById("input")
+    alias = document.getElementById("alias")
+    expiry = document.getElementById("expiry")
     output = document.getElementById("output")
     output.innerHTML = ""
     var xhr = new XMLHttpRequest()
@@ -37,5 +39,12 @@ function shorten() {
         }
     }
     xhr.setRequestHeader("Content-Type", "application/x-www-form-urlencoded");
-    xhr.send(encodeForm({url:input.value}))
+    form = {url:input.value}
+    if (alias.value) {
+        form.alias = alias.value
+    }
+    if (expiry.value) {
+        form.expiry = expiry.value
+    }
+    xhr.send(encodeForm(form))
 }
\ No newline at end of file